@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -25,6 +26,10 @@ type ArrayParser struct {
 	parser  Parser
 
 	invalid_parser bool
+
+	// Protects parser and invalid_parser which may be filled in by
+	// concurrent calls to Parse()
+	mu sync.Mutex
 }
 
 func (self *ArrayParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -74,33 +79,70 @@ func (self *ArrayParser) getCount(scope vfilter.Scope) int64 {
 	return result
 }
 
-func (self *ArrayParser) Parse(
-	scope vfilter.Scope,
-	reader io.ReaderAt, offset int64) interface{} {
-
-	result_len := self.getCount(scope)
-	result := make([]interface{}, 0, result_len)
+// The element type may be defined after the array so the parser is
+// resolved on first use. Returns nil if the type is not known.
+func (self *ArrayParser) getParser(scope vfilter.Scope) Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
 	if self.invalid_parser {
-		return vfilter.Null{}
+		return nil
 	}
 
+	err := self.resolve()
+	if err != nil {
+		scope.Log("ERROR:binary_parser: ArrayParser: %v", err)
+		self.invalid_parser = true
+		return nil
+	}
+
+	return self.parser
+}
+
+// Must be called with the lock held.
+func (self *ArrayParser) resolve() error {
 	if self.parser == nil {
 		parser, err := self.profile.GetParser(
 			self.options.Type, self.options.TypeOptions)
 		if err != nil {
-			scope.Log("ERROR:binary_parser: ArrayParser: %v", err)
-			self.invalid_parser = true
-			return vfilter.Null{}
+			return err
 		}
 
 		// Cache the parser for next time.
 		self.parser = parser
 	}
+	return nil
+}
+
+func (self *ArrayParser) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	// The type may have been missing at parse time.
+	self.invalid_parser = false
+	return []Parser{self.parser}, nil
+}
+
+func (self *ArrayParser) Parse(
+	scope vfilter.Scope,
+	reader io.ReaderAt, offset int64) interface{} {
+
+	result_len := self.getCount(scope)
+	result := make([]interface{}, 0, result_len)
+
+	parser := self.getParser(scope)
+	if parser == nil {
+		return vfilter.Null{}
+	}
 
 	member_offset := int64(0)
 	for i := int64(0); i < result_len; i++ {
-		element := self.parser.Parse(
+		element := parser.Parse(
 			scope, reader, offset+member_offset)
 
 		// Check for a sentinel value
@@ -118,7 +160,7 @@ func (self *ArrayParser) Parse(
 
 		// The parser may know about the element size, or the
 		// element itself.
-		element_size := SizeOf(self.parser)
+		element_size := SizeOf(parser)
 		if element_size == 0 {
 			element_size = SizeOf(element)
 		}
@@ -184,3 +226,11 @@ func (self *ArrayObject) End() int64 {
 func (self *ArrayObject) MarshalJSON() ([]byte, error) {
 	return json.Marshal(self.Contents())
 }
+
+func (self *ArrayParser) typeReferences() []typeReference {
+	return []typeReference{{
+		option:    "type",
+		type_name: self.options.Type,
+		options:   self.options.TypeOptions,
+	}}
+}
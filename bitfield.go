@@ -75,3 +75,7 @@ func (self *BitFieldParser) Parse(
 
 	return result >> self.options.StartBit
 }
+
+func (self *BitFieldParser) compile() ([]Parser, error) {
+	return []Parser{self.parser}, nil
+}
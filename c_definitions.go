@@ -0,0 +1,1324 @@
+// Import C struct, union, enum and typedef declarations into a
+// profile.
+
+package vtypes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Parse C declarations (e.g. copied from a header file) and add the
+// structs they declare to the profile. Struct layouts are computed
+// using the natural alignment of each member (the usual System V
+// rules), honoring `#pragma pack` and `__attribute__((packed))`.
+//
+// Structs and unions become structs in the profile, fixed size arrays
+// become Array fields (or String fields for char arrays), bit fields
+// become BitField fields, enums become Enumeration fields and
+// pointers become Pointer fields. Typedefs of structs are added as
+// aliases to the struct.
+func (self *Profile) ParseCDefinitions(src string) error {
+	tokens, err := tokenizeC(src)
+	if err != nil {
+		return err
+	}
+
+	parser := &cParser{
+		profile:   self,
+		tokens:    tokens,
+		typedefs:  make(map[string]*cType),
+		records:   make(map[string]*cRecord),
+		enums:     make(map[string]*cType),
+		constants: make(map[string]int64),
+		aliases:   ordereddict.NewDict(),
+		pack:      []int64{0},
+	}
+
+	err = parser.parse()
+	if err != nil {
+		return err
+	}
+
+	definitions, err := parser.structDefinitions()
+	if err != nil {
+		return err
+	}
+
+	err = self.addStructDefinitions(definitions, false)
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range parser.aliases.Keys() {
+		target, _ := parser.aliases.GetString(alias)
+		_, pres := self.types[alias]
+		if !pres {
+			self.types[alias] = self.types[target]
+		}
+	}
+
+	return nil
+}
+
+const (
+	cTokenIdent = iota
+	cTokenNumber
+	cTokenPunct
+	cTokenPragma
+	cTokenEOF
+)
+
+type cToken struct {
+	kind  int
+	value string
+	line  int
+}
+
+func tokenizeC(src string) ([]cToken, error) {
+	var result []cToken
+	line := 1
+	at_line_start := true
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == '\n':
+			line++
+			i++
+			at_line_start = true
+			continue
+
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %v: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+			continue
+
+		case c == '#' && at_line_start:
+			// Preprocessor directives run to the end of the line
+			// (including continuation lines). We only care about
+			// #pragma pack.
+			start := i
+			for i < len(src) && (src[i] != '\n' || src[i-1] == '\\') {
+				if src[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			directive := strings.Join(strings.Fields(src[start+1:i]), " ")
+			if strings.HasPrefix(directive, "pragma pack") {
+				result = append(result, cToken{
+					kind: cTokenPragma, value: directive, line: line})
+			}
+			continue
+
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' ||
+				unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			result = append(result, cToken{
+				kind: cTokenIdent, value: src[start:i], line: line})
+
+		case unicode.IsDigit(rune(c)):
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] == '.' ||
+				unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			result = append(result, cToken{
+				kind: cTokenNumber, value: src[start:i], line: line})
+
+		default:
+			value := string(c)
+			for _, op := range []string{"<<", ">>", "..."} {
+				if strings.HasPrefix(src[i:], op) {
+					value = op
+					break
+				}
+			}
+			if !strings.Contains("{}[]();,:*=+-~!/%&|^<>.?", string(c)) {
+				return nil, fmt.Errorf("line %v: unexpected character %q", line, c)
+			}
+			i += len(value)
+			result = append(result, cToken{
+				kind: cTokenPunct, value: value, line: line})
+		}
+		at_line_start = false
+	}
+
+	return append(result, cToken{kind: cTokenEOF, line: line}), nil
+}
+
+const (
+	cKindBase = iota
+	cKindVoid
+	cKindRecord
+	cKindEnum
+	cKindPointer
+	cKindArray
+	cKindFunction
+)
+
+type cType struct {
+	kind int
+
+	// For base types: the vtypes type name and properties.
+	name   string
+	size   int64
+	signed bool
+
+	// Set for char types - arrays of these become strings.
+	char bool
+	wide bool
+
+	record *cRecord
+
+	// Enumerations
+	choices *ordereddict.Dict
+
+	// Pointer target or array element
+	elem  *cType
+	count int64
+}
+
+type cMember struct {
+	name   string
+	typ    *cType
+	offset int64
+
+	// Bit fields
+	is_bitfield bool
+	start_bit   int64
+	end_bit     int64
+}
+
+type cRecord struct {
+	// The name of the struct in the profile.
+	name     string
+	union    bool
+	complete bool
+
+	members []*cMember
+	size    int64
+	align   int64
+}
+
+type cParser struct {
+	profile *Profile
+	tokens  []cToken
+	pos     int
+
+	typedefs  map[string]*cType
+	records   map[string]*cRecord
+	enums     map[string]*cType
+	constants map[string]int64
+
+	// Records in the order they were defined.
+	defined []*cRecord
+
+	// Typedef name -> struct name
+	aliases *ordereddict.Dict
+
+	// The stack of #pragma pack values (0 means natural alignment).
+	pack []int64
+}
+
+func (self *cParser) peek() cToken {
+	return self.tokens[self.pos]
+}
+
+func (self *cParser) next() cToken {
+	token := self.tokens[self.pos]
+	if token.kind != cTokenEOF {
+		self.pos++
+	}
+	return token
+}
+
+func (self *cParser) is(value string) bool {
+	token := self.peek()
+	return token.kind != cTokenEOF && token.value == value
+}
+
+func (self *cParser) accept(value string) bool {
+	if self.is(value) {
+		self.pos++
+		return true
+	}
+	return false
+}
+
+func (self *cParser) expect(value string) error {
+	if !self.accept(value) {
+		return self.errorf("expected '%v'", value)
+	}
+	return nil
+}
+
+func (self *cParser) errorf(format string, args ...interface{}) error {
+	token := self.peek()
+	found := token.value
+	if token.kind == cTokenEOF {
+		found = "end of input"
+	}
+	return fmt.Errorf("line %v: %v (found '%v')", token.line,
+		fmt.Sprintf(format, args...), found)
+}
+
+func (self *cParser) parse() error {
+	for self.peek().kind != cTokenEOF {
+		if self.peek().kind == cTokenPragma {
+			err := self.parsePragma(self.next())
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if self.accept(";") {
+			continue
+		}
+
+		err := self.parseDeclaration()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Supports #pragma pack(n), pack(push, n), pack(pop) and pack()
+func (self *cParser) parsePragma(token cToken) error {
+	args := strings.TrimSpace(strings.TrimPrefix(token.value, "pragma pack"))
+	args = strings.TrimSuffix(strings.TrimPrefix(args, "("), ")")
+
+	current := self.pack[len(self.pack)-1]
+	for _, arg := range strings.Split(args, ",") {
+		arg = strings.TrimSpace(arg)
+		switch arg {
+		case "":
+			current = 0
+		case "push":
+			self.pack = append(self.pack, current)
+		case "pop":
+			if len(self.pack) > 1 {
+				self.pack = self.pack[:len(self.pack)-1]
+			}
+			current = self.pack[len(self.pack)-1]
+		default:
+			value, err := strconv.ParseInt(arg, 0, 64)
+			if err != nil {
+				return fmt.Errorf("line %v: invalid #pragma pack: %v",
+					token.line, token.value)
+			}
+			current = value
+		}
+	}
+	self.pack[len(self.pack)-1] = current
+	return nil
+}
+
+func (self *cParser) parseDeclaration() error {
+	is_typedef := self.accept("typedef")
+
+	base, err := self.parseTypeSpecifier()
+	if err != nil {
+		return err
+	}
+
+	// Just a struct/union/enum declaration
+	if self.accept(";") {
+		return nil
+	}
+
+	for {
+		name, wrap, err := self.parseDeclarator()
+		if err != nil {
+			return err
+		}
+		self.skipAttributes()
+
+		if is_typedef {
+			if name == "" {
+				return self.errorf("typedef requires a name")
+			}
+			typ := wrap(base)
+			self.typedefs[name] = typ
+
+			// Anonymous structs take the name of their first typedef.
+			if typ.kind == cKindRecord {
+				if typ.record.name == "" {
+					typ.record.name = name
+				} else if typ.record.name != name {
+					self.aliases.Set(name, typ.record.name)
+				}
+			}
+		} else if self.accept("=") {
+			// Skip initializers of variable declarations.
+			_, err := self.skipUntil(",", ";")
+			if err != nil {
+				return err
+			}
+		}
+
+		if self.accept(",") {
+			continue
+		}
+		return self.expect(";")
+	}
+}
+
+// Skip tokens until one of the delimiters at nesting level 0.
+func (self *cParser) skipUntil(delimiters ...string) ([]cToken, error) {
+	var result []cToken
+	depth := 0
+	for {
+		token := self.peek()
+		if token.kind == cTokenEOF {
+			return nil, self.errorf("unexpected end of input")
+		}
+		if depth == 0 {
+			for _, delimiter := range delimiters {
+				if token.value == delimiter {
+					return result, nil
+				}
+			}
+		}
+		switch token.value {
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		result = append(result, self.next())
+	}
+}
+
+// Skip compiler specific decorations but note if the record should be
+// packed.
+func (self *cParser) skipAttributes() (packed bool) {
+	for {
+		token := self.peek()
+		switch token.value {
+		case "__attribute__", "__attribute", "__declspec", "__align":
+			self.next()
+			if self.is("(") {
+				tokens, _ := self.skipBalanced()
+				for _, t := range tokens {
+					if t.value == "packed" || t.value == "__packed__" {
+						packed = true
+					}
+				}
+			}
+
+		case "const", "volatile", "restrict", "__restrict", "__ptr64",
+			"__ptr32", "__unaligned", "__extension__", "extern", "static",
+			"register", "inline", "__inline", "_Atomic", "__cdecl", "__stdcall":
+			self.next()
+
+		default:
+			return packed
+		}
+	}
+}
+
+func (self *cParser) skipBalanced() ([]cToken, error) {
+	var result []cToken
+	depth := 0
+	for {
+		token := self.next()
+		if token.kind == cTokenEOF {
+			return nil, self.errorf("unbalanced parentheses")
+		}
+		result = append(result, token)
+		switch token.value {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return result, nil
+			}
+		}
+	}
+}
+
+var cBaseTypeWords = map[string]bool{
+	"signed": true, "unsigned": true, "char": true, "short": true,
+	"int": true, "long": true, "float": true, "double": true,
+	"void": true, "_Bool": true, "bool": true, "__int8": true,
+	"__int16": true, "__int32": true, "__int64": true, "wchar_t": true,
+}
+
+func (self *cParser) parseTypeSpecifier() (*cType, error) {
+	self.skipAttributes()
+
+	token := self.peek()
+	switch token.value {
+	case "struct", "union":
+		return self.parseRecord()
+
+	case "enum":
+		return self.parseEnum()
+	}
+
+	var words []string
+	for cBaseTypeWords[self.peek().value] {
+		words = append(words, self.next().value)
+		self.skipAttributes()
+	}
+
+	if len(words) > 0 {
+		return self.baseType(words)
+	}
+
+	if token.kind == cTokenIdent {
+		typ, pres := self.typedefs[token.value]
+		if pres {
+			self.next()
+			self.skipAttributes()
+			return typ, nil
+		}
+
+		base_type, pres := cWellKnownTypes[token.value]
+		if pres {
+			self.next()
+			self.skipAttributes()
+			return self.baseType(strings.Split(base_type, " "))
+		}
+
+		signed, pres := cPointerSizedTypes[token.value]
+		if pres {
+			self.next()
+			self.skipAttributes()
+			size := self.pointerSize()
+			return &cType{
+				kind:   cKindBase,
+				name:   intTypeName(size, signed),
+				size:   size,
+				signed: signed,
+			}, nil
+		}
+	}
+
+	return nil, self.errorf("unknown type")
+}
+
+// Common fixed size types used in headers. Byte types are __int8 and
+// not char so arrays of them are byte arrays and not strings.
+var cWellKnownTypes = map[string]string{
+	"int8_t": "__int8", "uint8_t": "unsigned __int8",
+	"int16_t": "short", "uint16_t": "unsigned short",
+	"int32_t": "int", "uint32_t": "unsigned int",
+	"int64_t": "long long", "uint64_t": "unsigned long long",
+	"BYTE": "unsigned __int8", "UCHAR": "unsigned __int8",
+	"CHAR": "char", "BOOLEAN": "unsigned __int8",
+	"WORD": "unsigned short", "USHORT": "unsigned short",
+	"SHORT": "short", "WCHAR": "wchar_t",
+	"DWORD": "unsigned int", "ULONG": "unsigned int",
+	"LONG": "int", "UINT": "unsigned int",
+	"INT": "int", "BOOL": "int",
+	"QWORD": "unsigned long long", "ULONGLONG": "unsigned long long",
+	"LONGLONG": "long long", "DWORD64": "unsigned long long",
+	"ULONG64": "unsigned long long",
+}
+
+// Types as wide as a pointer. The value is true for signed types.
+var cPointerSizedTypes = map[string]bool{
+	"size_t": false, "uintptr_t": false, "SIZE_T": false,
+	"ULONG_PTR": false, "DWORD_PTR": false, "UINT_PTR": false,
+	"ssize_t": true, "intptr_t": true, "ptrdiff_t": true,
+	"SSIZE_T": true, "LONG_PTR": true, "INT_PTR": true,
+}
+
+// Map the C base type onto a vtypes type.
+func (self *cParser) baseType(words []string) (*cType, error) {
+	unsigned := false
+	longs := 0
+	base := ""
+
+	for _, word := range words {
+		switch word {
+		case "unsigned":
+			unsigned = true
+		case "signed":
+		case "long":
+			longs++
+		case "int":
+			if base == "" {
+				base = "int"
+			}
+		default:
+			base = word
+		}
+	}
+
+	var name string
+	switch base {
+	case "void":
+		return &cType{kind: cKindVoid, name: "void", size: 1}, nil
+
+	case "char", "__int8":
+		if !unsigned {
+			return &cType{kind: cKindBase, name: "int8", size: 1,
+				signed: true, char: base == "char"}, nil
+		}
+		return &cType{kind: cKindBase, name: "uint8", size: 1,
+			char: base == "char"}, nil
+
+	case "wchar_t":
+		return &cType{kind: cKindBase, name: "uint16", size: 2,
+			char: true, wide: true}, nil
+
+	case "_Bool", "bool":
+		return &cType{kind: cKindBase, name: "uint8", size: 1}, nil
+
+	case "short", "__int16":
+		name = "short"
+	case "__int32":
+		name = "int"
+	case "__int64":
+		name = "long long"
+
+	case "float", "double":
+		if base == "double" || longs > 0 {
+			name = "double"
+		} else {
+			name = "float"
+		}
+		if longs > 0 {
+			return nil, self.errorf("long double is not supported")
+		}
+
+		parser, pres := self.profile.types[name]
+		size := SizeOf(parser)
+		if !pres || size == 0 {
+			return nil, self.errorf("type %v is not defined in the profile", name)
+		}
+		return &cType{kind: cKindBase, name: name, size: int64(size),
+			signed: true}, nil
+
+	case "int", "":
+		switch longs {
+		case 0:
+			name = "int"
+		case 1:
+			name = "long"
+		default:
+			name = "long long"
+		}
+	}
+
+	if unsigned {
+		name = "unsigned " + name
+	}
+
+	size := self.baseTypeSize(name)
+	return &cType{
+		kind:   cKindBase,
+		name:   intTypeName(size, !unsigned),
+		size:   size,
+		signed: !unsigned,
+	}, nil
+}
+
+// The size of the integer types may be defined by the profile's
+// model, otherwise we use the common sizes.
+func (self *cParser) baseTypeSize(name string) int64 {
+	parser, pres := self.profile.types[name]
+	if pres {
+		size := SizeOf(parser)
+		if size > 0 {
+			return int64(size)
+		}
+	}
+
+	switch strings.TrimPrefix(name, "unsigned ") {
+	case "short":
+		return 2
+	case "long long":
+		return 8
+	default:
+		return 4
+	}
+}
+
+func (self *cParser) pointerSize() int64 {
+	parser, pres := self.profile.types["pointer"]
+	if pres {
+		size := SizeOf(parser)
+		if size > 0 {
+			return int64(size)
+		}
+	}
+	return 8
+}
+
+// Returns the vtypes name for an int of this size.
+func intTypeName(size int64, signed bool) string {
+	name := fmt.Sprintf("int%d", size*8)
+	if !signed {
+		name = "u" + name
+	}
+	return name
+}
+
+func (self *cParser) parseRecord() (*cType, error) {
+	union := self.next().value == "union"
+	packed := self.skipAttributes()
+
+	tag := ""
+	if self.peek().kind == cTokenIdent {
+		tag = self.next().value
+		packed = self.skipAttributes() || packed
+	}
+
+	record, pres := self.records[tag]
+	if tag == "" || !pres {
+		record = &cRecord{name: tag, union: union}
+		if tag != "" {
+			self.records[tag] = record
+		}
+	}
+
+	if !self.accept("{") {
+		if tag == "" {
+			return nil, self.errorf("anonymous struct requires a body")
+		}
+		return &cType{kind: cKindRecord, record: record}, nil
+	}
+
+	if record.complete {
+		return nil, self.errorf("redefinition of %v", tag)
+	}
+
+	var members []*cMember
+	for !self.accept("}") {
+		if self.peek().kind == cTokenPragma {
+			err := self.parsePragma(self.next())
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		new_members, err := self.parseMembers()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, new_members...)
+	}
+	packed = self.skipAttributes() || packed
+
+	pack := self.pack[len(self.pack)-1]
+	if packed {
+		pack = 1
+	}
+
+	err := self.layout(record, members, pack)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cType{kind: cKindRecord, record: record}, nil
+}
+
+func (self *cParser) parseMembers() ([]*cMember, error) {
+	base, err := self.parseTypeSpecifier()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*cMember
+
+	// Anonymous struct or union members. A nested struct with a tag
+	// only declares the type.
+	if self.accept(";") {
+		if base.kind == cKindRecord && base.record.name == "" {
+			result = append(result, &cMember{typ: base})
+		}
+		return result, nil
+	}
+
+	for {
+		member := &cMember{typ: base}
+		if !self.is(":") {
+			name, wrap, err := self.parseDeclarator()
+			if err != nil {
+				return nil, err
+			}
+			member.name = name
+			member.typ = wrap(base)
+		}
+
+		// The width is stored in end_bit until the layout is done.
+		if self.accept(":") {
+			member.is_bitfield = true
+			member.end_bit, err = self.parseConstExpression()
+			if err != nil {
+				return nil, err
+			}
+		}
+		self.skipAttributes()
+
+		result = append(result, member)
+
+		if self.accept(",") {
+			continue
+		}
+		return result, self.expect(";")
+	}
+}
+
+// Parses a declarator and returns its name and a function which
+// applies the declarator to the base type.
+func (self *cParser) parseDeclarator() (string, func(*cType) *cType, error) {
+	pointers := 0
+	for self.accept("*") {
+		pointers++
+		self.skipAttributes()
+	}
+
+	name := ""
+	inner := func(t *cType) *cType { return t }
+
+	if self.accept("(") {
+		var err error
+		name, inner, err = self.parseDeclarator()
+		if err != nil {
+			return "", nil, err
+		}
+		err = self.expect(")")
+		if err != nil {
+			return "", nil, err
+		}
+	} else if self.peek().kind == cTokenIdent {
+		name = self.next().value
+	}
+
+	// Array dimensions and function parameters
+	var suffixes []int64
+	for {
+		if self.accept("[") {
+			count := int64(0)
+			if !self.is("]") {
+				var err error
+				count, err = self.parseConstExpression()
+				if err != nil {
+					return "", nil, err
+				}
+			}
+			err := self.expect("]")
+			if err != nil {
+				return "", nil, err
+			}
+			suffixes = append(suffixes, count)
+			continue
+		}
+
+		if self.is("(") {
+			_, err := self.skipBalanced()
+			if err != nil {
+				return "", nil, err
+			}
+			// -1 marks a function
+			suffixes = append(suffixes, -1)
+			continue
+		}
+		break
+	}
+
+	pointer_size := self.pointerSize()
+	return name, func(t *cType) *cType {
+		for i := 0; i < pointers; i++ {
+			t = &cType{kind: cKindPointer, elem: t, size: pointer_size}
+		}
+		for i := len(suffixes) - 1; i >= 0; i-- {
+			if suffixes[i] < 0 {
+				t = &cType{kind: cKindFunction, elem: t}
+			} else {
+				t = &cType{kind: cKindArray, elem: t, count: suffixes[i]}
+			}
+		}
+		return inner(t)
+	}, nil
+}
+
+func (self *cParser) parseEnum() (*cType, error) {
+	self.next()
+	self.skipAttributes()
+
+	tag := ""
+	if self.peek().kind == cTokenIdent {
+		tag = self.next().value
+	}
+
+	// Enums are always int sized.
+	result := &cType{
+		kind:    cKindEnum,
+		name:    "int32",
+		size:    4,
+		signed:  true,
+		choices: ordereddict.NewDict(),
+	}
+
+	if !self.accept("{") {
+		existing, pres := self.enums[tag]
+		if pres {
+			return existing, nil
+		}
+		// An enum we have not seen - still an int.
+		return result, nil
+	}
+
+	value := int64(0)
+	for !self.accept("}") {
+		token := self.next()
+		if token.kind != cTokenIdent {
+			return nil, fmt.Errorf("line %v: expected enumerator name", token.line)
+		}
+
+		if self.accept("=") {
+			var err error
+			value, err = self.parseConstExpression()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		self.constants[token.value] = value
+		key := fmt.Sprintf("%d", value)
+		_, pres := result.choices.Get(key)
+		if !pres {
+			result.choices.Set(key, token.value)
+		}
+		value++
+
+		if !self.accept(",") {
+			err := self.expect("}")
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	if tag != "" {
+		self.enums[tag] = result
+	}
+	return result, nil
+}
+
+func (self *cParser) typeAlignment(t *cType) int64 {
+	switch t.kind {
+	case cKindArray:
+		return self.typeAlignment(t.elem)
+	case cKindRecord:
+		return t.record.align
+	case cKindFunction, cKindVoid:
+		return 1
+	default:
+		return t.size
+	}
+}
+
+func (self *cParser) typeSize(t *cType) int64 {
+	switch t.kind {
+	case cKindArray:
+		return t.count * self.typeSize(t.elem)
+	case cKindRecord:
+		return t.record.size
+	case cKindFunction:
+		return 0
+	default:
+		return t.size
+	}
+}
+
+func alignUp(value, alignment int64) int64 {
+	if alignment <= 1 {
+		return value
+	}
+	return (value + alignment - 1) / alignment * alignment
+}
+
+// Compute the offsets of the members using the System V rules: each
+// member is aligned to its natural alignment (limited by the packing)
+// and bit fields are packed into storage units of their declared type
+// as long as they fit.
+func (self *cParser) layout(record *cRecord, members []*cMember, pack int64) error {
+	bit_offset := int64(0)
+	max_align := int64(1)
+	size := int64(0)
+
+	for _, member := range members {
+		if member.typ.kind == cKindRecord && !member.typ.record.complete {
+			return fmt.Errorf("%v: member %v has incomplete type %v",
+				record.name, member.name, member.typ.record.name)
+		}
+
+		alignment := self.typeAlignment(member.typ)
+		if pack > 0 && alignment > pack {
+			alignment = pack
+		}
+		member_size := self.typeSize(member.typ)
+
+		if record.union {
+			bit_offset = 0
+		}
+
+		if member.is_bitfield {
+			width := member.end_bit
+			unit_bits := member_size * 8
+			if width > unit_bits || unit_bits == 0 {
+				return fmt.Errorf("%v: bit field %v is too wide",
+					record.name, member.name)
+			}
+
+			// Zero width bit fields start a new unit.
+			if width == 0 {
+				bit_offset = alignUp(bit_offset, alignment*8)
+				continue
+			}
+
+			unit_start := bit_offset / (alignment * 8) * (alignment * 8)
+			if bit_offset+width > unit_start+unit_bits {
+				bit_offset = alignUp(bit_offset, alignment*8)
+				unit_start = bit_offset
+			}
+
+			member.offset = unit_start / 8
+			member.start_bit = bit_offset - unit_start
+			member.end_bit = member.start_bit + width
+			bit_offset += width
+
+		} else {
+			member.offset = alignUp((bit_offset+7)/8, alignment)
+			bit_offset = (member.offset + member_size) * 8
+		}
+
+		if alignment > max_align {
+			max_align = alignment
+		}
+
+		end := (bit_offset + 7) / 8
+		if member.is_bitfield {
+			end = member.offset + member_size
+		}
+		if end > size {
+			size = end
+		}
+
+		// Only named members and anonymous records are kept.
+		if member.name != "" || member.typ.kind == cKindRecord {
+			record.members = append(record.members, member)
+		}
+	}
+
+	record.align = max_align
+	record.size = alignUp(size, max_align)
+	record.complete = true
+	self.defined = append(self.defined, record)
+
+	return nil
+}
+
+// Const expressions are used in array sizes, bit field widths and
+// enum values.
+func (self *cParser) parseConstExpression() (int64, error) {
+	return self.parseBinary(0)
+}
+
+var cOperatorPrecedence = map[string]int{
+	"|": 1, "^": 2, "&": 3, "<<": 4, ">>": 4,
+	"+": 5, "-": 5, "*": 6, "/": 6, "%": 6,
+}
+
+func (self *cParser) parseBinary(min_precedence int) (int64, error) {
+	lhs, err := self.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		token := self.peek()
+		precedence, pres := cOperatorPrecedence[token.value]
+		if token.kind != cTokenPunct || !pres || precedence <= min_precedence {
+			return lhs, nil
+		}
+		self.next()
+
+		rhs, err := self.parseBinary(precedence)
+		if err != nil {
+			return 0, err
+		}
+
+		switch token.value {
+		case "|":
+			lhs |= rhs
+		case "^":
+			lhs ^= rhs
+		case "&":
+			lhs &= rhs
+		case "<<":
+			lhs <<= uint64(rhs)
+		case ">>":
+			lhs >>= uint64(rhs)
+		case "+":
+			lhs += rhs
+		case "-":
+			lhs -= rhs
+		case "*":
+			lhs *= rhs
+		case "/", "%":
+			if rhs == 0 {
+				return 0, self.errorf("division by zero")
+			}
+			if token.value == "/" {
+				lhs /= rhs
+			} else {
+				lhs %= rhs
+			}
+		}
+	}
+}
+
+func (self *cParser) parseUnary() (int64, error) {
+	token := self.next()
+	switch {
+	case token.value == "-":
+		value, err := self.parseUnary()
+		return -value, err
+
+	case token.value == "+":
+		return self.parseUnary()
+
+	case token.value == "~":
+		value, err := self.parseUnary()
+		return ^value, err
+
+	case token.value == "(":
+		value, err := self.parseBinary(0)
+		if err != nil {
+			return 0, err
+		}
+		return value, self.expect(")")
+
+	case token.value == "sizeof":
+		err := self.expect("(")
+		if err != nil {
+			return 0, err
+		}
+		base, err := self.parseTypeSpecifier()
+		if err != nil {
+			return 0, err
+		}
+		_, wrap, err := self.parseDeclarator()
+		if err != nil {
+			return 0, err
+		}
+		return self.typeSize(wrap(base)), self.expect(")")
+
+	case token.kind == cTokenNumber:
+		literal := strings.TrimRight(strings.ToLower(token.value), "ul")
+		value, err := strconv.ParseInt(literal, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("line %v: invalid number %v", token.line, token.value)
+		}
+		return value, nil
+
+	case token.kind == cTokenIdent:
+		value, pres := self.constants[token.value]
+		if !pres {
+			return 0, fmt.Errorf("line %v: unknown constant %v",
+				token.line, token.value)
+		}
+		return value, nil
+	}
+
+	return 0, fmt.Errorf("line %v: unexpected '%v' in expression",
+		token.line, token.value)
+}
+
+// Convert all the records into struct definitions.
+func (self *cParser) structDefinitions() ([]*StructDefinition, error) {
+	var result []*StructDefinition
+
+	// New records may be named while converting (anonymous member
+	// records) so iterate by index.
+	for i := 0; i < len(self.defined); i++ {
+		record := self.defined[i]
+
+		// Anonymous records which are only used inside other
+		// records are named when they are used.
+		if record.name == "" {
+			continue
+		}
+
+		struct_def, err := self.structDefinition(record)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, struct_def)
+	}
+	return result, nil
+}
+
+func (self *cParser) structDefinition(record *cRecord) (*StructDefinition, error) {
+	result := &StructDefinition{
+		Name: record.name,
+		Size: int(record.size),
+	}
+
+	err := self.addMembers(result, record, record.members, 0)
+	return result, err
+}
+
+func (self *cParser) addMembers(result *StructDefinition, record *cRecord,
+	members []*cMember, base_offset int64) error {
+	for _, member := range members {
+		// Members of anonymous structs and unions are accessed as
+		// if they were members of the containing struct.
+		if member.name == "" {
+			err := self.addMembers(result, record, member.typ.record.members,
+				base_offset+member.offset)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		type_name, options, err := self.vtype(record, member.name, member.typ)
+		if err != nil {
+			return err
+		}
+
+		if member.is_bitfield {
+			storage_type := type_name
+			if member.typ.kind == cKindEnum {
+				storage_type = member.typ.name
+			}
+			bitfield_options := ordereddict.NewDict().
+				Set("type", storage_type).
+				Set("start_bit", member.start_bit).
+				Set("end_bit", member.end_bit)
+
+			type_name = "BitField"
+			if member.typ.kind == cKindEnum {
+				options.Set("type", "BitField").
+					Set("type_options", bitfield_options)
+				type_name = "Enumeration"
+			} else {
+				options = bitfield_options
+			}
+		}
+
+		field := &FieldDefinition{
+			Name:   member.name,
+			Offset: base_offset + member.offset,
+			Type:   type_name,
+		}
+		if options.Len() > 0 {
+			field.Options = options
+		}
+		result.Fields = append(result.Fields, field)
+	}
+
+	return nil
+}
+
+// Returns the vtypes type name and options for the C type.
+func (self *cParser) vtype(record *cRecord, member string,
+	t *cType) (string, *ordereddict.Dict, error) {
+	options := ordereddict.NewDict()
+
+	switch t.kind {
+	case cKindBase:
+		return t.name, options, nil
+
+	case cKindEnum:
+		if t.choices.Len() == 0 {
+			return t.name, options, nil
+		}
+		return "Enumeration", options.Set("type", t.name).
+			Set("choices", t.choices), nil
+
+	case cKindRecord:
+		if t.record.name == "" {
+			t.record.name = fmt.Sprintf("%v_%v", record.name, member)
+			self.defined = append(self.defined, t.record)
+		}
+		return t.record.name, options, nil
+
+	case cKindPointer:
+		switch t.elem.kind {
+		case cKindVoid, cKindFunction:
+			// There is nothing to dereference so just return the
+			// address.
+			return intTypeName(t.size, false), options, nil
+		}
+
+		if t.elem.kind == cKindBase && t.elem.char {
+			options.Set("type", "String")
+			if t.elem.wide {
+				options.Set("type_options",
+					ordereddict.NewDict().Set("encoding", "utf16"))
+			}
+			return "Pointer", options, nil
+		}
+
+		type_name, type_options, err := self.vtype(record, member, t.elem)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("type", type_name)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Pointer", options, nil
+
+	case cKindArray:
+		// Character arrays are usually strings.
+		if t.elem.kind == cKindBase && t.elem.char {
+			options.Set("length", t.count*t.elem.size)
+			if t.elem.wide {
+				options.Set("encoding", "utf16")
+			}
+			return "String", options, nil
+		}
+
+		type_name, type_options, err := self.vtype(record, member, t.elem)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("type", type_name).Set("count", t.count)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Array", options, nil
+	}
+
+	return "", nil, fmt.Errorf("%v: member %v has an unsupported type",
+		record.name, member)
+}
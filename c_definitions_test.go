@@ -0,0 +1,87 @@
+package vtypes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestCDefinitions(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	definition := `
+#include <stdint.h>
+#define MAX_PATH 260
+
+enum Color { RED = 1, GREEN, BLUE = 0x10 };
+
+typedef unsigned short WORD_T;
+
+/* A struct with padding */
+typedef struct _Header {
+    char Signature[4];
+    uint8_t Version;
+    WORD_T Flags;        // Aligned to 2
+    unsigned int Count;
+    enum Color Color;
+    unsigned long long Timestamp;   // Aligned to 8
+    unsigned int Low: 4, High: 4;
+    enum Color Packed: 8;
+    struct _Header *Next;
+    void *Data;
+    int Values[2][3];
+    union {
+        uint32_t AsInt;
+        uint8_t AsBytes[4];
+    };
+    struct {
+        short X;
+    } Inner;
+} Header, *PHeader;
+
+#pragma pack(push, 1)
+struct Packed {
+    char a;
+    int b;
+};
+#pragma pack(pop)
+
+struct __attribute__((packed)) Packed2 {
+    char a;
+    long long b;
+};
+
+struct Sizes {
+    char Buffer[sizeof(int) * 2];
+};
+`
+	err := profile.ParseCDefinitions(definition)
+	assert.NoError(t, err)
+
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	goldie.Assert(t, "TestCDefinitions", []byte(exported))
+
+	// Typedefs are aliases to the struct.
+	scope := MakeScope()
+	reader := bytes.NewReader(sample)
+	obj, err := profile.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x0807), Associative(scope, obj, "Flags"))
+	assert.Equal(t, uint64(0x05), Associative(scope, obj, "Version"))
+
+	errors := []string{
+		"struct A { unknown_t x; };",
+		"struct A { int x; ",
+		"struct A { struct B b; };",
+		"struct A { int x[UNDEFINED]; };",
+	}
+	for _, definition := range errors {
+		err := NewProfile().ParseCDefinitions(definition)
+		assert.Error(t, err, definition)
+	}
+}
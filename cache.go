@@ -0,0 +1,198 @@
+// A cache of compiled profiles so the same definitions are only
+// parsed once.
+
+package vtypes
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// The number of profiles kept by DefaultProfileCache.
+const DefaultProfileCacheSize = 100
+
+// A process wide cache for callers which parse the same definitions
+// over and over (e.g. once per row of a query).
+var DefaultProfileCache = NewProfileCache(DefaultProfileCacheSize)
+
+// Maps a hash of the definition text to the compiled profile. The
+// least recently used profiles are evicted when the cache is full.
+//
+// Compiled profiles can not be changed so they are safe to share
+// between all the callers. Errors are cached too so bad definitions
+// are not parsed again every time either.
+type ProfileCache struct {
+	mu sync.Mutex
+
+	size    int
+	entries map[string]*list.Element
+
+	// Most recently used at the front.
+	lru *list.List
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	// Builds the profiles. Replaced by tests.
+	compile func(definitions string, model DataModel) (*CompiledProfile, error)
+}
+
+type ProfileCacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+
+	// The number of profiles in the cache and its capacity.
+	Size    int
+	MaxSize int
+}
+
+type profileCacheEntry struct {
+	key string
+
+	// Closed when the profile is built. Callers asking for the same
+	// definitions in the meantime wait for it.
+	done    chan struct{}
+	profile *CompiledProfile
+	err     error
+}
+
+// A cache holding at most size profiles.
+func NewProfileCache(size int) *ProfileCache {
+	if size < 1 {
+		size = 1
+	}
+	return &ProfileCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		compile: compileDefinitions,
+	}
+}
+
+// Get the compiled profile for the definitions using the built in
+// types from AddModel().
+func (self *ProfileCache) Get(definitions string) (*CompiledProfile, error) {
+	return self.get(definitions, DataModel(0))
+}
+
+// Like Get() but the built in types follow the data model (see
+// AddModelFor()).
+func (self *ProfileCache) GetForModel(
+	definitions string, model DataModel) (*CompiledProfile, error) {
+	_, pres := dataModelNames[model]
+	if !pres {
+		return nil, fmt.Errorf("ProfileCache: unknown data model %v", model)
+	}
+	return self.get(definitions, model)
+}
+
+func (self *ProfileCache) get(
+	definitions string, model DataModel) (*CompiledProfile, error) {
+	key := profileCacheKey(definitions, model)
+
+	self.mu.Lock()
+	element, pres := self.entries[key]
+	if pres {
+		self.hits++
+		self.lru.MoveToFront(element)
+		self.mu.Unlock()
+
+		entry := element.Value.(*profileCacheEntry)
+		<-entry.done
+		return entry.profile, entry.err
+	}
+
+	self.misses++
+	entry := &profileCacheEntry{key: key, done: make(chan struct{})}
+	self.entries[key] = self.lru.PushFront(entry)
+	self.evict()
+	self.mu.Unlock()
+
+	// Build the profile without holding the lock so other
+	// definitions are not held up.
+	self.build(entry, definitions, model)
+
+	return entry.profile, entry.err
+}
+
+// Build the entry's profile. The callers waiting for it are released
+// even if building the profile panics, and get the panic as an error.
+func (self *ProfileCache) build(
+	entry *profileCacheEntry, definitions string, model DataModel) {
+	defer close(entry.done)
+	defer func() {
+		r := recover()
+		if r != nil {
+			entry.profile = nil
+			entry.err = fmt.Errorf("ProfileCache: %v", r)
+		}
+	}()
+
+	entry.profile, entry.err = self.compile(definitions, model)
+}
+
+// Remove the least recently used entries until the cache fits.
+// Called with the lock held.
+func (self *ProfileCache) evict() {
+	for self.lru.Len() > self.size {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.entries, oldest.Value.(*profileCacheEntry).key)
+		self.evictions++
+	}
+}
+
+func (self *ProfileCache) Stats() ProfileCacheStats {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return ProfileCacheStats{
+		Hits:      self.hits,
+		Misses:    self.misses,
+		Evictions: self.evictions,
+		Size:      self.lru.Len(),
+		MaxSize:   self.size,
+	}
+}
+
+// Remove all profiles from the cache. The stats are kept.
+func (self *ProfileCache) Clear() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.entries = make(map[string]*list.Element)
+	self.lru.Init()
+}
+
+func profileCacheKey(definitions string, model DataModel) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%d\x00", model)
+	hash.Write([]byte(definitions))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func compileDefinitions(
+	definitions string, model DataModel) (*CompiledProfile, error) {
+	profile := NewProfile()
+	var err error
+	if model == DataModel(0) {
+		err = AddModel(profile)
+	} else {
+		err = AddModelFor(profile, model)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = profile.ParseStructDefinitions(definitions)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile.Compile()
+}
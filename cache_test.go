@@ -0,0 +1,157 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func cacheDefinitions(size int) string {
+	return fmt.Sprintf(`[["Header", %d, [
+  ["Value", 0, "uint16"],
+]]]`, size)
+}
+
+func TestProfileCache(t *testing.T) {
+	cache := NewProfileCache(2)
+
+	first, err := cache.Get(cacheDefinitions(2))
+	assert.NoError(t, err)
+
+	// The same definitions give the same profile.
+	second, err := cache.Get(cacheDefinitions(2))
+	assert.NoError(t, err)
+	assert.True(t, first == second)
+
+	obj, err := second.Parse(MakeScope(), "Header", bytes.NewReader([]byte{1, 2}), 0)
+	assert.NoError(t, err)
+	serialized, _ := json.Marshal(obj)
+	assert.Equal(t, `{"Value":513}`, string(serialized))
+
+	// Cached profiles can not be changed.
+	err = second.Profile().ParseStructDefinitions(cacheDefinitions(4))
+	assert.Error(t, err)
+
+	assert.Equal(t, ProfileCacheStats{
+		Hits: 1, Misses: 1, Size: 1, MaxSize: 2}, cache.Stats())
+
+	// The least recently used profile is evicted.
+	_, err = cache.Get(cacheDefinitions(3))
+	assert.NoError(t, err)
+	_, err = cache.Get(cacheDefinitions(2))
+	assert.NoError(t, err)
+	_, err = cache.Get(cacheDefinitions(4))
+	assert.NoError(t, err)
+
+	assert.Equal(t, ProfileCacheStats{
+		Hits: 2, Misses: 3, Evictions: 1, Size: 2, MaxSize: 2}, cache.Stats())
+
+	third, err := cache.Get(cacheDefinitions(2))
+	assert.NoError(t, err)
+	assert.True(t, first == third)
+
+	_, err = cache.Get(cacheDefinitions(3))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), cache.Stats().Misses)
+
+	// The data model is part of the key.
+	lp64, err := cache.GetForModel(cacheDefinitions(2), ModelLP64)
+	assert.NoError(t, err)
+	assert.True(t, first != lp64)
+
+	_, err = cache.GetForModel(cacheDefinitions(2), DataModel(0))
+	assert.Error(t, err)
+
+	// Errors are cached too.
+	for i := 0; i < 2; i++ {
+		_, err = cache.Get(`[["Header", 0, [["Value", 0, "Missing"]]]]`)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int64(4), cache.Stats().Hits)
+
+	cache.Clear()
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+// Run with go test -race: all callers get the same profile and it is
+// only built once.
+func TestProfileCacheConcurrency(t *testing.T) {
+	cache := NewProfileCache(10)
+
+	var wg sync.WaitGroup
+	profiles := make([]*CompiledProfile, 20)
+	for i := range profiles {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			profile, err := cache.Get(cacheDefinitions(2))
+			assert.NoError(t, err)
+			profiles[i] = profile
+
+			_, err = profile.Parse(MakeScope(), "Header",
+				bytes.NewReader([]byte{1, 2}), 0)
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, profile := range profiles {
+		assert.True(t, profile == profiles[0])
+	}
+	assert.Equal(t, int64(1), cache.Stats().Misses)
+	assert.Equal(t, int64(19), cache.Stats().Hits)
+}
+
+// Callers waiting for a profile which fails to build all get the
+// error, even if building it panics.
+func TestProfileCacheConcurrentErrors(t *testing.T) {
+	for _, failure := range []func() (*CompiledProfile, error){
+		func() (*CompiledProfile, error) {
+			return nil, errors.New("bad definitions")
+		},
+		func() (*CompiledProfile, error) {
+			panic("bad definitions")
+		},
+	} {
+		cache := NewProfileCache(10)
+
+		// Fail only once all the other callers are waiting.
+		waiters := 9
+		cache.compile = func(
+			definitions string, model DataModel) (*CompiledProfile, error) {
+			for cache.Stats().Hits < int64(waiters) {
+				time.Sleep(time.Millisecond)
+			}
+			return failure()
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, waiters+1)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				profile, err := cache.Get(cacheDefinitions(2))
+				assert.Nil(t, profile)
+				errs[i] = err
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			assert.Error(t, err)
+			if err != nil {
+				assert.Contains(t, err.Error(), "bad definitions")
+			}
+		}
+		assert.Equal(t, int64(1), cache.Stats().Misses)
+	}
+}
@@ -0,0 +1,83 @@
+// vtypes-gen compiles the structs in a vtypes profile into Go code.
+//
+// Usage:
+//
+//	vtypes-gen -profile profile.json -package mypackage [-model LP64] -output profile.go [Struct ...]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"www.velocidex.com/golang/vtypes"
+)
+
+var (
+	profile_path = flag.String("profile", "", "The profile definition file (json or yaml)")
+	package_name = flag.String("package", "main", "The package name of the generated code")
+	output_path  = flag.String("output", "", "Write the code to this file instead of stdout")
+	model        = flag.String("model", "",
+		"The data model giving the size of long, size_t and pointers: ILP32, LLP64 or LP64")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s -profile profile.json [flags] [Struct ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	err := generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vtypes-gen: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func generate() error {
+	if *profile_path == "" {
+		return fmt.Errorf("-profile is required")
+	}
+
+	definitions, err := os.ReadFile(*profile_path)
+	if err != nil {
+		return err
+	}
+
+	profile := vtypes.NewProfile()
+	if *model == "" {
+		err = vtypes.AddModel(profile)
+		if err != nil {
+			return err
+		}
+	} else {
+		data_model, err := vtypes.ParseDataModel(*model)
+		if err != nil {
+			return err
+		}
+
+		err = vtypes.AddModelFor(profile, data_model)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = profile.ParseStructDefinitions(string(definitions))
+	if err != nil {
+		return err
+	}
+
+	code, err := profile.GenerateGo(*package_name, flag.Args()...)
+	if err != nil {
+		return err
+	}
+
+	if *output_path == "" {
+		_, err = os.Stdout.Write([]byte(code))
+		return err
+	}
+
+	return os.WriteFile(*output_path, []byte(code), 0644)
+}
@@ -0,0 +1,355 @@
+// vtypes parses binary files with a vtypes profile.
+//
+// Usage:
+//
+//	vtypes parse --profile profile.json --struct Header [--offset 0x10] [--lambda 'x=>x.Field'] [--set NAME=VALUE] [--model LP64] file
+//	vtypes describe --profile profile.json [Struct ...]
+//	vtypes validate --profile profile.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vtypes"
+)
+
+var usage = `Usage: vtypes <command> [flags]
+
+Commands:
+  parse     Parse a struct from a file and print it as JSON
+  describe  List the structs and their fields
+  validate  Check the profile for problems
+
+Run vtypes <command> -h for the flags of each command.
+`
+
+// Returned when the command ran but found problems.
+var errFailed = errors.New("failed")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		if !errors.Is(err, errFailed) {
+			fmt.Fprintf(os.Stderr, "vtypes: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// Results are written to out, usage and flag errors to errout.
+func run(args []string, out, errout io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(errout, usage)
+		return errors.New("a command is required")
+	}
+
+	switch args[0] {
+	case "parse":
+		return doParse(args[1:], out, errout)
+	case "describe":
+		return doDescribe(args[1:], out, errout)
+	case "validate":
+		return doValidate(args[1:], out, errout)
+	case "help", "-h", "--help":
+		fmt.Fprint(out, usage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+}
+
+// Flags which may be given multiple times.
+type listFlags []string
+
+func (self *listFlags) String() string {
+	return strings.Join(*self, ", ")
+}
+
+func (self *listFlags) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
+// Parse NAME=VALUE pairs which override the profile's constants.
+// Values are numbers if possible, otherwise strings.
+func parseConstants(pairs []string) (*ordereddict.Dict, error) {
+	result := ordereddict.NewDict()
+	for _, pair := range pairs {
+		name, value, found := strings.Cut(pair, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("--set %v should be NAME=VALUE", pair)
+		}
+
+		number, err := strconv.ParseInt(value, 0, 64)
+		if err == nil {
+			result.Set(name, number)
+		} else {
+			result.Set(name, value)
+		}
+	}
+	return result, nil
+}
+
+func loadProfile(path, model string) (*vtypes.Profile, error) {
+	if path == "" {
+		return nil, errors.New("--profile is required")
+	}
+
+	definitions, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := vtypes.NewProfile()
+	if model == "" {
+		err = vtypes.AddModel(profile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data_model, err := vtypes.ParseDataModel(model)
+		if err != nil {
+			return nil, err
+		}
+
+		err = vtypes.AddModelFor(profile, data_model)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = profile.ParseStructDefinitions(string(definitions))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return profile, nil
+}
+
+func doParse(args []string, out, errout io.Writer) error {
+	flags := flag.NewFlagSet("parse", flag.ContinueOnError)
+	flags.SetOutput(errout)
+	profile_path := flags.String("profile", "", "The profile definition file (json, yaml or text)")
+	model := flags.String("model", "",
+		"The data model giving the size of long, size_t and pointers: ILP32, LLP64 or LP64")
+	struct_name := flags.String("struct", "", "The struct to parse")
+	offset := flags.Int64("offset", 0, "The offset in the file to parse the struct at")
+	var lambdas listFlags
+	flags.Var(&lambdas, "lambda",
+		"Print the result of this lambda on the struct instead (e.g. 'x=>x.Field'). May be repeated.")
+	var constants listFlags
+	flags.Var(&constants, "set",
+		"Override a constant of the profile (e.g. BUILD=7601). May be repeated.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: vtypes parse --profile profile.json --struct Header [flags] file\n")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *struct_name == "" {
+		return errors.New("--struct is required")
+	}
+
+	if flags.NArg() != 1 {
+		return errors.New("parse requires exactly one file")
+	}
+
+	profile, err := loadProfile(*profile_path, *model)
+	if err != nil {
+		return err
+	}
+
+	overrides, err := parseConstants(constants)
+	if err != nil {
+		return err
+	}
+
+	// Parse the lambdas before doing any work.
+	var parsed []*vfilter.Lambda
+	for _, expression := range lambdas {
+		lambda, err := vfilter.ParseLambda(expression)
+		if err != nil {
+			return fmt.Errorf("lambda %v: %w", expression, err)
+		}
+		parsed = append(parsed, lambda)
+	}
+
+	fd, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	scope := vtypes.MakeScope()
+	defer scope.Close()
+
+	scope.AppendVars(overrides)
+
+	obj, err := profile.Parse(scope, *struct_name, fd, *offset)
+	if err != nil {
+		return err
+	}
+
+	if len(parsed) == 0 {
+		return printJSON(out, obj)
+	}
+
+	ctx := context.Background()
+	for idx, lambda := range parsed {
+		result := lambda.Reduce(ctx, scope, []vfilter.Any{obj})
+		if len(parsed) > 1 {
+			fmt.Fprintf(out, "%v: ", lambdas[idx])
+		}
+
+		err = printJSON(out, result)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printJSON(out io.Writer, value interface{}) error {
+	serialized, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", serialized)
+	return err
+}
+
+func doDescribe(args []string, out, errout io.Writer) error {
+	flags := flag.NewFlagSet("describe", flag.ContinueOnError)
+	flags.SetOutput(errout)
+	profile_path := flags.String("profile", "", "The profile definition file (json, yaml or text)")
+	model := flags.String("model", "",
+		"The data model giving the size of long, size_t and pointers: ILP32, LLP64 or LP64")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: vtypes describe --profile profile.json [Struct ...]\n")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	profile, err := loadProfile(*profile_path, *model)
+	if err != nil {
+		return err
+	}
+
+	// By default describe all the structs, but not aliases to them.
+	names := flags.Args()
+	if len(names) == 0 {
+		for _, name := range profile.Types() {
+			description, err := profile.Describe(name)
+			if err == nil && description.IsStruct && description.Name == name {
+				names = append(names, name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		description, err := profile.Describe(name)
+		if err != nil {
+			return err
+		}
+
+		size := describeSize(description.Size)
+		if description.SizeExpression != "" {
+			size = description.SizeExpression
+		}
+		fmt.Fprintf(out, "%v (size %v)\n", description.Name, size)
+
+		for _, field := range description.Fields {
+			offset := fmt.Sprintf("%#x", field.Offset)
+			switch {
+			case field.OffsetExpression != "":
+				offset = field.OffsetExpression
+
+			// Fields following a field of variable size have no
+			// static offset.
+			case field.FollowsVariableSize:
+				offset = "auto"
+			}
+			fmt.Fprintf(out, "  %-8v %v: %v%v (size %v)\n", offset, field.Name,
+				field.Type, describeOptions(field.Options),
+				describeSize(field.Size))
+		}
+	}
+
+	return nil
+}
+
+func describeSize(size int) string {
+	if size == 0 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%#x", size)
+}
+
+func describeOptions(options interface{}) string {
+	if options == nil {
+		return ""
+	}
+	serialized, err := json.Marshal(options)
+	if err != nil || string(serialized) == "null" {
+		return ""
+	}
+	return " " + string(serialized)
+}
+
+func doValidate(args []string, out, errout io.Writer) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	flags.SetOutput(errout)
+	profile_path := flags.String("profile", "", "The profile definition file (json, yaml or text)")
+	model := flags.String("model", "",
+		"The data model giving the size of long, size_t and pointers: ILP32, LLP64 or LP64")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: vtypes validate --profile profile.json\n")
+		flags.PrintDefaults()
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	profile, err := loadProfile(*profile_path, *model)
+	if err != nil {
+		return err
+	}
+
+	errors_found := false
+	for _, diagnostic := range profile.Validate() {
+		fmt.Fprintln(out, diagnostic.String())
+		if diagnostic.Level == vtypes.DiagnosticError {
+			errors_found = true
+		}
+	}
+
+	if errors_found {
+		return errFailed
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+var testProfile = `[["Header", 8, [
+  ["Magic", 0, "String", {"length": 4}],
+  ["Length", 4, "uint32"]
+]]]`
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	profile_path := filepath.Join(dir, "profile.json")
+	data_path := filepath.Join(dir, "data.bin")
+
+	assert.NoError(t, os.WriteFile(profile_path, []byte(testProfile), 0600))
+	assert.NoError(t, os.WriteFile(data_path,
+		[]byte("xxxxMZIP\x10\x00\x00\x00"), 0600))
+
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+	err := run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--offset", "0x4", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"Magic\": \"MZIP\",\n  \"Length\": 16\n}\n", out.String())
+
+	out.Reset()
+	err = run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--offset", "4",
+		"--lambda", "x=>x.Length + 1", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "17\n", out.String())
+
+	out.Reset()
+	err = run([]string{"describe", "--profile", profile_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, `Header (size 0x8)
+  0x0      Magic: String {"length":4} (size 0x4)
+  0x4      Length: uint32 (size 0x4)
+`, out.String())
+
+	out.Reset()
+	err = run([]string{"validate", "--profile", profile_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "INFO: Header: Struct is not used by any other struct\n",
+		out.String())
+
+	err = run([]string{"parse", "--profile", profile_path,
+		"--struct", "Missing", data_path}, out, errout)
+	assert.Error(t, err)
+}
+
+func TestConstants(t *testing.T) {
+	dir := t.TempDir()
+	profile_path := filepath.Join(dir, "profile.json")
+	data_path := filepath.Join(dir, "data.bin")
+
+	assert.NoError(t, os.WriteFile(profile_path, []byte(`{
+  "constants": {"HEADER_SIZE": 4},
+  "structs": [["Header", 8, [
+    ["Length", "x=>HEADER_SIZE", "uint32"]
+  ]]]
+}`), 0600))
+	assert.NoError(t, os.WriteFile(data_path,
+		[]byte("\x01\x00\x00\x00\x10\x00\x00\x00"), 0600))
+
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+	err := run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--lambda", "x=>x.Length", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "16\n", out.String())
+
+	out.Reset()
+	err = run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--set", "HEADER_SIZE=0",
+		"--lambda", "x=>x.Length", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", out.String())
+
+	err = run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--set", "HEADER_SIZE", data_path}, out, errout)
+	assert.Error(t, err)
+}
+
+func TestModel(t *testing.T) {
+	dir := t.TempDir()
+	profile_path := filepath.Join(dir, "profile.json")
+	data_path := filepath.Join(dir, "data.bin")
+
+	assert.NoError(t, os.WriteFile(profile_path, []byte(`[["Header", 8, [
+  ["Value", 0, "unsigned long"]
+]]]`), 0600))
+	assert.NoError(t, os.WriteFile(data_path,
+		[]byte("\x01\x00\x00\x00\x01\x00\x00\x00"), 0600))
+
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+	err := run([]string{"parse", "--profile", profile_path,
+		"--struct", "Header", "--lambda", "x=>x.Value", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", out.String())
+
+	out.Reset()
+	err = run([]string{"parse", "--profile", profile_path, "--model", "LP64",
+		"--struct", "Header", "--lambda", "x=>x.Value", data_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, "4294967297\n", out.String())
+
+	err = run([]string{"parse", "--profile", profile_path, "--model", "LP128",
+		"--struct", "Header", data_path}, out, errout)
+	assert.Error(t, err)
+}
+
+// Only fields following a field of variable size have no static
+// offset.
+func TestDescribeAutoOffsets(t *testing.T) {
+	dir := t.TempDir()
+	profile_path := filepath.Join(dir, "profile.json")
+
+	assert.NoError(t, os.WriteFile(profile_path, []byte(`[["Record", 0, [
+  ["Type", "auto", "uint32"],
+  ["Name", "auto", "String", {"term": ""}],
+  ["Value", "auto", "uint16"]
+]]]`), 0600))
+
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+	err := run([]string{"describe", "--profile", profile_path}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, `Record (size unknown)
+  0x0      Type: uint32 (size 0x4)
+  0x4      Name: String {"term":""} (size unknown)
+  auto     Value: uint16 (size 0x2)
+`, out.String())
+}
+
+// Usage and flag errors go to the error writer.
+func TestUsage(t *testing.T) {
+	out := &bytes.Buffer{}
+	errout := &bytes.Buffer{}
+	err := run(nil, out, errout)
+	assert.Error(t, err)
+	assert.Equal(t, "", out.String())
+	assert.Equal(t, usage, errout.String())
+
+	errout.Reset()
+	err = run([]string{"describe", "--unknown"}, out, errout)
+	assert.Error(t, err)
+	assert.Equal(t, "", out.String())
+	assert.Contains(t, errout.String(), "flag provided but not defined: -unknown")
+
+	// Asking for help is not an error.
+	err = run([]string{"help"}, out, errout)
+	assert.NoError(t, err)
+	assert.Equal(t, usage, out.String())
+}
@@ -0,0 +1,1066 @@
+// Generate Go source code which parses the structs in a profile
+// without interpreting the profile at runtime.
+
+package vtypes
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Generate Go source for the named structs (or all the structs in
+// the profile if none are named) and the structs they use. Each
+// struct becomes a plain Go struct and a ParseXXX(reader, offset)
+// function which parses it eagerly.
+//
+// Ints, bit fields, strings, enumerations, nested structs and arrays
+// are compiled into straight line code, including offsets, counts
+// and lengths given by simple lambdas (arithmetic on other fields of
+// the same struct). Any other field is parsed by the runtime parser
+// from the profile embedded in the generated code. Structs with such
+// fields have a VtypesError() method giving the runtime parser's
+// error.
+func (self *Profile) GenerateGo(package_name string, struct_names ...string) (string, error) {
+	generator := &goGenerator{
+		profile: self,
+		structs: make(map[string]*goGenStruct),
+		helpers: make(map[string]string),
+		imports: map[string]bool{"io": true},
+	}
+
+	if len(struct_names) == 0 {
+		for name, parser := range self.types {
+			struct_parser, ok := parser.(*StructParser)
+			if ok && struct_parser.type_name == name {
+				struct_names = append(struct_names, name)
+			}
+		}
+	}
+
+	for _, name := range struct_names {
+		parser, pres := self.types[name]
+		if !pres {
+			return "", fmt.Errorf("GenerateGo: struct %v not found", name)
+		}
+		struct_parser, ok := parser.(*StructParser)
+		if !ok {
+			return "", fmt.Errorf("GenerateGo: %v is not a struct", name)
+		}
+		generator.analyzeStruct(struct_parser)
+	}
+
+	return generator.emit(package_name)
+}
+
+type goGenerator struct {
+	profile *Profile
+
+	// Structs by vtypes name
+	structs map[string]*goGenStruct
+
+	// Helper functions and variables by name.
+	helpers map[string]string
+	imports map[string]bool
+
+	// Set when a field is parsed with the runtime parser.
+	uses_runtime bool
+}
+
+type goGenStruct struct {
+	parser  *StructParser
+	go_name string
+
+	// Set while the struct's fields are analyzed.
+	in_progress bool
+
+	fields   []*goGenField
+	by_name  map[string]*goGenField
+	go_names map[string]bool
+
+	// Go expression for the size of the struct if it has a size
+	// expression.
+	size_expression string
+	size_error      error
+}
+
+type goGenField struct {
+	name    string
+	go_name string
+	go_type string
+
+	// Go expression which parses the field.
+	expression string
+
+	// The fields this field depends on.
+	deps []string
+
+	// The field is parsed with the runtime parser.
+	runtime bool
+	err     error
+
+	// Array fields are parsed by a method on the struct.
+	method string
+}
+
+func (self *goGenStruct) usesRuntime() bool {
+	for _, field := range self.fields {
+		if field.runtime {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *goGenField) isNumeric() bool {
+	switch self.go_type {
+	case "uint64", "int64", "float64":
+		return true
+	}
+	return false
+}
+
+// Analyze the struct and all the structs it uses.
+func (self *goGenerator) analyzeStruct(struct_parser *StructParser) *goGenStruct {
+	result, pres := self.structs[struct_parser.type_name]
+	if pres {
+		return result
+	}
+
+	result = &goGenStruct{
+		parser:      struct_parser,
+		go_name:     self.goTypeName(struct_parser.type_name),
+		in_progress: true,
+		by_name:     make(map[string]*goGenField),
+		// Reserved for the method of structs with runtime fields.
+		go_names: map[string]bool{"VtypesError": true},
+	}
+	self.structs[struct_parser.type_name] = result
+
+	for _, field_name := range struct_parser.field_names {
+		field := &goGenField{
+			name:    field_name,
+			go_name: result.goFieldName(field_name),
+		}
+		result.fields = append(result.fields, field)
+		result.by_name[field_name] = field
+	}
+
+	// Lambdas may only refer to numeric fields which are compiled,
+	// possibly later in the struct. Compile all the fields until
+	// their types do not change any more, then fall back to the
+	// runtime for the fields which failed and repeat.
+	for {
+		changed := false
+		for _, field := range result.fields {
+			if field.runtime {
+				continue
+			}
+
+			go_type := field.go_type
+			field.err = self.compileField(result, field)
+			if field.err != nil {
+				field.go_type = ""
+			}
+
+			if go_type != field.go_type {
+				changed = true
+			}
+		}
+
+		if changed {
+			continue
+		}
+
+		for _, field := range result.fields {
+			if field.err != nil && !field.runtime {
+				self.runtimeField(result, field)
+				changed = true
+			}
+		}
+
+		if !changed && self.checkDependencies(result) {
+			break
+		}
+	}
+
+	if struct_parser.size_expression_source != "" {
+		result.size_expression, _, result.size_error = self.translateLambda(
+			result, struct_parser.size_expression_source)
+	}
+
+	result.in_progress = false
+	return result
+}
+
+// Fields which depend on each other can not be compiled. Returns
+// true if all dependencies can be satisfied.
+func (self *goGenerator) checkDependencies(go_struct *goGenStruct) bool {
+	_, err := go_struct.orderedFields()
+	if err == nil {
+		return true
+	}
+
+	for _, field := range go_struct.fields {
+		if len(field.deps) > 0 {
+			self.runtimeField(go_struct, field)
+		}
+	}
+	return false
+}
+
+// Order the fields so each field is parsed after the fields it
+// depends on.
+func (self *goGenStruct) orderedFields() ([]*goGenField, error) {
+	var result []*goGenField
+	done := make(map[*goGenField]bool)
+	in_progress := make(map[*goGenField]bool)
+
+	var visit func(field *goGenField) error
+	visit = func(field *goGenField) error {
+		if done[field] {
+			return nil
+		}
+		if in_progress[field] {
+			return fmt.Errorf("circular dependency on %v", field.name)
+		}
+		in_progress[field] = true
+
+		for _, dep := range field.deps {
+			err := visit(self.by_name[dep])
+			if err != nil {
+				return err
+			}
+		}
+
+		done[field] = true
+		result = append(result, field)
+		return nil
+	}
+
+	for _, field := range self.fields {
+		err := visit(field)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (self *goGenerator) runtimeField(go_struct *goGenStruct, field *goGenField) {
+	field.runtime = true
+	field.err = nil
+	field.go_type = "interface{}"
+	field.deps = nil
+	field.method = ""
+	field.expression = fmt.Sprintf("self.vtypesRuntime.field(%q, reader, offset, %q)",
+		go_struct.parser.type_name, field.name)
+	self.uses_runtime = true
+}
+
+func (self *goGenerator) compileField(go_struct *goGenStruct, field *goGenField) error {
+	parser := go_struct.parser.fields[field.name]
+	definition := parser.definition
+	if definition == nil {
+		return fmt.Errorf("field %v was not built from a definition", field.name)
+	}
+
+	offset := "offset"
+	var deps []string
+	if definition.OffsetExpression != "" {
+		expression, offset_deps, err := self.translateLambda(
+			go_struct, definition.OffsetExpression)
+		if err != nil {
+			return err
+		}
+		offset = fmt.Sprintf("offset+(%v)", expression)
+		deps = offset_deps
+
+	} else if parser.previous != nil {
+		return fmt.Errorf("field %v follows a field of variable size", field.name)
+
+	} else if parser.offset != 0 {
+		offset = fmt.Sprintf("offset+%d", parser.offset)
+	}
+
+	value, err := self.compileType(go_struct, field.go_name,
+		definition.Type, definition.Options, offset)
+	if err != nil {
+		return err
+	}
+
+	field.go_type = value.go_type
+	field.expression = value.expression
+	field.deps = append(deps, value.deps...)
+	field.method = value.method
+	return nil
+}
+
+// A compiled value.
+type goGenValue struct {
+	go_type    string
+	expression string
+	deps       []string
+
+	// Go expression for the size of the value in arrays. The
+	// parsed value is in the variable element.
+	size string
+
+	// Code for a method which parses arrays.
+	method string
+}
+
+func (self *goGenerator) compileType(go_struct *goGenStruct, name string,
+	type_name string, options *ordereddict.Dict, offset string) (*goGenValue, error) {
+	if options == nil {
+		options = ordereddict.NewDict()
+	}
+
+	parser, pres := self.profile.types[type_name]
+	if !pres {
+		return nil, fmt.Errorf("type %v not found", type_name)
+	}
+
+	switch t := parser.(type) {
+	case *IntParser:
+		return self.compileInt(go_struct, t, offset)
+
+	case *TypedefParser:
+		return self.compileType(go_struct, name, t.definition.Type,
+			t.mergeOptions(options), offset)
+
+	case *StructParser:
+		target := self.analyzeStruct(t)
+		result := &goGenValue{
+			go_type: "*" + target.go_name,
+			expression: fmt.Sprintf("Parse%v(reader, %v)",
+				target.go_name, offset),
+			size: fmt.Sprintf("%d", t.size),
+		}
+
+		// Like the runtime, use the size expression when the struct
+		// has no fixed size.
+		if t.size == 0 && t.size_expression_source != "" {
+			if target.in_progress || target.size_error != nil {
+				result.size = ""
+			} else {
+				result.size = "element.vtypesSize()"
+			}
+		}
+		return result, nil
+
+	case *BitFieldParser:
+		instance, err := t.New(self.profile, options)
+		if err != nil {
+			return nil, err
+		}
+		bit_field := instance.(*BitFieldParser)
+
+		storage, err := self.compileType(go_struct, name,
+			bit_field.options.Type, nil, offset)
+		if err != nil {
+			return nil, err
+		}
+		if storage.go_type != "uint64" && storage.go_type != "int64" {
+			return nil, fmt.Errorf("BitField can not be compiled on %v",
+				bit_field.options.Type)
+		}
+
+		self.addHelper("vtypesBits", `
+func vtypesBits(value int64, start_bit, end_bit int64) int64 {
+	result := int64(0)
+	for i := start_bit; i < end_bit; i++ {
+		result |= value & (1 << uint8(i))
+	}
+	return result >> start_bit
+}`)
+		return &goGenValue{
+			go_type: "int64",
+			expression: fmt.Sprintf("vtypesBits(int64(%v), %d, %d)",
+				storage.expression, bit_field.options.StartBit,
+				bit_field.options.EndBit),
+		}, nil
+
+	case *EnumerationParser:
+		instance, err := t.New(self.profile, options)
+		if err != nil {
+			return nil, err
+		}
+		enum := instance.(*EnumerationParser)
+
+		value, err := self.compileType(go_struct, name,
+			enum.options.Type, enum.options.TypeOptions, offset)
+		if err != nil {
+			return nil, err
+		}
+		if value.go_type != "uint64" && value.go_type != "int64" {
+			return nil, fmt.Errorf("Enumeration can not be compiled on %v",
+				enum.options.Type)
+		}
+
+		self.imports["fmt"] = true
+		self.addHelper("vtypesEnum", `
+func vtypesEnum(choices map[int64]string, value int64) string {
+	result, pres := choices[value]
+	if !pres {
+		return fmt.Sprintf("%#x", value)
+	}
+	return result
+}`)
+
+		var values []int64
+		for k := range enum.options.choices {
+			values = append(values, k)
+		}
+		sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+		choices := &bytes.Buffer{}
+		choices_name := fmt.Sprintf("vtypes%v%vChoices", go_struct.go_name, name)
+		fmt.Fprintf(choices, "\nvar %v = map[int64]string{\n", choices_name)
+		for _, k := range values {
+			fmt.Fprintf(choices, "\t%d: %q,\n", k, enum.options.choices[k])
+		}
+		choices.WriteString("}")
+		self.addHelper(choices_name, choices.String())
+
+		return &goGenValue{
+			go_type: "string",
+			expression: fmt.Sprintf("vtypesEnum(%v, int64(%v))",
+				choices_name, value.expression),
+			deps: value.deps,
+			size: "int64(len(element))",
+		}, nil
+
+	case *StringParser:
+		return self.compileString(go_struct, t, options, offset)
+
+	case *ArrayParser:
+		return self.compileArray(go_struct, name, t, options, offset)
+
+	default:
+		return nil, fmt.Errorf("%T can not be compiled", parser)
+	}
+}
+
+// Floats are returned as float64 like the runtime parsers. Returns
+// the expression converting the buffer.
+func (self *goGenerator) compileFloat(bits, endian string) string {
+	order := "binary.LittleEndian"
+	if endian == "be" {
+		order = "binary.BigEndian"
+	}
+
+	self.imports["math"] = true
+	switch bits {
+	case "16":
+		self.addHelper("vtypesFloat16frombits", `
+// Decode an IEEE 754 half precision float.
+func vtypesFloat16frombits(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1.0
+	}
+
+	exponent := int(bits>>10) & 0x1f
+	fraction := float64(bits & 0x3ff)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+
+	case 0x1f:
+		if fraction != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+
+	return sign * math.Ldexp(fraction+0x400, exponent-25)
+}`)
+		return fmt.Sprintf("vtypesFloat16frombits(%v.Uint16(buf))", order)
+
+	case "32":
+		return fmt.Sprintf("float64(math.Float32frombits(%v.Uint32(buf)))", order)
+	}
+
+	return fmt.Sprintf("math.Float64frombits(%v.Uint64(buf))", order)
+}
+
+var goIntRegex = regexp.MustCompile(`^(u?)int(8|16|32|64)(b|be|le)?$`)
+var goFloatRegex = regexp.MustCompile(`^float(16|32|64)(be|le)?$`)
+
+func (self *goGenerator) compileInt(go_struct *goGenStruct,
+	parser *IntParser, offset string) (*goGenValue, error) {
+	go_type := "int64"
+	var conversion string
+
+	// Generic ints follow the byte order of the struct.
+	if parser.big_endian != nil {
+		big_endian, err := self.isBigEndian(go_struct)
+		if err != nil {
+			return nil, err
+		}
+		if big_endian {
+			parser = parser.big_endian
+		}
+	}
+
+	match := goIntRegex.FindStringSubmatch(parser.type_name)
+	float_match := goFloatRegex.FindStringSubmatch(parser.type_name)
+	switch {
+	case float_match != nil:
+		go_type = "float64"
+		conversion = self.compileFloat(float_match[1], float_match[2])
+
+	case match == nil:
+		return nil, fmt.Errorf("%v can not be compiled", parser.type_name)
+
+	case match[2] == "8":
+		conversion = "int64(int8(buf[0]))"
+		if match[1] == "u" {
+			go_type = "uint64"
+			conversion = "uint64(buf[0])"
+		}
+
+	default:
+		order := "binary.LittleEndian"
+		if match[3] == "b" || match[3] == "be" {
+			order = "binary.BigEndian"
+		}
+
+		conversion = fmt.Sprintf("int64(int%v(%v.Uint%v(buf)))",
+			match[2], order, match[2])
+		if match[1] == "u" {
+			go_type = "uint64"
+			conversion = fmt.Sprintf("uint64(%v.Uint%v(buf))", order, match[2])
+		}
+	}
+
+	if strings.Contains(conversion, "binary.") {
+		self.imports["encoding/binary"] = true
+	}
+
+	self.imports["errors"] = true
+	self.addHelper("vtypesReadBuffer", `
+// Ints are read from an 8 byte buffer like the runtime IntParser.
+func vtypesReadBuffer(reader io.ReaderAt, offset int64) []byte {
+	buf := make([]byte, 8)
+	n, err := reader.ReadAt(buf, offset)
+	if n == 0 || (err != nil && !errors.Is(err, io.EOF)) {
+		return nil
+	}
+	return buf
+}`)
+
+	helper := "vtypesRead" + goIdentifier(parser.type_name)
+	self.addHelper(helper, fmt.Sprintf(`
+func %v(reader io.ReaderAt, offset int64) %v {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return %v
+}`, helper, go_type, conversion))
+
+	return &goGenValue{
+		go_type:    go_type,
+		expression: fmt.Sprintf("%v(reader, %v)", helper, offset),
+		size:       fmt.Sprintf("%d", parser.size),
+	}, nil
+}
+
+// The byte order of the generic ints in the struct. Structs without
+// their own endian attribute use the byte order of the enclosing
+// struct, which is only known statically if no struct sets one.
+func (self *goGenerator) isBigEndian(go_struct *goGenStruct) (bool, error) {
+	struct_parser := go_struct.parser
+	if struct_parser.endian_expression != nil {
+		return false, fmt.Errorf("endian of %v can not be compiled",
+			struct_parser.type_name)
+	}
+
+	if struct_parser.endian != "" {
+		return struct_parser.endian == BigEndian, nil
+	}
+
+	for _, parser := range self.profile.types {
+		other, ok := parser.(*StructParser)
+		if ok && other.endian != "" {
+			return false, fmt.Errorf(
+				"endian of %v depends on the enclosing struct",
+				struct_parser.type_name)
+		}
+	}
+
+	return self.profile.endian == BigEndian, nil
+}
+
+func (self *goGenerator) compileString(go_struct *goGenStruct,
+	parser *StringParser, options *ordereddict.Dict, offset string) (*goGenValue, error) {
+	instance, err := parser.New(self.profile, options)
+	if err != nil {
+		return nil, err
+	}
+	string_parser := instance.(*StringParser)
+
+	if string_parser.options.TermExpression != nil {
+		return nil, fmt.Errorf("term_exp can not be compiled")
+	}
+
+	var deps []string
+	length := "1024"
+	if string_parser.options.Length != nil {
+		length = fmt.Sprintf("%d", *string_parser.options.Length)
+	}
+
+	if string_parser.options.LengthExpression != nil {
+		source, _ := options.GetString("length")
+		length, deps, err = self.translateLambda(go_struct, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	term := defaultTerm
+	if string_parser.options.Term != nil {
+		term = *string_parser.options.Term
+	}
+	term_bytes := []byte(term)
+	if string_parser.options.utf16 {
+		term_bytes = UTF16Encode(term)
+	}
+
+	self.imports["bytes"] = true
+	self.imports["encoding/binary"] = true
+	self.imports["unicode/utf16"] = true
+	self.addHelper("vtypesReadString", `
+// Read a string like the runtime StringParser.
+func vtypesReadString(reader io.ReaderAt, offset, length, max_length int64,
+	term []byte, is_utf16 bool) []byte {
+	if length > max_length {
+		length = max_length
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	buf := make([]byte, length)
+	n, _ := reader.ReadAt(buf, offset)
+	result := buf[:n]
+
+	step := 1
+	if is_utf16 {
+		step = 2
+	}
+
+	if len(term) > 0 {
+		for i := 0; i < len(result); i += step {
+			if bytes.HasPrefix(result[i:], term) {
+				result = result[:i]
+				break
+			}
+		}
+	}
+
+	if is_utf16 {
+		ints := make([]uint16, len(result)/2)
+		for i := range ints {
+			ints[i] = binary.LittleEndian.Uint16(result[2*i:])
+		}
+		return []byte(string(utf16.Decode(ints)))
+	}
+
+	return result
+}`)
+
+	expression := fmt.Sprintf("vtypesReadString(reader, %v, int64(%v), %d, []byte(%q), %v)",
+		offset, length, string_parser.options.MaxLength, string(term_bytes),
+		string_parser.options.utf16)
+
+	if string_parser.options.Bytes {
+		return &goGenValue{
+			go_type:    "[]byte",
+			expression: expression,
+			deps:       deps,
+			size:       "int64(len(element))",
+		}, nil
+	}
+
+	return &goGenValue{
+		go_type:    "string",
+		expression: "string(" + expression + ")",
+		deps:       deps,
+		size:       "int64(len(element))",
+	}, nil
+}
+
+func (self *goGenerator) compileArray(go_struct *goGenStruct, name string,
+	parser *ArrayParser, options *ordereddict.Dict, offset string) (*goGenValue, error) {
+	instance, err := parser.New(self.profile, options)
+	if err != nil {
+		return nil, err
+	}
+	array_parser := instance.(*ArrayParser)
+
+	if array_parser.options.SentinelExpression != nil {
+		return nil, fmt.Errorf("sentinel can not be compiled")
+	}
+
+	var deps []string
+	count := fmt.Sprintf("%d", array_parser.options.Count)
+	if array_parser.options.CountExpression != nil {
+		source, _ := options.GetString("count")
+		count, deps, err = self.translateLambda(go_struct, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	element, err := self.compileType(go_struct, name+"Element",
+		array_parser.options.Type, array_parser.options.TypeOptions,
+		"offset+member_offset")
+	if err != nil {
+		return nil, err
+	}
+
+	if element.size == "" {
+		return nil, fmt.Errorf("size of %v elements is not known",
+			array_parser.options.Type)
+	}
+
+	method_name := "vtypesParse" + name
+	method := fmt.Sprintf(`
+func (self *%v) %v(reader io.ReaderAt, offset int64, count int64) []%v {
+	if count > %d {
+		count = %d
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	result := make([]%v, 0, count)
+	member_offset := int64(0)
+	for i := int64(0); i < count; i++ {
+		element := %v
+		element_size := int64(%v)
+		if element_size == 0 {
+			break
+		}
+		result = append(result, element)
+		member_offset += element_size
+	}
+	return result
+}`, go_struct.go_name, method_name, element.go_type,
+		array_parser.options.MaxCount, array_parser.options.MaxCount,
+		element.go_type, element.expression, element.size)
+
+	return &goGenValue{
+		go_type: "[]" + element.go_type,
+		expression: fmt.Sprintf("self.%v(reader, %v, int64(%v))",
+			method_name, offset, count),
+		deps:   append(deps, element.deps...),
+		method: method,
+	}, nil
+}
+
+var goLambdaTokenRegex = regexp.MustCompile(
+	"^(\\s+|0[xX][0-9a-fA-F]+|[0-9]+|[a-zA-Z_][a-zA-Z0-9_]*|`[^`]*`|=>|.)")
+
+// Translate simple lambdas (arithmetic on numeric fields of the
+// struct) into Go expressions.
+func (self *goGenerator) translateLambda(
+	go_struct *goGenStruct, source string) (string, []string, error) {
+	input := strings.TrimSpace(source)
+	var tokens []string
+	for len(input) > 0 {
+		token := goLambdaTokenRegex.FindString(input)
+		input = input[len(token):]
+		if strings.TrimSpace(token) != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	if len(tokens) < 3 || tokens[1] != "=>" {
+		return "", nil, fmt.Errorf("lambda %v can not be compiled", source)
+	}
+	variable := tokens[0]
+
+	result := ""
+	var deps []string
+	for i := 2; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case token == "+" || token == "-" || token == "*" ||
+			token == "(" || token == ")":
+			result += token
+
+		case token[0] >= '0' && token[0] <= '9':
+			value, err := strconv.ParseInt(token, 0, 64)
+			if err != nil {
+				return "", nil, err
+			}
+			result += fmt.Sprintf("%d", value)
+
+		case (token == variable || token == "this") &&
+			i+2 < len(tokens) && tokens[i+1] == ".":
+			field_name := strings.Trim(tokens[i+2], "`")
+			field, pres := go_struct.by_name[field_name]
+			if !pres || field.runtime || !field.isNumeric() {
+				return "", nil, fmt.Errorf("lambda %v can not be compiled", source)
+			}
+			result += fmt.Sprintf("int64(self.%v)", field.go_name)
+			deps = append(deps, field_name)
+			i += 2
+
+		default:
+			return "", nil, fmt.Errorf("lambda %v can not be compiled", source)
+		}
+	}
+
+	return "(" + result + ")", deps, nil
+}
+
+func (self *goGenerator) addHelper(name, code string) {
+	self.helpers[name] = code
+}
+
+// Convert a vtypes name into an exported Go identifier.
+func goIdentifier(name string) string {
+	result := []rune{}
+	for _, c := range name {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' {
+			result = append(result, c)
+		} else {
+			result = append(result, '_')
+		}
+	}
+
+	if len(result) == 0 || !unicode.IsLetter(result[0]) {
+		result = append([]rune{'X'}, result...)
+	}
+	result[0] = unicode.ToUpper(result[0])
+	return string(result)
+}
+
+func (self *goGenerator) goTypeName(name string) string {
+	return goIdentifier(name)
+}
+
+func (self *goGenStruct) goFieldName(name string) string {
+	result := goIdentifier(name)
+	candidate := result
+	for i := 1; self.go_names[candidate]; i++ {
+		candidate = fmt.Sprintf("%v%d", result, i)
+	}
+	self.go_names[candidate] = true
+	return candidate
+}
+
+func (self *goGenerator) emit(package_name string) (string, error) {
+	body := &bytes.Buffer{}
+
+	var names []string
+	for name := range self.structs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		go_struct := self.structs[name]
+		err := self.emitStruct(body, go_struct)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if self.uses_runtime {
+		definitions, err := self.profile.ExportDefinitions("json")
+		if err != nil {
+			return "", fmt.Errorf("GenerateGo: runtime fallback: %w", err)
+		}
+
+		// The definitions include the endian and constants. The
+		// built in types must follow the same data model.
+		add_model := "vtypes.AddModel(profile)"
+		if self.profile.model != DataModel(0) {
+			add_model = fmt.Sprintf("vtypes.AddModelFor(profile, vtypes.Model%v)",
+				self.profile.model)
+		}
+
+		self.imports["fmt"] = true
+		self.imports["sync"] = true
+		self.imports["www.velocidex.com/golang/vtypes"] = true
+		fmt.Fprintf(body, `
+// Fields which can not be compiled are parsed by the runtime parser.
+var vtypesDefinitions = %s
+
+var (
+	vtypesRuntimeOnce    sync.Once
+	vtypesRuntimeProfile *vtypes.Profile
+	vtypesRuntimeError   error
+)
+
+func vtypesRuntimeLoad() (*vtypes.Profile, error) {
+	vtypesRuntimeOnce.Do(func() {
+		profile := vtypes.NewProfile()
+		err := %s
+		if err != nil {
+			vtypesRuntimeError = err
+			return
+		}
+		vtypesRuntimeError = profile.ParseStructDefinitions(vtypesDefinitions)
+		if vtypesRuntimeError == nil {
+			vtypesRuntimeProfile = profile
+		}
+	})
+	return vtypesRuntimeProfile, vtypesRuntimeError
+}
+
+// The struct parsed by the runtime parser. It is only parsed once for
+// all the fields which need it.
+type vtypesRuntimeStruct struct {
+	obj *vtypes.StructObject
+	err error
+}
+
+func (self *vtypesRuntimeStruct) field(struct_name string,
+	reader io.ReaderAt, offset int64, field string) interface{} {
+	if self.obj == nil && self.err == nil {
+		self.obj, self.err = vtypesRuntimeParse(struct_name, reader, offset)
+	}
+	if self.obj == nil {
+		return nil
+	}
+
+	value, _ := self.obj.Get(field)
+	return value
+}
+
+func vtypesRuntimeParse(struct_name string,
+	reader io.ReaderAt, offset int64) (*vtypes.StructObject, error) {
+	profile, err := vtypesRuntimeLoad()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := profile.Parse(vtypes.MakeScope(), struct_name, reader, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	struct_obj, ok := obj.(*vtypes.StructObject)
+	if !ok {
+		return nil, fmt.Errorf("%%v is not a struct", struct_name)
+	}
+	return struct_obj, nil
+}
+`, strconv.Quote(definitions), add_model)
+	}
+
+	var helper_names []string
+	for name := range self.helpers {
+		helper_names = append(helper_names, name)
+	}
+	sort.Strings(helper_names)
+	for _, name := range helper_names {
+		body.WriteString(self.helpers[name])
+		body.WriteString("\n")
+	}
+
+	var imports []string
+	for name := range self.imports {
+		imports = append(imports, name)
+	}
+	sort.Strings(imports)
+
+	result := &bytes.Buffer{}
+	fmt.Fprintf(result,
+		"// Code generated by vtypes-gen. DO NOT EDIT.\n\npackage %v\n\nimport (\n",
+		package_name)
+	// Standard library imports come first.
+	for _, third_party := range []bool{false, true} {
+		if third_party && self.imports["www.velocidex.com/golang/vtypes"] {
+			result.WriteString("\n")
+		}
+		for _, name := range imports {
+			if strings.Contains(name, ".") == third_party {
+				fmt.Fprintf(result, "\t%q\n", name)
+			}
+		}
+	}
+	result.WriteString(")\n")
+	result.Write(body.Bytes())
+
+	formatted, err := format.Source(result.Bytes())
+	if err != nil {
+		return "", fmt.Errorf("GenerateGo: %w", err)
+	}
+	return string(formatted), nil
+}
+
+func (self *goGenerator) emitStruct(out *bytes.Buffer, go_struct *goGenStruct) error {
+	fields, err := go_struct.orderedFields()
+	if err != nil {
+		return fmt.Errorf("GenerateGo: %v: %w", go_struct.parser.type_name, err)
+	}
+
+	fmt.Fprintf(out, "\n// %v is generated from the struct %v.\ntype %v struct {\n",
+		go_struct.go_name, go_struct.parser.type_name, go_struct.go_name)
+	for _, field := range go_struct.fields {
+		json_name := field.name
+		// The runtime does not serialize fields starting with __
+		if strings.HasPrefix(json_name, "__") {
+			json_name = "-"
+		}
+		fmt.Fprintf(out, "\t%v %v `json:%q`\n",
+			field.go_name, field.go_type, json_name)
+	}
+
+	uses_runtime := go_struct.usesRuntime()
+	if uses_runtime {
+		out.WriteString("\n\tvtypesRuntime vtypesRuntimeStruct\n")
+	}
+	out.WriteString("}\n")
+
+	fmt.Fprintf(out, `
+func Parse%v(reader io.ReaderAt, offset int64) *%v {
+	self := &%v{}
+`, go_struct.go_name, go_struct.go_name, go_struct.go_name)
+	for _, field := range fields {
+		fmt.Fprintf(out, "\tself.%v = %v\n", field.go_name, field.expression)
+	}
+	out.WriteString("\treturn self\n}\n")
+
+	if uses_runtime {
+		fmt.Fprintf(out, `
+// The error from the runtime parser if the fields it parses could not
+// be parsed.
+func (self *%v) VtypesError() error {
+	return self.vtypesRuntime.err
+}
+`, go_struct.go_name)
+	}
+
+	if go_struct.size_expression != "" {
+		fmt.Fprintf(out, `
+func (self *%v) vtypesSize() int64 {
+	return int64(%v)
+}
+`, go_struct.go_name, go_struct.size_expression)
+	}
+
+	for _, field := range go_struct.fields {
+		if field.method != "" {
+			out.WriteString(field.method)
+			out.WriteString("\n")
+		}
+	}
+
+	return nil
+}
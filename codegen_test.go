@@ -0,0 +1,34 @@
+package vtypes
+
+import (
+	"os"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+// The generated code is tested against the runtime parser in the
+// internal/generated package. Make sure it is up to date.
+func TestGenerateGo(t *testing.T) {
+	definitions, err := os.ReadFile("internal/generated/profile.json")
+	assert.NoError(t, err)
+
+	profile := NewProfile()
+	err = AddModelFor(profile, ModelLP64)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(string(definitions))
+	assert.NoError(t, err)
+
+	code, err := profile.GenerateGo("generated")
+	assert.NoError(t, err)
+
+	expected, err := os.ReadFile("internal/generated/generated.go")
+	assert.NoError(t, err)
+
+	assert.Equal(t, string(expected), code,
+		"internal/generated is out of date, run go generate ./internal/generated")
+
+	_, err = profile.GenerateGo("generated", "Missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,134 @@
+package vtypes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"www.velocidex.com/golang/vfilter"
+)
+
+// Implemented by parsers which refer to other parsers. Parsers which
+// resolve their types lazily resolve them now. Returns the sub
+// parsers so they can be compiled too.
+type compilableParser interface {
+	compile() ([]Parser, error)
+}
+
+// A profile where all type references were resolved by
+// Profile.Compile(). Parsing never needs to look up types by name.
+type CompiledProfile struct {
+	profile *Profile
+}
+
+// The underlying profile. It can no longer be changed.
+func (self *CompiledProfile) Profile() *Profile {
+	return self.profile
+}
+
+func (self *CompiledProfile) Parse(scope vfilter.Scope, type_name string,
+	reader io.ReaderAt, offset int64) (interface{}, error) {
+	return self.profile.Parse(scope, type_name, reader, offset)
+}
+
+func (self *CompiledProfile) ObjectSize(scope vfilter.Scope,
+	name string, reader io.ReaderAt, offset int64) int {
+	return self.profile.ObjectSize(scope, name, reader, offset)
+}
+
+// Resolve all the types referred to by the structs and typedefs in
+// the profile and build all their parsers: Array element types,
+// Pointer targets, Union choices, Profile types etc. Normally these
+// are resolved on first use and problems are only logged at parse
+// time (and the field is NULL). Lambdas are already parsed when
+// definitions are added.
+//
+// All problems are reported at once. On success the profile can not
+// be changed any more: adding definitions, parsers, models or imports
+// fails.
+func (self *Profile) Compile() (*CompiledProfile, error) {
+	compiler := &profileCompiler{seen: make(map[Parser]bool)}
+
+	var names []string
+	for name, parser := range self.types {
+		switch t := parser.(type) {
+		case *StructParser:
+			if t.type_name == name {
+				names = append(names, name)
+			}
+
+		// Typedefs which are not used by any struct.
+		case *TypedefParser:
+			if t.definition.Name == name {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		compiler.compile(name, self.types[name])
+	}
+
+	if len(compiler.errors) > 0 {
+		return nil, fmt.Errorf("Compile: %w", errors.Join(compiler.errors...))
+	}
+
+	self.mu.Lock()
+	self.compiled = true
+	self.mu.Unlock()
+
+	return &CompiledProfile{profile: self}, nil
+}
+
+// Definitions can not be changed after the profile is compiled.
+func (self *Profile) checkMutable() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.compiled {
+		return errors.New("Profile is compiled and can not be changed")
+	}
+	return nil
+}
+
+type profileCompiler struct {
+	seen   map[Parser]bool
+	errors []error
+}
+
+// Compile the parser and all its sub parsers. The location is
+// used in errors.
+func (self *profileCompiler) compile(location string, parser Parser) {
+	if IsNil(parser) || self.seen[parser] {
+		return
+	}
+	self.seen[parser] = true
+
+	switch t := parser.(type) {
+	case *StructParser:
+		for _, field_name := range t.field_names {
+			field := t.fields[field_name]
+			field_location := t.type_name + "." + field_name
+			if IsNil(field.parser) {
+				self.errors = append(self.errors, fmt.Errorf(
+					"%v: field has no parser", field_location))
+				continue
+			}
+			self.compile(field_location, field.parser)
+		}
+
+	case compilableParser:
+		sub_parsers, err := t.compile()
+		if err != nil {
+			self.errors = append(self.errors,
+				fmt.Errorf("%v: %w", location, err))
+			return
+		}
+
+		for _, sub_parser := range sub_parsers {
+			self.compile(location, sub_parser)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+	"www.velocidex.com/golang/vfilter"
+)
+
+func TestCompile(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`
+[
+  ["Header", 8, [
+     ["Magic", 0, "uint8"],
+     ["Array", 0, "Array", {"type": "Later", "count": 2}],
+     ["Nested", 0, "Array", {"type": "Array", "count": 1,
+        "type_options": {"type": "Missing", "count": 1}}],
+     ["Pointer", 0, "Pointer", {"type": "Later"}],
+     ["Union", 0, "Union", {
+        "selector": "x=>x.Magic",
+        "choices": {"1": "Later", "2": "Missing"}}],
+     ["Profile", 0, "Profile", {"type": "Missing", "offset": "x=>0"}],
+     ["Time", 0, "WinFileTime", {"type": "Missing"}],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	scope := MakeScope()
+	reader := bytes.NewReader(sample)
+
+	// Parsing before the types are defined substitutes NULL.
+	obj, err := profile.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, vfilter.Null{}, Associative(scope, obj, "Pointer"))
+
+	_, err = profile.Compile()
+	assert.Error(t, err)
+	assert.Equal(t, `Compile: Header.Array: NotFoundError: Parser Later not found
+Header.Nested: NotFoundError: Parser Missing not found
+Header.Pointer: NotFoundError: Parser Later not found
+Header.Union: choice 1: NotFoundError: Parser Later not found
+choice 2: NotFoundError: Parser Missing not found
+Header.Profile: NotFoundError: Parser Missing not found
+Header.Time: NotFoundError: Parser Missing not found`, err.Error())
+
+	// A failed compile does not prevent adding definitions.
+	err = profile.ParseStructDefinitions(`
+[
+  ["Later", 2, [
+     ["Value", 0, "uint16"],
+  ]],
+  ["Missing", 1, [
+     ["Value", 0, "uint8"],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	compiled, err := profile.Compile()
+	assert.NoError(t, err)
+
+	// All the parsers are resolved now.
+	header := profile.types["Header"].(*StructParser)
+	assert.NotNil(t, header.fields["Array"].parser.(*ArrayParser).parser)
+	assert.NotNil(t, header.fields["Union"].parser.(*Union).options.choices["2"])
+	_, is_null := header.fields["Pointer"].parser.(*PointerParser).parser.(NullParser)
+	assert.False(t, is_null)
+
+	obj, err = compiled.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+	serialized, err := json.Marshal(Associative(scope, obj, "Array"))
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"Value":513},{"Value":1027}]`, string(serialized))
+	assert.Equal(t, uint64(0x0201), Associative(scope, obj, "Union.Value"))
+	assert.Equal(t, uint64(0x01), Associative(scope, obj, "Profile.Value"))
+	assert.Equal(t, 8, compiled.ObjectSize(scope, "Header", reader, 0))
+
+	// The pointer substituted at parse time was resolved.
+	obj, err = compiled.Parse(scope, "Header", bytes.NewReader(
+		[]byte{2, 0, 0, 0, 0, 0, 0, 0}), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), Associative(scope, obj, "Pointer.Value"))
+
+	// The profile can not be changed any more.
+	err = profile.ParseStructDefinitions(`[["Other", 0, []]]`)
+	assert.Error(t, err)
+	assert.Error(t, profile.Import("other", NewProfile()))
+	assert.Error(t, profile.AddParser("Other", profile.types["uint8"]))
+	assert.Error(t, AddModel(profile))
+	assert.Error(t, AddModelFor(profile, ModelLP64))
+	_, pres := profile.types["Other"]
+	assert.False(t, pres)
+
+	// Compiling again is fine.
+	_, err = profile.Compile()
+	assert.NoError(t, err)
+}
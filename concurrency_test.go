@@ -0,0 +1,144 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+var concurrencyData = []byte{
+	0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Pointer
+	0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Time
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+var concurrencyExpected = `{"Magic":1,"Array":[{"Value":513},{"Value":1027},{"Value":1541},{"Value":2055}],"Enum":"One","Pointer":{"Value":1027},"Profile":{"Value":770},"Union":{"Value":513},"Time":"1970-01-01T00:00:16Z","FileTime":"1601-01-01T00:00:00Z","Undefined":null}`
+
+// The fields refer to Later which is not defined when the struct is
+// added so their parsers are resolved by the first call to Parse().
+func concurrencyProfile(t *testing.T) *Profile {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`
+[
+  ["Header", 32, [
+     ["Magic", 0, "uint8"],
+     ["Array", 0, "Array", {"type": "Later", "count": 4}],
+     ["Enum", 0, "Enumeration", {"type": "LaterInt", "choices": {"1": "One"}}],
+     ["Pointer", 8, "Pointer", {"type": "Later"}],
+     ["Profile", 0, "Profile", {"type": "Later", "offset": "x=>x.Magic"}],
+     ["Union", 0, "Union", {
+        "selector": "x=>x.Magic",
+        "choices": {"1": "Later"}}],
+     ["Time", 16, "Timestamp", {"type": "LaterInt"}],
+     ["FileTime", 16, "WinFileTime", {"type": "LaterInt"}],
+     ["Undefined", 0, "Array", {"type": "Undefined", "count": 2}],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(`
+[
+  ["Later", 2, [
+     ["Value", 0, "uint16"],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+	profile.AddParser("LaterInt", profile.types["uint8"])
+
+	return profile
+}
+
+// Run with go test -race: many goroutines resolve the same lazily
+// filled parsers and fill the cache of the same object at once.
+func TestConcurrentResolve(t *testing.T) {
+	profile := concurrencyProfile(t)
+	reader := bytes.NewReader(concurrencyData)
+
+	scope := MakeScope()
+	shared, err := profile.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+
+	start := make(chan bool)
+	var ready, wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Each goroutine has its own scope like when parsing
+			// different files.
+			scope := MakeScope()
+			defer scope.Close()
+
+			obj, err := profile.Parse(scope, "Header", reader, 0)
+			assert.NoError(t, err)
+
+			// vfilter synchronizes internally which hides races
+			// from the race detector, so start all goroutines at
+			// once.
+			ready.Done()
+			<-start
+
+			for _, item := range []interface{}{obj, shared} {
+				for _, field := range []string{
+					"Array", "Enum", "Pointer", "Profile", "Union",
+					"Time", "FileTime", "Undefined"} {
+					item.(*StructObject).Get(field)
+				}
+			}
+		}()
+	}
+
+	ready.Wait()
+	close(start)
+	wg.Wait()
+
+	serialized, err := json.Marshal(shared)
+	assert.NoError(t, err)
+	assert.Equal(t, concurrencyExpected, string(serialized))
+}
+
+// Parse with a shared profile from many goroutines.
+func TestConcurrentParse(t *testing.T) {
+	profile := concurrencyProfile(t)
+	reader := bytes.NewReader(concurrencyData)
+
+	results := make(chan string, 20*20)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			scope := MakeScope()
+			defer scope.Close()
+
+			for j := 0; j < 20; j++ {
+				obj, err := profile.Parse(scope, "Header", reader, 0)
+				assert.NoError(t, err)
+
+				serialized, err := json.Marshal(obj)
+				assert.NoError(t, err)
+				results <- string(serialized)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(results)
+
+	for result := range results {
+		assert.Equal(t, concurrencyExpected, result)
+	}
+}
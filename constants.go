@@ -0,0 +1,161 @@
+// Constants declared by the profile and visible to all lambdas.
+
+package vtypes
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+// The scope variable holding the profile whose constants are in the
+// scope.
+const profileVariable = "__vtypes_profile"
+
+// Declare a constant which lambdas can refer to by name (e.g.
+// "x=>x.Count * PAGE_SIZE"). Callers may override constants for a
+// single parse by defining a variable of the same name in the scope
+// passed to Parse().
+func (self *Profile) SetConstant(name string, value interface{}) error {
+	err := self.checkMutable()
+	if err != nil {
+		return err
+	}
+
+	value, err = constantValue(name, value)
+	if err != nil {
+		return err
+	}
+
+	self.constants.Set(name, value)
+	return nil
+}
+
+// A copy of the constants declared by the profile, sorted by name.
+func (self *Profile) Constants() *ordereddict.Dict {
+	keys := self.constants.Keys()
+	sort.Strings(keys)
+
+	result := ordereddict.NewDict()
+	for _, k := range keys {
+		v, _ := self.constants.Get(k)
+		result.Set(k, v)
+	}
+	return result
+}
+
+// Constants are plain values. Numbers decoded from JSON are converted
+// to int64 or float64.
+func constantValue(name string, value interface{}) (interface{}, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Constant name can not be empty")
+	}
+
+	switch t := value.(type) {
+	case string, bool, float32, float64,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return value, nil
+
+	case json.Number:
+		i, err := t.Int64()
+		if err == nil {
+			return i, nil
+		}
+		return t.Float64()
+
+	default:
+		return nil, fmt.Errorf(
+			"Constant %v should be a number, string or bool, not %T",
+			name, value)
+	}
+}
+
+// Constants in the document are added before the structs. Outside
+// overlays a constant can not be declared twice.
+func (self *Profile) addConstants(
+	constants *ordereddict.Dict, overlay bool) error {
+	if constants == nil {
+		return nil
+	}
+
+	for _, k := range constants.Keys() {
+		v, _ := constants.Get(k)
+
+		_, pres := self.constants.Get(k)
+		if pres && !overlay {
+			return fmt.Errorf("Constant %v is already defined", k)
+		}
+
+		err := self.SetConstant(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make the constants visible to the lambdas evaluated while parsing
+// and set the profile's byte order. Variables already in the scope
+// override the constants. Types owned by an imported profile are
+// parsed with that profile's constants and byte order (see
+// enterScope()).
+func (self *Profile) parseScope(
+	scope vfilter.Scope, owner *Profile) vfilter.Scope {
+	// Nothing to add. Imported profiles need the profile variable
+	// to notice when parsing crosses into them.
+	if self.constants.Len() == 0 && self.endian == "" &&
+		len(self.imports) == 0 && (owner == nil || owner == self) {
+		return scope
+	}
+
+	vars := ordereddict.NewDict()
+	for _, k := range self.constants.Keys() {
+		v, _ := self.constants.Get(k)
+		vars.Set(k, v)
+	}
+
+	if self.endian != "" {
+		vars.Set(endianVariable, self.endian)
+	}
+
+	for _, k := range vars.Keys() {
+		_, pres := scope.Resolve(k)
+		if pres {
+			vars.Delete(k)
+		}
+	}
+	vars.Set(profileVariable, self)
+
+	subscope := scope.Copy()
+	subscope.AppendVars(vars)
+
+	if owner != nil {
+		owner.enterScope(subscope)
+	}
+	return subscope
+}
+
+// Called when parsing reaches a type owned by the profile. If the
+// scope belongs to another profile, the profile's own constants and
+// byte order replace that profile's, even if the scope already has
+// variables of the same name. Does nothing for parsers used without
+// Profile.Parse().
+func (self *Profile) enterScope(scope vfilter.Scope) {
+	current, pres := scope.Resolve(profileVariable)
+	if !pres || current == self {
+		return
+	}
+
+	vars := ordereddict.NewDict()
+	for _, k := range self.constants.Keys() {
+		v, _ := self.constants.Get(k)
+		vars.Set(k, v)
+	}
+	vars.Set(endianVariable, self.Endian())
+	vars.Set(profileVariable, self)
+	scope.AppendVars(vars)
+}
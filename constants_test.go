@@ -0,0 +1,217 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Velocidex/ordereddict"
+	assert "github.com/stretchr/testify/assert"
+	"www.velocidex.com/golang/vfilter"
+)
+
+var constantDefinitions = `
+{
+  "constants": {"HEADER_SIZE": 2, "ITEM_COUNT": 2, "BUILD": 19041, "TERMINATOR": 0xff},
+  "structs": [
+    ["Header", "x=>HEADER_SIZE + ITEM_COUNT", [
+      ["Items", "x=>HEADER_SIZE", "Array", {"type": "uint8", "count": "x=>ITEM_COUNT"}],
+      ["Terminated", 0, "Array", {"type": "uint8", "count": 10, "sentinel": "x=>x = TERMINATOR"}],
+      ["Build", 0, "Value", {"value": "x=>BUILD"}],
+      ["Version", 0, "Union", {
+         "selector": "x=>if(condition=BUILD > 10000, then='New', else='Old')",
+         "choices": {"New": "NewVersion", "Old": "OldVersion"}}],
+    ]],
+    ["NewVersion", 0, [
+      ["Value", 0, "uint16"],
+    ]],
+    ["OldVersion", 0, [
+      ["Value", 0, "uint8"],
+    ]],
+  ]
+}
+`
+
+func TestConstants(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(constantDefinitions)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader([]byte{0x01, 0x02, 0x03, 0xff, 0x05})
+
+	obj, err := profile.Parse(MakeScope(), "Header", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Items":[3,255],"Terminated":[1,2,3],"Build":19041,"Version":{"Value":513}}`,
+		string(serialized))
+	assert.Equal(t, 4, obj.(*StructObject).Size())
+
+	// Variables in the caller's scope override the constants.
+	scope := MakeScope()
+	scope.AppendVars(ordereddict.NewDict().
+		Set("BUILD", 7601).
+		Set("ITEM_COUNT", 1))
+
+	obj, err = profile.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err = json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Items":[3],"Terminated":[1,2,3],"Build":7601,"Version":{"Value":1}}`,
+		string(serialized))
+
+	// Constants are exported and can be parsed again.
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	assert.Contains(t, exported,
+		`"constants": {"BUILD": 19041, "HEADER_SIZE": 2, "ITEM_COUNT": 2, "TERMINATOR": 255},`)
+
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		round_trip := NewProfile()
+		AddModel(round_trip)
+		err = round_trip.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		re_exported, err := round_trip.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, re_exported, format)
+	}
+
+	// Constants can not be declared twice, except in overlays.
+	err = profile.ParseStructDefinitions(`{"constants": {"BUILD": 7601}}`)
+	assert.Error(t, err)
+
+	err = profile.ApplyOverlay(`{"constants": {"BUILD": 7601}}`)
+	assert.NoError(t, err)
+
+	err = profile.SetConstant("ITEM_COUNT", 1)
+	assert.NoError(t, err)
+
+	obj, err = profile.Parse(MakeScope(), "Header", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err = json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Items":[3],"Terminated":[1,2,3],"Build":7601,"Version":{"Value":1}}`,
+		string(serialized))
+
+	err = profile.SetConstant("TABLE", []int{1, 2})
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"BUILD", "HEADER_SIZE", "ITEM_COUNT", "TERMINATOR"},
+		profile.Constants().Keys())
+
+	_, err = profile.Compile()
+	assert.NoError(t, err)
+
+	err = profile.SetConstant("BUILD", 19041)
+	assert.Error(t, err)
+}
+
+// Structs of an imported profile use the constants of the profile
+// which defines them, wherever they are used.
+func TestImportedConstants(t *testing.T) {
+	b := NewNamedProfile("b")
+	AddModel(b)
+	err := b.ParseStructDefinitions(`
+{
+  "constants": {"V": 2},
+  "structs": [
+    ["Rec", 1, [
+      ["V", 0, "Value", {"value": "x=>V"}],
+    ]],
+  ]
+}`)
+	assert.NoError(t, err)
+
+	a := NewProfile()
+	AddModel(a)
+	err = a.Import("b", b)
+	assert.NoError(t, err)
+
+	err = a.ParseStructDefinitions(`
+{
+  "constants": {"V": 1},
+  "structs": [
+    ["Outer", 0, [
+      ["R", 0, "b::Rec"],
+      ["Recs", 0, "Array", {"type": "b::Rec", "count": 1}],
+      ["Own", 0, "Value", {"value": "x=>V"}],
+    ]],
+  ]
+}`)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader([]byte{0})
+	for _, test_case := range []struct {
+		profile   *Profile
+		type_name string
+	}{{a, "b::Rec"}, {b, "Rec"}} {
+		obj, err := test_case.profile.Parse(MakeScope(), test_case.type_name, reader, 0)
+		assert.NoError(t, err)
+
+		serialized, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"V":2}`, string(serialized), test_case.type_name)
+	}
+
+	obj, err := a.Parse(MakeScope(), "Outer", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"R":{"V":2},"Recs":[{"V":2}],"Own":1}`, string(serialized))
+
+	// The caller's variables override the constants of the profile
+	// being parsed but not those of the imported profile.
+	scope := MakeScope()
+	scope.AppendVars(ordereddict.NewDict().Set("V", 3))
+
+	obj, err = a.Parse(scope, "Outer", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err = json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"R":{"V":2},"Recs":[{"V":2}],"Own":3}`, string(serialized))
+}
+
+// The number of open child scopes. vfilter keeps children until they
+// are closed.
+func openChildScopes(scope vfilter.Scope) int {
+	children := reflect.ValueOf(scope).Elem().FieldByName("children")
+	result := 0
+	for i := 0; i < children.Len(); i++ {
+		if !children.Index(i).IsNil() {
+			result++
+		}
+	}
+	return result
+}
+
+// Parsing many times with the same scope does not leak subscopes.
+func TestParseScopeClosed(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(constantDefinitions)
+	assert.NoError(t, err)
+
+	scope := MakeScope()
+	reader := bytes.NewReader([]byte{0x01, 0x02, 0x03, 0xff, 0x05})
+	for i := 0; i < 20; i++ {
+		obj, err := profile.Parse(scope, "Header", reader, 0)
+		assert.NoError(t, err)
+
+		_, err = json.Marshal(obj)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 0, openChildScopes(scope))
+}
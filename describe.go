@@ -0,0 +1,291 @@
+// Introspection of the types in a profile.
+
+package vtypes
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Describes a type in the profile. Returned by Profile.Describe().
+type TypeDescription struct {
+	// The name the type was defined with. For aliases (e.g. "int")
+	// this is the name of the aliased type (e.g. "int32").
+	Name string
+
+	// True for structs. Only structs have fields.
+	IsStruct bool
+
+	// The size in bytes if it is fixed, otherwise 0.
+	Size int
+
+	// For structs whose size is given by an expression.
+	SizeExpression string
+
+	// The documentation and tags of the struct definition.
+	Doc  string
+	Tags []string
+
+	Fields []*FieldDescription
+}
+
+type FieldDescription struct {
+	Name string
+
+	// The offset from the start of the struct, unless the offset is
+	// given by an expression or follows a field of variable size.
+	Offset           int64
+	OffsetExpression string
+
+	// The field is placed after the previous field.
+	AutoOffset bool
+
+	// The field follows a field of variable size so its offset is
+	// only known when parsing.
+	FollowsVariableSize bool
+
+	// Name of the type of the field and its options. Options are
+	// sorted by key like in ExportDefinitions().
+	Type    string
+	Options *ordereddict.Dict
+
+	// The size in bytes if it is fixed, otherwise 0.
+	Size int
+
+	Doc  string
+	Tags []string
+}
+
+// The names of all the types in the profile, including the built in
+// types and aliases, in sorted order. Types of imported profiles are
+// not included.
+func (self *Profile) Types() []string {
+	result := make([]string, 0, len(self.types))
+	for name := range self.types {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Describe the named type. For structs this includes the fields in
+// the order they are parsed. Qualified names of imported types may
+// be used.
+func (self *Profile) Describe(name string) (*TypeDescription, error) {
+	parser, _, pres := self.getType(name)
+	if !pres {
+		return nil, fmt.Errorf("%w: Type %v not found", NotFoundError, name)
+	}
+
+	result := &TypeDescription{
+		Name: name,
+		Size: fixedSize(parser),
+	}
+
+	int_parser, ok := parser.(*IntParser)
+	if ok {
+		result.Name = int_parser.type_name
+	}
+
+	struct_parser, ok := parser.(*StructParser)
+	if !ok {
+		return result, nil
+	}
+
+	result.Name = struct_parser.type_name
+	result.IsStruct = true
+	result.SizeExpression = struct_parser.size_expression_source
+	result.Doc = struct_parser.doc
+	result.Tags = struct_parser.tags
+	for _, field_name := range struct_parser.field_names {
+		field := struct_parser.fields[field_name]
+
+		field_desc := &FieldDescription{
+			Name:   field_name,
+			Offset: field.offset,
+			Size:   fixedSize(field.parser),
+		}
+
+		if field.definition != nil {
+			field_desc.OffsetExpression = field.definition.OffsetExpression
+			field_desc.AutoOffset = field.definition.AutoOffset
+			field_desc.Type = field.definition.Type
+			field_desc.Options = sortedOptions(field.definition.Options)
+			field_desc.Doc = field.definition.Doc
+			field_desc.Tags = field.definition.Tags
+		}
+
+		// Fields with an offset expression have no static offset.
+		if field.isDynamic() {
+			field_desc.Offset = 0
+		}
+		field_desc.FollowsVariableSize = field.previous != nil
+
+		result.Fields = append(result.Fields, field_desc)
+	}
+
+	return result, nil
+}
+
+// The offset of the field from the start of the struct. The field may
+// be a path through nested structs (e.g. "Header.Length"). Fails if
+// any of the offsets are given by an expression or follow a field of
+// variable size since these can only be known when parsing.
+func (self *Profile) OffsetOf(type_name, field string) (int64, error) {
+	parser, _, pres := self.getType(type_name)
+	if !pres {
+		return 0, fmt.Errorf("%w: Type %v not found", NotFoundError, type_name)
+	}
+
+	result := int64(0)
+	for _, component := range strings.Split(field, ".") {
+		struct_parser, ok := parser.(*StructParser)
+		if !ok {
+			return 0, fmt.Errorf("OffsetOf %v.%v: %v is not a struct",
+				type_name, field, component)
+		}
+
+		field_parser, pres := struct_parser.fields[component]
+		if !pres {
+			return 0, fmt.Errorf("%w: OffsetOf %v.%v: %v has no field %v",
+				NotFoundError, type_name, field,
+				struct_parser.type_name, component)
+		}
+
+		if field_parser.offset_expression != nil {
+			return 0, fmt.Errorf(
+				"OffsetOf %v.%v: offset of %v.%v is an expression",
+				type_name, field, struct_parser.type_name, component)
+		}
+
+		if field_parser.previous != nil {
+			return 0, fmt.Errorf(
+				"OffsetOf %v.%v: %v.%v follows a field of variable size",
+				type_name, field, struct_parser.type_name, component)
+		}
+
+		result += field_parser.offset
+		parser = field_parser.parser
+
+		// Fields may use a typedef of a struct.
+		typedef, ok := parser.(*TypedefParser)
+		for ok {
+			parser, _ = typedef.getParser()
+			typedef, ok = parser.(*TypedefParser)
+		}
+	}
+
+	return result, nil
+}
+
+// The size of the data read by the parser if it is always the same,
+// otherwise 0.
+func fixedSize(parser Parser) int {
+	switch t := parser.(type) {
+	case *StructParser:
+		if t.size_expression != nil {
+			return 0
+		}
+		return t.size
+
+	case *ArrayParser:
+		if t.options.CountExpression != nil ||
+			t.options.SentinelExpression != nil {
+			return 0
+		}
+
+		t.mu.Lock()
+		element := t.parser
+		t.mu.Unlock()
+
+		// The element type may not be resolved yet.
+		if element == nil {
+			element = lookupParser(t.profile,
+				t.options.Type, t.options.TypeOptions)
+		}
+
+		count := t.options.Count
+		if count > t.options.MaxCount {
+			count = t.options.MaxCount
+		}
+		return int(count) * fixedSize(element)
+
+	case *StringParser:
+		if t.options.Length == nil || t.options.LengthExpression != nil {
+			return 0
+		}
+		length := *t.options.Length
+		if length > t.options.MaxLength {
+			length = t.options.MaxLength
+		}
+		return int(length)
+
+	case *EnumerationParser:
+		t.mu.Lock()
+		element := t.parser
+		t.mu.Unlock()
+
+		if element == nil {
+			element = lookupParser(t.profile,
+				t.options.Type, t.options.TypeOptions)
+		}
+		return fixedSize(element)
+
+	case *TypedefParser:
+		parser, _ := t.getParser()
+		return fixedSize(parser)
+
+	case *BitFieldParser:
+		return fixedSize(t.parser)
+
+	case *Flags:
+		return fixedSize(t.parser)
+
+	case *PointerParser:
+		if t.address_parser != nil {
+			return fixedSize(t.address_parser)
+		}
+		return 8
+
+	// The prototype registered by AddModel() has no timestamp.
+	case *WinFileTime:
+		if t.EpochTimestamp == nil {
+			return 0
+		}
+		return t.Size()
+
+	case Sizer:
+		return t.Size()
+
+	default:
+		return 0
+	}
+}
+
+// Look up the parser for a type which was not resolved yet, without
+// caching it in the parser which refers to it: describing the profile
+// does not change it. Returns nil if the type is not defined.
+// Prototypes registered by AddModel() have no profile.
+func lookupParser(profile *Profile,
+	name string, options *ordereddict.Dict) Parser {
+	if profile == nil {
+		return nil
+	}
+
+	parser, owner, pres := profile.getType(name)
+	if !pres {
+		return nil
+	}
+	if options == nil {
+		options = ordereddict.NewDict()
+	}
+
+	result, err := parser.New(owner, options)
+	if err != nil {
+		return nil
+	}
+	return result
+}
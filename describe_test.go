@@ -0,0 +1,90 @@
+package vtypes
+
+import (
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDescribe(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`
+[
+  ["Header", 0x20, [
+     ["Magic", 0, "String", {"length": 4}],
+     ["Flags", 4, "BitField", {"type": "uint16", "start_bit": 0, "end_bit": 4}],
+     ["Kind", 6, "Enumeration", {"type": "uint16be", "choices": {"1": "File"}}],
+     ["Entries", 8, "Array", {"type": "Entry", "count": 2}],
+     ["Dynamic", 8, "Array", {"type": "Entry", "count": "x=>x.Kind"}],
+     ["Next", 16, "Pointer", {"type": "Header"}],
+     ["Data", "x=>x.Next", "Entry"],
+  ]],
+  ["Entry", 4, [
+     ["Type", 0, "uint16"],
+     ["Value", 2, "int16"],
+  ]],
+  ["Record", "x=>x.Header.Kind", [
+     ["Header", 0x10, "Header"],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	types := profile.Types()
+	assert.Contains(t, types, "Header")
+	assert.Contains(t, types, "uint32")
+
+	// All types can be described, including the built in ones.
+	for _, name := range types {
+		_, err := profile.Describe(name)
+		assert.NoError(t, err, name)
+	}
+
+	var descriptions []*TypeDescription
+	for _, name := range []string{"Header", "Record", "int"} {
+		description, err := profile.Describe(name)
+		assert.NoError(t, err)
+		descriptions = append(descriptions, description)
+	}
+	goldie.Assert(t, "TestDescribe", []byte(StringIndent(descriptions)))
+
+	_, err = profile.Describe("Missing")
+	assert.Error(t, err)
+
+	offset, err := profile.OffsetOf("Record", "Header.Entries")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0x18), offset)
+
+	offset, err = profile.OffsetOf("Header", "Next")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0x10), offset)
+
+	for _, bad := range []string{
+		"Header.Missing", "Header.Magic.Length", "Header.Data"} {
+		_, err = profile.OffsetOf("Record", bad)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = profile.OffsetOf("Missing", "Header")
+	assert.Error(t, err)
+
+	// Types defined later are sized without resolving them in the
+	// parser: describing the profile does not change it.
+	err = profile.ParseStructDefinitions(`
+[["Late", 0, [["Items", 0, "Array", {"type": "LateEntry", "count": 2}]]]]`)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(`
+[["LateEntry", 2, [["Value", 0, "uint16"]]]]`)
+	assert.NoError(t, err)
+
+	description, err := profile.Describe("Late")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, description.Fields[0].Size)
+
+	items := profile.types["Late"].(*StructParser).fields["Items"].parser
+	assert.Nil(t, items.(*ArrayParser).parser)
+}
@@ -0,0 +1,840 @@
+// A compact C-like text form of profile definitions. It is easier to
+// write by hand (e.g. inside a VQL string) than the nested JSON form:
+//
+//	endian little;
+//	const MAX_ENTRIES = 16;
+//	typedef Handle: uint32;
+//
+//	struct Header @size(x=>x.Len) @doc("The file header") {
+//	    0x00 Signature: String(length=4);
+//	    0x04 Count: uint32 @tags(counter);
+//	    (x=>x.Count * 4) Trailer: uint16;
+//	    Entries: Array<Entry>(count=x=>x.Count);
+//	}
+//
+// Fields start with their offset: a number, a lambda in parentheses
+// or nothing for an automatic offset. The type in angle brackets
+// becomes the "type" option (and its options "type_options"). Option
+// values are numbers, quoted strings, true or false, lambdas, bare
+// words, lists in [] and maps in {} (e.g. map={A=1, B=2}). Struct
+// attributes are @size, @extends, @endian, @align, @pack, @doc and
+// @tags while fields accept @doc and @tags.
+
+package vtypes
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Parse definitions written in the DSL.
+func ParseProfileDSL(text string) (*ProfileDefinitions, error) {
+	parser := newDSLParser(text)
+	err := parser.parse()
+	if err != nil {
+		return nil, err
+	}
+	return parser.definitions, nil
+}
+
+// Profile documents in the DSL start with one of these keywords
+// (after any comments).
+var dslKeywords = map[string]bool{
+	"struct":  true,
+	"typedef": true,
+	"const":   true,
+	"endian":  true,
+}
+
+func isProfileDSL(text string) bool {
+	parser := newDSLParser(text)
+	keyword, ok := parser.ident()
+	if !ok || !dslKeywords[keyword] || parser.pos >= len(text) {
+		return false
+	}
+	return strings.ContainsRune(" \t\r\n/", rune(text[parser.pos]))
+}
+
+func (self *Profile) addDSLDefinitions(text string, overlay bool) error {
+	parser := newDSLParser(text)
+	err := parser.parse()
+	if err != nil {
+		return err
+	}
+	return parser.locateError(self.addDefinitions(parser.definitions, overlay))
+}
+
+// Where a definition starts in the text, and where each of its
+// fields start.
+type dslPosition struct {
+	offset int
+	fields []int
+}
+
+type dslParser struct {
+	text string
+	pos  int
+
+	definitions *ProfileDefinitions
+
+	// Parallel to the structs and typedefs in the definitions.
+	structs  []*dslPosition
+	typedefs []*dslPosition
+}
+
+func newDSLParser(text string) *dslParser {
+	return &dslParser{
+		text:        text,
+		definitions: &ProfileDefinitions{},
+	}
+}
+
+func (self *dslParser) position(offset int) (int, int) {
+	line := 1 + strings.Count(self.text[:offset], "\n")
+	column := offset - strings.LastIndex(self.text[:offset], "\n")
+	return line, column
+}
+
+func (self *dslParser) errorAt(offset int, format string, args ...interface{}) error {
+	line, column := self.position(offset)
+	return fmt.Errorf("line %d column %d: %v", line, column,
+		fmt.Sprintf(format, args...))
+}
+
+// Errors from adding the definitions are located at the struct,
+// field or typedef they refer to.
+func (self *dslParser) locateError(err error) error {
+	var definition_error *DefinitionError
+	if !errors.As(err, &definition_error) || definition_error.Line > 0 {
+		return err
+	}
+
+	var names []string
+	positions := self.structs
+	if definition_error.Kind == "typedef" {
+		positions = self.typedefs
+		for _, typedef := range self.definitions.Typedefs {
+			names = append(names, typedef.Name)
+		}
+	} else {
+		for _, struct_def := range self.definitions.Structs {
+			names = append(names, struct_def.Name)
+		}
+	}
+
+	index := definition_error.Index
+	if index < 0 || index >= len(positions) {
+		index = -1
+		for i, name := range names {
+			if name == definition_error.Name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return err
+		}
+	}
+
+	position := positions[index]
+	offset := position.offset
+	if definition_error.Field >= 0 && definition_error.Field < len(position.fields) {
+		offset = position.fields[definition_error.Field]
+	}
+	definition_error.Line, definition_error.Column = self.position(offset)
+	return err
+}
+
+// Attach the position to errors found while building a definition.
+func (self *dslParser) definitionErrorAt(offset int, err error) error {
+	var definition_error *DefinitionError
+	if errors.As(err, &definition_error) {
+		definition_error.Line, definition_error.Column = self.position(offset)
+	}
+	return err
+}
+
+// Skip white space and comments.
+func (self *dslParser) skipSpace() {
+	for self.pos < len(self.text) {
+		rest := self.text[self.pos:]
+		switch {
+		case strings.ContainsRune(" \t\r\n\f\v", rune(rest[0])):
+			self.pos++
+
+		case strings.HasPrefix(rest, "//"):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			self.pos += end
+
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				self.pos = len(self.text)
+			} else {
+				self.pos += end + 4
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+func (self *dslParser) peek() byte {
+	self.skipSpace()
+	if self.pos >= len(self.text) {
+		return 0
+	}
+	return self.text[self.pos]
+}
+
+func (self *dslParser) consume(token string) bool {
+	self.skipSpace()
+	if strings.HasPrefix(self.text[self.pos:], token) {
+		self.pos += len(token)
+		return true
+	}
+	return false
+}
+
+// Missing tokens are reported right after the previous token.
+func (self *dslParser) expect(token string) error {
+	if self.consume(token) {
+		return nil
+	}
+
+	end := self.pos
+	for end > 0 && strings.IndexByte(" \t\r\n\f\v", self.text[end-1]) >= 0 {
+		end--
+	}
+	return self.errorAt(end, "expected '%v' but found %v",
+		token, self.describeNext())
+}
+
+func (self *dslParser) describeNext() string {
+	if self.peek() == 0 {
+		return "end of text"
+	}
+
+	end := self.pos + 1
+	for end < len(self.text) && isIdentChar(self.text[end]) &&
+		isIdentChar(self.text[self.pos]) {
+		end++
+	}
+	return fmt.Sprintf("'%v'", self.text[self.pos:end])
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (self *dslParser) ident() (string, bool) {
+	c := self.peek()
+	if !isIdentChar(c) || isDigit(c) {
+		return "", false
+	}
+
+	start := self.pos
+	for self.pos < len(self.text) && isIdentChar(self.text[self.pos]) {
+		self.pos++
+	}
+	return self.text[start:self.pos], true
+}
+
+func (self *dslParser) expectIdent(what string) (string, error) {
+	name, ok := self.ident()
+	if !ok {
+		return "", self.errorAt(self.pos, "expected %v but found %v",
+			what, self.describeNext())
+	}
+	return name, nil
+}
+
+func (self *dslParser) parse() error {
+	for self.peek() != 0 {
+		start := self.pos
+		keyword, _ := self.ident()
+
+		var err error
+		switch keyword {
+		case "struct":
+			err = self.parseStruct(start)
+		case "typedef":
+			err = self.parseTypedef(start)
+		case "const":
+			err = self.parseConstant()
+		case "endian":
+			err = self.parseEndian(start)
+		default:
+			self.pos = start
+			err = self.errorAt(start,
+				"expected struct, typedef, const or endian but found %v",
+				self.describeNext())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endian little;
+func (self *dslParser) parseEndian(start int) error {
+	value, err := self.parseValue()
+	if err != nil {
+		return err
+	}
+
+	endian, ok := value.(string)
+	if !ok {
+		return self.errorAt(start, "endian should be little or big")
+	}
+	if self.definitions.Endian != "" {
+		return self.errorAt(start, "endian given more than once")
+	}
+	self.definitions.Endian = endian
+	return self.expect(";")
+}
+
+// const NAME = value;
+func (self *dslParser) parseConstant() error {
+	name, err := self.expectIdent("a constant name")
+	if err != nil {
+		return err
+	}
+
+	err = self.expect("=")
+	if err != nil {
+		return err
+	}
+
+	value, err := self.parseValue()
+	if err != nil {
+		return err
+	}
+
+	if self.definitions.Constants == nil {
+		self.definitions.Constants = ordereddict.NewDict()
+	}
+	self.definitions.Constants.Set(name, value)
+	return self.expect(";")
+}
+
+// typedef NAME: TYPE;
+func (self *dslParser) parseTypedef(start int) error {
+	name, err := self.expectIdent("a typedef name")
+	if err != nil {
+		return err
+	}
+
+	err = self.expect(":")
+	if err != nil {
+		return err
+	}
+
+	type_name, options, err := self.parseType()
+	if err != nil {
+		return err
+	}
+
+	self.definitions.Typedefs = append(self.definitions.Typedefs,
+		&TypedefDefinition{
+			Name:    name,
+			Type:    type_name,
+			Options: options,
+		})
+	self.typedefs = append(self.typedefs, &dslPosition{offset: start})
+	return self.expect(";")
+}
+
+// struct NAME @attribute... { fields } with an optional ;
+func (self *dslParser) parseStruct(start int) error {
+	name, err := self.expectIdent("a struct name")
+	if err != nil {
+		return err
+	}
+
+	struct_def := &StructDefinition{Name: name}
+	position := &dslPosition{offset: start}
+
+	for self.peek() == '@' {
+		attribute_start := self.pos
+		attribute, value, err := self.parseAttribute()
+		if err != nil {
+			return err
+		}
+
+		err = self.setStructAttribute(struct_def, attribute, value)
+		if err != nil {
+			return self.definitionErrorAt(attribute_start,
+				struct_def.error(-1, err))
+		}
+	}
+
+	err = self.expect("{")
+	if err != nil {
+		return err
+	}
+
+	for !self.consume("}") {
+		if self.peek() == 0 {
+			return self.errorAt(self.pos, "struct %v is not closed", name)
+		}
+
+		self.skipSpace()
+		position.fields = append(position.fields, self.pos)
+		field_def, err := self.parseField(struct_def)
+		if err != nil {
+			return err
+		}
+		struct_def.Fields = append(struct_def.Fields, field_def)
+	}
+	self.consume(";")
+
+	self.definitions.Structs = append(self.definitions.Structs, struct_def)
+	self.structs = append(self.structs, position)
+	return nil
+}
+
+func (self *dslParser) setStructAttribute(struct_def *StructDefinition,
+	attribute string, value interface{}) error {
+	switch attribute {
+	case "size":
+		switch t := value.(type) {
+		case string:
+			struct_def.SizeExpression = t
+		default:
+			size, ok := to_int64(value)
+			if !ok {
+				return errors.New("size should be an int or a lambda")
+			}
+			struct_def.Size = int(size)
+		}
+		return nil
+
+	case "doc":
+		return docFromYAML(value, &struct_def.Doc)
+
+	case "tags":
+		return tagsFromYAML(value, &struct_def.Tags)
+
+	default:
+		return struct_def.setOptions(ordereddict.NewDict().Set(attribute, value))
+	}
+}
+
+// @name or @name(value) or @name(value, value...). Attributes
+// without a value are true, several values form a list.
+func (self *dslParser) parseAttribute() (string, interface{}, error) {
+	err := self.expect("@")
+	if err != nil {
+		return "", nil, err
+	}
+
+	name, err := self.expectIdent("an attribute name")
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !self.consume("(") {
+		return name, true, nil
+	}
+
+	values, err := self.parseValues(")")
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(values) == 1 && name != "tags" {
+		return name, values[0], nil
+	}
+	return name, values, nil
+}
+
+// [offset] NAME: TYPE @attribute... ;
+func (self *dslParser) parseField(struct_def *StructDefinition) (
+	*FieldDefinition, error) {
+	field_def := &FieldDefinition{}
+	index := len(struct_def.Fields)
+
+	switch c := self.peek(); {
+	case isDigit(c) || c == '-' || c == '+':
+		start := self.pos
+		value, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		offset, ok := to_int64(value)
+		if !ok {
+			return nil, self.errorAt(start, "field offset should be an int")
+		}
+		field_def.Offset = offset
+
+	case c == '(':
+		self.pos++
+		start := self.pos
+		expression, err := self.parseLambda(start)
+		if err != nil {
+			return nil, err
+		}
+		if expression == "" {
+			return nil, self.errorAt(start, "expected an offset expression")
+		}
+		field_def.OffsetExpression = expression
+
+		err = self.expect(")")
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		field_def.AutoOffset = true
+	}
+
+	name, err := self.expectIdent("a field name")
+	if err != nil {
+		return nil, err
+	}
+	field_def.Name = name
+
+	err = self.expect(":")
+	if err != nil {
+		return nil, err
+	}
+
+	field_def.Type, field_def.Options, err = self.parseType()
+	if err != nil {
+		return nil, err
+	}
+
+	for self.peek() == '@' {
+		attribute_start := self.pos
+		attribute, value, err := self.parseAttribute()
+		if err != nil {
+			return nil, err
+		}
+
+		switch attribute {
+		case "doc":
+			err = docFromYAML(value, &field_def.Doc)
+		case "tags":
+			err = tagsFromYAML(value, &field_def.Tags)
+		default:
+			err = fmt.Errorf("Unknown field attribute %v", attribute)
+		}
+		if err != nil {
+			return nil, self.definitionErrorAt(attribute_start,
+				&DefinitionError{
+					Kind:      "struct",
+					Name:      struct_def.Name,
+					Index:     -1,
+					Field:     index,
+					FieldName: name,
+					Err:       err,
+				})
+		}
+	}
+
+	return field_def, self.expect(";")
+}
+
+// A type name followed by an optional inner type in <> and options
+// in (). The inner type becomes the "type" option.
+func (self *dslParser) parseType() (string, *ordereddict.Dict, error) {
+	self.skipSpace()
+	start := self.pos
+	for self.pos < len(self.text) {
+		c := self.text[self.pos]
+		if !isIdentChar(c) && !strings.ContainsRune(" \t*:.", rune(c)) {
+			break
+		}
+		// A single : ends the type (e.g. in a map key).
+		if c == ':' && !strings.HasPrefix(self.text[self.pos:], NamespaceSeparator) {
+			break
+		}
+		if c == ':' {
+			self.pos++
+		}
+		self.pos++
+	}
+
+	name := strings.Join(strings.Fields(self.text[start:self.pos]), " ")
+	if name == "" {
+		return "", nil, self.errorAt(start, "expected a type but found %v",
+			self.describeNext())
+	}
+
+	options := ordereddict.NewDict()
+	if self.consume("<") {
+		inner_type, inner_options, err := self.parseType()
+		if err != nil {
+			return "", nil, err
+		}
+
+		err = self.expect(">")
+		if err != nil {
+			return "", nil, err
+		}
+
+		options.Set("type", inner_type)
+		if inner_options != nil {
+			options.Set("type_options", inner_options)
+		}
+	}
+
+	if self.consume("(") {
+		for !self.consume(")") {
+			key_start := self.pos
+			key, err := self.expectIdent("an option name")
+			if err != nil {
+				return "", nil, err
+			}
+
+			_, pres := options.Get(key)
+			if pres {
+				return "", nil, self.errorAt(key_start,
+					"option %v given more than once", key)
+			}
+
+			err = self.expect("=")
+			if err != nil {
+				return "", nil, err
+			}
+
+			value, err := self.parseValue()
+			if err != nil {
+				return "", nil, err
+			}
+			options.Set(key, value)
+
+			if !self.consume(",") && self.peek() != ')' {
+				return "", nil, self.errorAt(self.pos,
+					"expected ',' or ')' but found %v", self.describeNext())
+			}
+		}
+	}
+
+	if options.Len() == 0 {
+		options = nil
+	}
+	return name, options, nil
+}
+
+// Values separated by commas up to the closing token.
+func (self *dslParser) parseValues(end string) ([]interface{}, error) {
+	result := []interface{}{}
+	for !self.consume(end) {
+		value, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+
+		if !self.consume(",") && self.peek() != end[0] {
+			return nil, self.errorAt(self.pos, "expected ',' or '%v' but found %v",
+				end, self.describeNext())
+		}
+	}
+	return result, nil
+}
+
+func (self *dslParser) parseValue() (interface{}, error) {
+	c := self.peek()
+	start := self.pos
+
+	switch {
+	case c == '"':
+		return self.parseQuoted()
+
+	case c == '\'':
+		end := strings.IndexByte(self.text[start+1:], '\'')
+		if end < 0 {
+			return nil, self.errorAt(start, "unterminated string")
+		}
+		self.pos += end + 2
+		return self.text[start+1 : start+1+end], nil
+
+	case c == '[':
+		self.pos++
+		return self.parseValues("]")
+
+	case c == '{':
+		self.pos++
+		return self.parseMap()
+
+	case isDigit(c) || c == '-' || c == '+':
+		self.pos++
+		for self.pos < len(self.text) && (isIdentChar(self.text[self.pos]) ||
+			self.text[self.pos] == '.') {
+			self.pos++
+		}
+		return self.parseNumber(start, self.text[start:self.pos])
+
+	case isIdentChar(c):
+		// A lambda runs to the end of the value.
+		name, _ := self.ident()
+		if self.consume("=>") {
+			return self.parseLambda(start)
+		}
+
+		switch name {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+
+		// Bare words may be type names (e.g. "unsigned long").
+		self.pos = start
+		type_name, options, err := self.parseType()
+		if err != nil {
+			return nil, err
+		}
+		if options != nil {
+			return nil, self.errorAt(start, "options are not allowed here")
+		}
+		return type_name, nil
+	}
+
+	return nil, self.errorAt(start, "expected a value but found %v",
+		self.describeNext())
+}
+
+func (self *dslParser) parseQuoted() (interface{}, error) {
+	start := self.pos
+	for i := start + 1; i < len(self.text); i++ {
+		switch self.text[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(self.text[start : i+1])
+			if err != nil {
+				return nil, self.errorAt(start, "invalid string: %v", err)
+			}
+			self.pos = i + 1
+			return value, nil
+		}
+	}
+	return nil, self.errorAt(start, "unterminated string")
+}
+
+func (self *dslParser) parseNumber(start int, number string) (interface{}, error) {
+	value, err := strconv.ParseInt(number, 0, 64)
+	if err == nil {
+		if int64(int(value)) == value {
+			return int(value), nil
+		}
+		return value, nil
+	}
+
+	unsigned, err := strconv.ParseUint(number, 0, 64)
+	if err == nil {
+		return unsigned, nil
+	}
+
+	float, err := strconv.ParseFloat(number, 64)
+	if err == nil {
+		return float, nil
+	}
+
+	return nil, self.errorAt(start, "invalid number %v", number)
+}
+
+// {key=value, ...} where keys are names, numbers or quoted strings.
+func (self *dslParser) parseMap() (interface{}, error) {
+	result := ordereddict.NewDict()
+	for !self.consume("}") {
+		key_start := self.pos
+
+		var key string
+		switch c := self.peek(); {
+		case c == '"':
+			value, err := self.parseQuoted()
+			if err != nil {
+				return nil, err
+			}
+			key = value.(string)
+
+		case isIdentChar(c) || c == '-':
+			self.pos++
+			for self.pos < len(self.text) && isIdentChar(self.text[self.pos]) {
+				self.pos++
+			}
+			key = self.text[key_start:self.pos]
+
+		default:
+			return nil, self.errorAt(key_start, "expected a key but found %v",
+				self.describeNext())
+		}
+
+		err := self.expect("=")
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := self.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		result.Set(key, value)
+
+		if !self.consume(",") && self.peek() != '}' {
+			return nil, self.errorAt(self.pos, "expected ',' or '}' but found %v",
+				self.describeNext())
+		}
+	}
+	return result, nil
+}
+
+// A lambda extends to the first , or unmatched closing bracket
+// outside of strings, or to the first ; (which VQL does not use).
+// Returns the text from start.
+func (self *dslParser) parseLambda(start int) (string, error) {
+	depth := 0
+	for self.pos < len(self.text) {
+		c := self.text[self.pos]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			end := strings.IndexByte(self.text[self.pos+1:], c)
+			if end < 0 {
+				return "", self.errorAt(self.pos, "unterminated string")
+			}
+			self.pos += end + 2
+			continue
+
+		case strings.IndexByte("([{", c) >= 0:
+			depth++
+
+		case strings.IndexByte(")]}", c) >= 0:
+			if depth == 0 {
+				return strings.TrimSpace(self.text[start:self.pos]), nil
+			}
+			depth--
+
+		case c == ',' && depth == 0:
+			return strings.TrimSpace(self.text[start:self.pos]), nil
+		}
+
+		if c == ';' {
+			break
+		}
+		self.pos++
+	}
+
+	if depth > 0 {
+		return "", self.errorAt(start, "lambda is not closed")
+	}
+	return strings.TrimSpace(self.text[start:self.pos]), nil
+}
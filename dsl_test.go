@@ -0,0 +1,178 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDSL(t *testing.T) {
+	dsl := `
+// Comments are allowed anywhere.
+endian little;
+const MAGIC = "HDR1";
+typedef Handle: uint16;
+
+struct Header @size(x=>x.Len) @doc("The file header") {
+    0x00 Signature: String(length=4);
+    0x04 Count: uint32 @tags(counter);
+    0x08 Len: uint16;
+    (x=>x.Len - 1) Tail: uint8;
+    Entries: Array<Entry>(count=x=>x.Count, max_count=16);
+}
+
+/* Entries follow the header. */
+struct Entry @align {
+    Type: Enumeration<uint8>(map={File=1, "Sym link"=2});
+    Handle: Handle;
+    Data: String(length=2, term='');
+};
+`
+
+	definitions := `
+{
+  "endian": "little",
+  "constants": {"MAGIC": "HDR1"},
+  "typedefs": [["Handle", "uint16"]],
+  "structs": [
+    {"name": "Header", "size": "x=>x.Len", "doc": "The file header", "fields": [
+      ["Signature", 0, "String", {"length": 4}],
+      {"name": "Count", "offset": 4, "type": "uint32", "tags": ["counter"]},
+      ["Len", 8, "uint16"],
+      ["Tail", "x=>x.Len - 1", "uint8"],
+      ["Entries", "Array", {"type": "Entry", "count": "x=>x.Count", "max_count": 16}],
+    ]},
+    ["Entry", 0, [
+      ["Type", "Enumeration", {"type": "uint8", "map": {"File": 1, "Sym link": 2}}],
+      ["Handle", "Handle"],
+      ["Data", "String", {"length": 2, "term": ""}],
+    ], {"align": true}],
+  ]
+}`
+
+	dsl_profile := NewProfile()
+	AddModel(dsl_profile)
+	err := dsl_profile.ParseStructDefinitions(dsl)
+	assert.NoError(t, err)
+
+	json_profile := NewProfile()
+	AddModel(json_profile)
+	err = json_profile.ParseStructDefinitions(definitions)
+	assert.NoError(t, err)
+
+	expected, err := json_profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	exported, err := dsl_profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	assert.Equal(t, expected, exported)
+
+	data := []byte{
+		'H', 'D', 'R', '1', 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00,
+		0x02, 0x00, 0x05, 0x00, 'a', 'b',
+	}
+	obj, err := dsl_profile.Parse(MakeScope(), "Header", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Signature":"HDR1","Count":1,"Len":10,"Tail":0,"Entries":[{"Type":"Sym link","Handle":5,"Data":"ab"}]}`,
+		string(serialized))
+
+	// The definitions are available without a profile.
+	parsed, err := ParseProfileDSL(dsl)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(parsed.Structs))
+	count, _ := parsed.Structs[0].Fields[4].Options.GetString("count")
+	assert.Equal(t, "x=>x.Count", count)
+	assert.True(t, parsed.Structs[0].Fields[4].AutoOffset)
+
+	// Overlays may also be written in the DSL.
+	err = dsl_profile.ApplyOverlay(`struct Header { 0x08 Len: uint32; }`)
+	assert.NoError(t, err)
+
+	offset, err := dsl_profile.OffsetOf("Header", "Len")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), offset)
+}
+
+func TestDSLErrors(t *testing.T) {
+	for _, test_case := range []struct {
+		definitions, expected string
+	}{
+		// Syntax errors.
+		{`
+struct Header {
+    0x00 Magic: uint32
+    0x04 Count: uint32;
+}`, "line 3 column 23: expected ';' but found '0x04'"},
+
+		{`
+struct Header {
+    0x00 Magic: String(length=4;
+}`, "line 3 column 32: expected ',' or ')' but found ';'"},
+
+		{`
+struct Header {
+    Magic: String(length=4, length=5);
+}`, "line 3 column 29: option length given more than once"},
+
+		{`
+struct Header {
+    Magic: uint32;
+`, "line 4 column 1: struct Header is not closed"},
+
+		{`
+struct Header {}
+structs Trailer {}
+`, "line 3 column 1: expected struct, typedef, const or endian but found 'structs'"},
+
+		{`
+struct Header {
+    Magic: Array(count=x=>len(list=[1, 2);
+}`, "line 3 column 24: lambda is not closed"},
+
+		// Errors in the definitions.
+		{`
+struct Header @pack(3) {
+    Magic: uint32;
+}`, "line 2 column 15: struct Header: pack should be a power of two"},
+
+		{`
+struct Header {
+    Magic: uint32 @comment("x");
+}`, "line 3 column 19: struct Header field 0 'Magic': Unknown field attribute comment"},
+
+		{`
+struct Header {
+    0 Magic: uint32;
+    4 Next: Missing;
+}`, "line 4 column 5: struct Header field 1 'Next': Reference to undefined type Missing"},
+
+		{`
+typedef Handle: uint16;
+typedef Kind: Missing;
+`, "line 3 column 1: typedef Kind: NotFoundError: Parser Missing not found"},
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(test_case.definitions)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), test_case.expected)
+		}
+	}
+
+	// Documents in JSON or YAML are not mistaken for the DSL.
+	for _, definitions := range []string{
+		`endian: little`,
+		`structs: []`,
+		`# struct Header {}`,
+	} {
+		assert.False(t, isProfileDSL(definitions), definitions)
+	}
+	assert.True(t, isProfileDSL("// A profile\nstruct Header {}"))
+}
@@ -0,0 +1,515 @@
+// Build struct definitions from the DWARF debug information in ELF
+// binaries.
+
+package vtypes
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Load the named types (structs, unions, enums or typedefs to them)
+// from the DWARF debug information in the ELF file, together with all
+// the types they refer to. Typedefs are added as aliases to the
+// struct they name. The profile's "pointer" type is set to the
+// pointer size of the binary, unless the profile already has one
+// (e.g. from AddModelFor()).
+func (self *Profile) ParseDWARFDefinitions(
+	filename string, type_names ...string) error {
+	err := self.checkMutable()
+	if err != nil {
+		return err
+	}
+
+	converter, err := convertDWARF(filename, type_names)
+	if err != nil {
+		return err
+	}
+
+	pointer := intTypeName(converter.pointer_size, false)
+	if converter.big_endian && converter.pointer_size > 1 {
+		pointer += "be"
+	}
+	err = self.addStructDefinitionsWithPointer(
+		converter.definitions, self.types[pointer])
+	if err != nil {
+		return err
+	}
+
+	for alias, name := range converter.aliases {
+		_, pres := self.types[alias]
+		if !pres {
+			self.types[alias] = self.types[name]
+		}
+	}
+
+	return nil
+}
+
+// Build struct definitions for the named types from the DWARF debug
+// information in the ELF file. The result includes the definitions
+// of all the structs referred to by the named types.
+func DWARFStructDefinitions(
+	filename string, type_names ...string) ([]*StructDefinition, error) {
+	converter, err := convertDWARF(filename, type_names)
+	if err != nil {
+		return nil, err
+	}
+	return converter.definitions, nil
+}
+
+func convertDWARF(filename string, type_names []string) (*dwarfConverter, error) {
+	file, err := elf.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := file.DWARF()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+
+	converter := &dwarfConverter{
+		data:         data,
+		named:        make(map[string]dwarf.Offset),
+		converted:    make(map[string]bool),
+		aliases:      make(map[string]string),
+		pointer_size: 8,
+		big_endian:   file.ByteOrder == binary.BigEndian,
+	}
+
+	if file.Class == elf.ELFCLASS32 {
+		converter.pointer_size = 4
+	}
+
+	err = converter.index()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range type_names {
+		err = converter.convertNamedType(name)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", filename, err)
+		}
+	}
+
+	sort.Slice(converter.definitions, func(i, j int) bool {
+		return converter.definitions[i].Name < converter.definitions[j].Name
+	})
+
+	return converter, nil
+}
+
+type dwarfConverter struct {
+	data *dwarf.Data
+
+	// Offsets of complete type definitions by name.
+	named map[string]dwarf.Offset
+
+	definitions []*StructDefinition
+	converted   map[string]bool
+	aliases     map[string]string
+
+	pointer_size int64
+	big_endian   bool
+}
+
+// Find all the named types. The same type may be defined in many
+// compilation units - we use the first complete definition.
+func (self *dwarfConverter) index() error {
+	reader := self.data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return nil
+		}
+
+		switch entry.Tag {
+		case dwarf.TagStructType, dwarf.TagUnionType, dwarf.TagClassType,
+			dwarf.TagEnumerationType, dwarf.TagTypedef, dwarf.TagBaseType:
+		default:
+			continue
+		}
+
+		declaration, _ := entry.Val(dwarf.AttrDeclaration).(bool)
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if declaration || name == "" {
+			continue
+		}
+
+		_, pres := self.named[name]
+		if !pres {
+			self.named[name] = entry.Offset
+		}
+	}
+}
+
+func (self *dwarfConverter) convertNamedType(name string) error {
+	offset, pres := self.named[name]
+	if !pres {
+		return fmt.Errorf("type %v not found in debug info", name)
+	}
+
+	dwarf_type, err := self.data.Type(offset)
+	if err != nil {
+		return err
+	}
+
+	// Typedefs of anonymous structs name the struct, otherwise they
+	// are aliases.
+	typedef, ok := dwarf_type.(*dwarf.TypedefType)
+	if ok {
+		struct_type, ok := self.resolve(typedef.Type).(*dwarf.StructType)
+		if ok && struct_type.StructName == "" {
+			_, err := self.convertStruct(name, struct_type)
+			return err
+		}
+	}
+
+	switch t := self.resolve(dwarf_type).(type) {
+	case *dwarf.StructType:
+		struct_name, err := self.convertStruct(t.StructName, t)
+		if err != nil {
+			return err
+		}
+		if struct_name != name {
+			self.aliases[name] = struct_name
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("type %v is a %T, not a struct or union",
+			name, t)
+	}
+}
+
+// Strip typedefs and qualifiers.
+func (self *dwarfConverter) resolve(dwarf_type dwarf.Type) dwarf.Type {
+	for {
+		switch t := dwarf_type.(type) {
+		case *dwarf.TypedefType:
+			dwarf_type = t.Type
+		case *dwarf.QualType:
+			dwarf_type = t.Type
+		default:
+			return dwarf_type
+		}
+	}
+}
+
+// Anonymous structs are named after their typedef or otherwise the
+// field they appear in.
+func (self *dwarfConverter) structName(name string, dwarf_type dwarf.Type) string {
+	for {
+		switch t := dwarf_type.(type) {
+		case *dwarf.TypedefType:
+			struct_type, ok := self.resolve(t.Type).(*dwarf.StructType)
+			if ok && struct_type.StructName == "" {
+				return t.Name
+			}
+			dwarf_type = t.Type
+		case *dwarf.QualType:
+			dwarf_type = t.Type
+		case *dwarf.StructType:
+			if t.StructName != "" {
+				return t.StructName
+			}
+			return name
+		default:
+			return name
+		}
+	}
+}
+
+// Find the complete definition of a struct which was only declared.
+func (self *dwarfConverter) complete(
+	struct_type *dwarf.StructType) (*dwarf.StructType, error) {
+	if !struct_type.Incomplete {
+		return struct_type, nil
+	}
+
+	offset, pres := self.named[struct_type.StructName]
+	if !pres {
+		return nil, fmt.Errorf("struct %v is only declared", struct_type.StructName)
+	}
+
+	dwarf_type, err := self.data.Type(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := self.resolve(dwarf_type).(*dwarf.StructType)
+	if !ok || result.Incomplete {
+		return nil, fmt.Errorf("struct %v is only declared", struct_type.StructName)
+	}
+	return result, nil
+}
+
+// Add a struct definition for the struct type and return its name.
+func (self *dwarfConverter) convertStruct(
+	name string, struct_type *dwarf.StructType) (string, error) {
+	if self.converted[name] {
+		return name, nil
+	}
+	self.converted[name] = true
+
+	struct_type, err := self.complete(struct_type)
+	if err != nil {
+		return "", err
+	}
+
+	result := &StructDefinition{
+		Name: name,
+		Size: int(struct_type.ByteSize),
+	}
+	self.definitions = append(self.definitions, result)
+
+	return name, self.addFields(result, struct_type, 0)
+}
+
+// Add the struct's fields to the definition. Members of anonymous
+// structs and unions are added directly to the parent.
+func (self *dwarfConverter) addFields(result *StructDefinition,
+	struct_type *dwarf.StructType, base int64) error {
+	for _, field := range struct_type.Field {
+		offset := base + field.ByteOffset
+		field_type := self.resolve(field.Type)
+
+		if field.Name == "" {
+			anonymous, ok := field_type.(*dwarf.StructType)
+			if !ok {
+				continue
+			}
+			err := self.addFields(result, anonymous, offset)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if field.BitSize > 0 {
+			field_def, err := self.bitField(result.Name, base, field)
+			if err != nil {
+				return err
+			}
+			result.Fields = append(result.Fields, field_def)
+			continue
+		}
+
+		type_name, options, err := self.vtype(
+			result.Name+"_"+field.Name, field.Type)
+		if err != nil {
+			return fmt.Errorf("%v.%v: %w", result.Name, field.Name, err)
+		}
+
+		field_def := &FieldDefinition{
+			Name:   field.Name,
+			Offset: offset,
+			Type:   type_name,
+		}
+		if options.Len() > 0 {
+			field_def.Options = options
+		}
+		result.Fields = append(result.Fields, field_def)
+	}
+
+	return nil
+}
+
+func (self *dwarfConverter) bitField(struct_name string,
+	base int64, field *dwarf.StructField) (*FieldDefinition, error) {
+	field_type := self.resolve(field.Type)
+	unit := field_type.Size()
+
+	// DWARF 4 and later give the bit offset from the start of the
+	// struct, earlier versions give the offset from the most
+	// significant bit of the storage unit.
+	bit := field.DataBitOffset
+	if field.ByteSize > 0 {
+		bit = field.ByteOffset*8 + field.ByteSize*8 - field.BitOffset - field.BitSize
+		if self.big_endian {
+			bit = field.ByteOffset*8 + field.BitOffset
+		}
+	}
+
+	// Read the bits from a storage unit of the field's type aligned
+	// to its size, unless the field straddles units (e.g. in packed
+	// structs).
+	offset := (bit / (unit * 8)) * unit
+	start := bit - offset*8
+	if start+field.BitSize > unit*8 {
+		offset = bit / 8
+		start = bit % 8
+		unit = 8
+	}
+
+	if self.big_endian {
+		start = unit*8 - start - field.BitSize
+	}
+
+	storage := intTypeName(unit, false)
+	if self.big_endian && unit > 1 {
+		storage += "be"
+	}
+
+	options := ordereddict.NewDict().
+		Set("type", storage).
+		Set("start_bit", start).
+		Set("end_bit", start+field.BitSize)
+
+	result := &FieldDefinition{
+		Name:    field.Name,
+		Offset:  base + offset,
+		Type:    "BitField",
+		Options: options,
+	}
+
+	enum, ok := field_type.(*dwarf.EnumType)
+	if ok {
+		result.Type = "Enumeration"
+		result.Options = ordereddict.NewDict().
+			Set("type", "BitField").
+			Set("type_options", options).
+			Set("choices", self.enumChoices(enum))
+	}
+
+	if start < 0 {
+		return nil, fmt.Errorf("%v.%v: unsupported bit field layout",
+			struct_name, field.Name)
+	}
+
+	return result, nil
+}
+
+// Map the DWARF type to a vtypes type. Anonymous structs are named
+// after the field they appear in.
+func (self *dwarfConverter) vtype(name string,
+	dwarf_type dwarf.Type) (string, *ordereddict.Dict, error) {
+	options := ordereddict.NewDict()
+
+	switch t := self.resolve(dwarf_type).(type) {
+	case *dwarf.StructType:
+		struct_name, err := self.convertStruct(
+			self.structName(name, dwarf_type), t)
+		return struct_name, options, err
+
+	case *dwarf.EnumType:
+		storage, err := self.intType(t.ByteSize, true)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("type", storage).Set("choices", self.enumChoices(t))
+		return "Enumeration", options, nil
+
+	case *dwarf.PtrType:
+		elem := self.resolve(t.Type)
+		switch elem.(type) {
+		case *dwarf.VoidType, *dwarf.FuncType, nil:
+			// There is nothing to dereference so just return the
+			// address.
+			type_name, err := self.intType(self.pointer_size, false)
+			return type_name, options, err
+
+		case *dwarf.CharType, *dwarf.UcharType:
+			options.Set("type", "String")
+			return "Pointer", options, nil
+		}
+
+		type_name, type_options, err := self.vtype(name, t.Type)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("type", type_name)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Pointer", options, nil
+
+	case *dwarf.ArrayType:
+		count := t.Count
+		if count < 0 {
+			// Flexible array members
+			count = 0
+		}
+
+		// Character arrays are usually strings.
+		switch t.Type.(type) {
+		case *dwarf.CharType, *dwarf.UcharType:
+			options.Set("length", count)
+			return "String", options, nil
+		}
+
+		type_name, type_options, err := self.vtype(name, t.Type)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("count", count).Set("type", type_name)
+		if count > 1000 {
+			options.Set("max_count", count)
+		}
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Array", options, nil
+
+	case *dwarf.IntType, *dwarf.CharType:
+		type_name, err := self.intType(t.Size(), true)
+		return type_name, options, err
+
+	case *dwarf.UintType, *dwarf.UcharType, *dwarf.BoolType:
+		type_name, err := self.intType(t.Size(), false)
+		return type_name, options, err
+
+	case *dwarf.FloatType:
+		switch t.Size() {
+		case 2, 4, 8:
+		default:
+			return "", nil, fmt.Errorf("unsupported float size %v", t.Size())
+		}
+		type_name := fmt.Sprintf("float%d", t.Size()*8)
+		if self.big_endian {
+			type_name += "be"
+		}
+		return type_name, options, nil
+
+	default:
+		return "", nil, fmt.Errorf("unsupported type %v", dwarf_type)
+	}
+}
+
+func (self *dwarfConverter) intType(size int64, signed bool) (string, error) {
+	switch size {
+	case 1:
+		return intTypeName(size, signed), nil
+	case 2, 4, 8:
+		type_name := intTypeName(size, signed)
+		if self.big_endian {
+			type_name += "be"
+		}
+		return type_name, nil
+	default:
+		return "", fmt.Errorf("unsupported int size %v", size)
+	}
+}
+
+func (self *dwarfConverter) enumChoices(enum *dwarf.EnumType) *ordereddict.Dict {
+	choices := ordereddict.NewDict()
+	for _, value := range enum.Val {
+		key := fmt.Sprintf("%d", value.Val)
+		_, pres := choices.Get(key)
+		if !pres {
+			choices.Set(key, value.Name)
+		}
+	}
+	return choices
+}
@@ -0,0 +1,94 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDWARFDefinitions(t *testing.T) {
+	result := ""
+	for _, filename := range []string{
+		"test_data/dwarf_amd64.o", "test_data/dwarf_386.o"} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseDWARFDefinitions(filename, "Header", "Point")
+		assert.NoError(t, err)
+
+		exported, err := profile.ExportDefinitions("json")
+		assert.NoError(t, err)
+
+		result += filename + ":\n" + exported
+	}
+
+	goldie.Assert(t, "TestDWARFDefinitions", []byte(result))
+
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseDWARFDefinitions("test_data/dwarf_386.o", "Header")
+	assert.NoError(t, err)
+
+	// Header is an alias of the struct _Header
+	data := make([]byte, 0x100)
+	data[4] = 7                                      // Version
+	data[8] = 0x21                                   // Low, High
+	data[9] = 0x10                                   // Packed
+	binary.LittleEndian.PutUint32(data[0x18:], 0x18) // List.Next points to itself
+
+	scope := MakeScope()
+	obj, err := profile.Parse(scope, "Header", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(7), Associative(scope, obj, "Version"))
+	assert.Equal(t, int64(1), Associative(scope, obj, "Low"))
+	assert.Equal(t, int64(2), Associative(scope, obj, "High"))
+	assert.Equal(t, "BLUE", Associative(scope, obj, "Packed"))
+	assert.Equal(t, int64(0x18),
+		Associative(scope, obj, "List.Next.Next.OffsetOf"))
+
+	_, err = DWARFStructDefinitions("test_data/dwarf_amd64.o", "Missing")
+	assert.Error(t, err)
+
+	_, err = DWARFStructDefinitions("test_data/dwarf_amd64.o", "Color")
+	assert.Error(t, err)
+	if err != nil {
+		assert.Contains(t, err.Error(),
+			"type Color is a *dwarf.EnumType, not a struct or union")
+	}
+}
+
+func TestDWARFPointer(t *testing.T) {
+	// The pointer type of the data model is kept.
+	profile := NewProfile()
+	err := AddModelFor(profile, ModelLP64)
+	assert.NoError(t, err)
+
+	err = profile.ParseDWARFDefinitions("test_data/dwarf_386.o", "Header")
+	assert.NoError(t, err)
+	assert.True(t, profile.types["pointer"] == profile.types["uint64"])
+
+	profile = NewProfile()
+	AddModel(profile)
+
+	err = profile.ParseDWARFDefinitions("test_data/dwarf_386.o", "Header")
+	assert.NoError(t, err)
+	assert.True(t, profile.types["pointer"] == profile.types["uint32"])
+
+	// Nothing is installed when the types can not be added.
+	profile = NewProfile()
+	AddModel(profile)
+
+	err = profile.ParseStructDefinitions(`[["_Header", 8, []]]`)
+	assert.NoError(t, err)
+
+	err = profile.ParseDWARFDefinitions("test_data/dwarf_386.o", "Header")
+	assert.Error(t, err)
+
+	_, pres := profile.types["pointer"]
+	assert.False(t, pres)
+}
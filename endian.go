@@ -0,0 +1,112 @@
+// The byte order of the generic ints (e.g. uint32) may be set by the
+// profile or by each struct.
+
+package vtypes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+const (
+	LittleEndian = "little"
+	BigEndian    = "big"
+
+	// The scope variable holding the current byte order.
+	endianVariable = "__vtypes_endian"
+)
+
+// An endian attribute is either "little", "big" or a lambda
+// returning one of these.
+func checkEndian(endian string) error {
+	switch endian {
+	case "", LittleEndian, BigEndian:
+		return nil
+	}
+
+	if strings.Contains(endian, "=>") {
+		_, err := vfilter.ParseLambda(endian)
+		return err
+	}
+
+	return fmt.Errorf("endian should be %v, %v or a lambda, not %v",
+		LittleEndian, BigEndian, endian)
+}
+
+// Set the byte order used by the generic ints in structs which do
+// not set their own. The default is little endian.
+func (self *Profile) SetEndian(endian string) error {
+	err := self.checkMutable()
+	if err != nil {
+		return err
+	}
+
+	switch endian {
+	case "", LittleEndian, BigEndian:
+		self.endian = endian
+		if endian != "" {
+			self.has_endian = true
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Profile endian should be %v or %v, not %v",
+		LittleEndian, BigEndian, endian)
+}
+
+func (self *Profile) Endian() string {
+	if self.endian == "" {
+		return LittleEndian
+	}
+	return self.endian
+}
+
+// Set the struct's byte order. An empty string means the byte order
+// of the enclosing struct or the profile is used.
+func (self *StructParser) setEndian(endian string) (err error) {
+	err = checkEndian(endian)
+	if err != nil {
+		return err
+	}
+
+	self.endian = endian
+	self.endian_expression = nil
+	if endian != "" && self.profile != nil {
+		self.profile.has_endian = true
+	}
+	if strings.Contains(endian, "=>") {
+		self.endian_expression, err = vfilter.ParseLambda(endian)
+	}
+	return err
+}
+
+// Add the struct's byte order to the struct's scope. Lambdas are
+// evaluated on the new struct. Fields read by the lambda use the byte
+// order of the enclosing struct.
+func (self *StructParser) addEndian(scope vfilter.Scope, obj *StructObject) {
+	endian := self.endian
+	if self.endian_expression != nil {
+		value := self.endian_expression.Reduce(
+			context.Background(), scope, []vfilter.Any{obj})
+
+		endian, _ = value.(string)
+		if endian != LittleEndian && endian != BigEndian {
+			scope.Log("ERROR:binary_parser: %v: endian should be %v or %v, not %v",
+				self.type_name, LittleEndian, BigEndian, value)
+			return
+		}
+	}
+
+	if endian != "" {
+		scope.AppendVars(ordereddict.NewDict().Set(endianVariable, endian))
+	}
+}
+
+func isBigEndian(scope vfilter.Scope) bool {
+	endian, pres := scope.Resolve(endianVariable)
+	return pres && endian == BigEndian
+}
@@ -0,0 +1,221 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Velocidex/ordereddict"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// The byte order of a TIFF file is given by its first two bytes.
+var tiffDefinitions = `
+[
+  ["TIFF", 8, [
+    ["Order", 0, "String", {"length": 2}],
+    ["Magic", 2, "uint16"],
+    ["Offset", 4, "uint32"],
+    ["IFD", "x=>x.Offset", "IFD"],
+  ], {"endian": "x=>if(condition=x.Order = 'MM', then='big', else='little')"}],
+  ["IFD", 4, [
+    ["Count", 0, "uint16"],
+    ["Tags", 2, "Array", {"type": "uint8", "count": "x=>x.Count"}],
+    ["Trailer", 2, "uint16le"],
+  ]],
+]
+`
+
+func TestEndian(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(tiffDefinitions)
+	assert.NoError(t, err)
+
+	for _, test_case := range []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte("II\x2a\x00\x08\x00\x00\x00\x02\x00\x01\x02"),
+			`{"Order":"II","Magic":42,"Offset":8,"IFD":{"Count":2,"Tags":[1,2],"Trailer":513}}`},
+		{[]byte("MM\x00\x2a\x00\x00\x00\x08\x00\x02\x01\x02"),
+			`{"Order":"MM","Magic":42,"Offset":8,"IFD":{"Count":2,"Tags":[1,2],"Trailer":513}}`},
+	} {
+		obj, err := profile.Parse(MakeScope(), "TIFF",
+			bytes.NewReader(test_case.data), 0)
+		assert.NoError(t, err)
+
+		serialized, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.expected, string(serialized))
+	}
+
+	// Lambdas can not be compiled into Go code.
+	code, err := profile.GenerateGo("generated")
+	assert.NoError(t, err)
+	assert.Contains(t, code, `self.vtypesRuntime.field("TIFF", reader, offset, "Magic")`)
+}
+
+func TestProfileEndian(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`
+endian: big
+structs:
+  - [Header, 8, [
+      [Big, 0, uint16],
+      [Little, 2, uint16le],
+      [Explicit, 4, uint16b],
+      [Int, 6, short int],
+    ]]
+  - [LittleHeader, 0, [
+      [Value, 0, uint16],
+    ], {extends: Header, endian: little}]
+  - [Derived, 0, [], {extends: LittleHeader}]
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, BigEndian, profile.Endian())
+
+	data := []byte{0x01, 0x02, 0x01, 0x02, 0x01, 0x02, 0xff, 0xfe}
+	for _, test_case := range []struct {
+		type_name, expected string
+	}{
+		{"Header", `{"Big":258,"Little":513,"Explicit":258,"Int":-2}`},
+		{"LittleHeader", `{"Big":513,"Little":513,"Explicit":258,"Int":-257,"Value":513}`},
+		{"Derived", `{"Big":513,"Little":513,"Explicit":258,"Int":-257,"Value":513}`},
+	} {
+		obj, err := profile.Parse(MakeScope(), test_case.type_name,
+			bytes.NewReader(data), 0)
+		assert.NoError(t, err)
+
+		serialized, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.expected, string(serialized))
+	}
+
+	// The endian attributes are exported.
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(exported, "{\n  \"endian\": \"big\",\n"))
+	assert.Contains(t, exported, `["Derived", 8, [`)
+	assert.Contains(t, exported, `], {"endian": "little"}]`)
+
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		round_trip := NewProfile()
+		AddModel(round_trip)
+		err = round_trip.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		re_exported, err := round_trip.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, re_exported, format)
+	}
+
+	// The profile's byte order is compiled into Go code.
+	profile = NewProfile()
+	AddModel(profile)
+
+	err = profile.ParseStructDefinitions(`
+endian: big
+structs:
+  - [Header, 4, [[Big, 0, uint16], [Little, 2, uint16le]]]
+`)
+	assert.NoError(t, err)
+
+	code, err := profile.GenerateGo("generated")
+	assert.NoError(t, err)
+	assert.NotContains(t, code, "vtypesRuntime")
+	assert.Contains(t, code, "binary.BigEndian.Uint16")
+	assert.Contains(t, code, "binary.LittleEndian.Uint16")
+}
+
+// Structs of an imported profile use the byte order of the profile
+// which defines them unless they set their own.
+func TestImportedEndian(t *testing.T) {
+	b := NewNamedProfile("b")
+	AddModel(b)
+	err := b.ParseStructDefinitions(`
+structs:
+  - [Rec, 4, [
+      [Value, 0, uint32],
+    ]]
+  - [BigRec, 4, [
+      [Value, 0, uint32],
+    ], {endian: big}]
+`)
+	assert.NoError(t, err)
+
+	a := NewProfile()
+	AddModel(a)
+	err = a.Import("b", b)
+	assert.NoError(t, err)
+
+	err = a.ParseStructDefinitions(`
+endian: big
+structs:
+  - [Outer, 0, [
+      [R, 0, b::Rec],
+      [Big, 0, b::BigRec],
+      [Own, 0, uint32],
+    ]]
+`)
+	assert.NoError(t, err)
+
+	obj, err := a.Parse(MakeScope(), "Outer",
+		bytes.NewReader([]byte{0x01, 0x00, 0x00, 0x00}), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"R":{"Value":1},"Big":{"Value":16777216},"Own":16777216}`,
+		string(serialized))
+}
+
+// Generic ints only look up the byte order once the profile or one
+// of its structs sets it.
+func TestEndianUnused(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`[["Header", 4, [["Value", 0, "uint32"]]]]`)
+	assert.NoError(t, err)
+	assert.False(t, profile.has_endian)
+
+	scope := MakeScope()
+	scope.AppendVars(ordereddict.NewDict().Set(endianVariable, BigEndian))
+
+	reader := bytes.NewReader([]byte{0x01, 0x00, 0x00, 0x00})
+	obj, err := profile.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), Associative(scope, obj, "Value"))
+
+	err = profile.ParseStructDefinitions(
+		`[["BigHeader", 4, [["Value", 0, "uint32"]], {"endian": "big"}]]`)
+	assert.NoError(t, err)
+	assert.True(t, profile.has_endian)
+
+	obj, err = profile.Parse(MakeScope(), "BigHeader", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x01000000), Associative(scope, obj, "Value"))
+}
+
+func TestEndianErrors(t *testing.T) {
+	for _, definitions := range []string{
+		`{"endian": "middle"}`,
+		`{"endian": "x=>'big'"}`,
+		`[["Header", 0, [], {"endian": "middle"}]]`,
+		`[["Header", 0, [], {"endian": "x=>"}]]`,
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(definitions)
+		assert.Error(t, err, definitions)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -25,6 +26,10 @@ type EnumerationParser struct {
 	parser  Parser
 
 	invalid_parser bool
+
+	// Protects parser and invalid_parser which may be filled in by
+	// concurrent calls to Parse()
+	mu sync.Mutex
 }
 
 func (self *EnumerationParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -84,27 +89,65 @@ func (self *EnumerationParser) New(profile *Profile, options *ordereddict.Dict)
 	return result, nil
 }
 
-func (self *EnumerationParser) Parse(
-	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+// The underlying type may be defined after the enumeration so the
+// parser is resolved on first use. Returns nil if the type is not
+// known.
+func (self *EnumerationParser) getParser(scope vfilter.Scope) Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
 	if self.invalid_parser {
-		return vfilter.Null{}
+		return nil
+	}
+
+	err := self.resolve()
+	if err != nil {
+		scope.Log("ERROR:binary_parser: EnumerationParser: %v", err)
+		self.invalid_parser = true
+		return nil
 	}
 
+	return self.parser
+}
+
+// Must be called with the lock held.
+func (self *EnumerationParser) resolve() error {
 	if self.parser == nil {
 		parser, err := self.profile.GetParser(
 			self.options.Type, self.options.TypeOptions)
 		if err != nil {
-			scope.Log("ERROR:binary_parser: EnumerationParser: %v", err)
-			self.invalid_parser = true
-			return vfilter.Null{}
+			return err
 		}
 
 		// Cache the parser for next time.
 		self.parser = parser
 	}
+	return nil
+}
 
-	value, ok := to_int64(self.parser.Parse(scope, reader, offset))
+func (self *EnumerationParser) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	// The type may have been missing at parse time.
+	self.invalid_parser = false
+	return []Parser{self.parser}, nil
+}
+
+func (self *EnumerationParser) Parse(
+	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+
+	parser := self.getParser(scope)
+	if parser == nil {
+		return vfilter.Null{}
+	}
+
+	value, ok := to_int64(parser.Parse(scope, reader, offset))
 	if !ok {
 		return vfilter.Null{}
 	}
@@ -115,3 +158,11 @@ func (self *EnumerationParser) Parse(
 	}
 	return string_value
 }
+
+func (self *EnumerationParser) typeReferences() []typeReference {
+	return []typeReference{{
+		option:    "type",
+		type_name: self.options.Type,
+		options:   self.options.TypeOptions,
+	}}
+}
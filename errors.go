@@ -1,7 +1,105 @@
 package vtypes
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	NotFoundError = errors.New("NotFoundError")
 )
+
+// An error in a struct or typedef definition. Errors returned by
+// ParseStructDefinitions() and ApplyOverlay() include the position of
+// the definition in the document.
+type DefinitionError struct {
+	// Either "struct" or "typedef".
+	Kind string
+
+	// The name of the definition if it is known, and its index
+	// within its section of the document (-1 if not known).
+	Name  string
+	Index int
+
+	// The index and name of the field within the struct. Field is
+	// -1 for errors in the struct itself.
+	Field     int
+	FieldName string
+
+	// The position in the document starting at 1. 0 if not known.
+	Line   int
+	Column int
+
+	Err error
+}
+
+func (self *DefinitionError) Error() string {
+	result := &strings.Builder{}
+	if self.Line > 0 {
+		fmt.Fprintf(result, "line %d column %d: ", self.Line, self.Column)
+	}
+
+	name := self.Name
+	if name == "" {
+		name = fmt.Sprintf("#%d", self.Index)
+	}
+	fmt.Fprintf(result, "%v %v", self.Kind, name)
+
+	if self.Field >= 0 {
+		fmt.Fprintf(result, " field %d", self.Field)
+		if self.FieldName != "" {
+			fmt.Fprintf(result, " '%v'", self.FieldName)
+		}
+	}
+
+	fmt.Fprintf(result, ": %v", self.Err)
+	return result.String()
+}
+
+func (self *DefinitionError) Unwrap() error {
+	return self.Err
+}
+
+// An error in the struct definition or in one of its fields (field is
+// -1 for the struct itself).
+func (self *StructDefinition) error(field int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	result := &DefinitionError{
+		Kind:  "struct",
+		Name:  self.Name,
+		Index: -1,
+		Field: field,
+		Err:   err,
+	}
+	if field >= 0 && field < len(self.Fields) {
+		result.FieldName = self.Fields[field].Name
+	}
+	return result
+}
+
+func (self *TypedefDefinition) error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &DefinitionError{
+		Kind:  "typedef",
+		Name:  self.Name,
+		Index: -1,
+		Field: -1,
+		Err:   err,
+	}
+}
+
+// Record the index of the definition within its section.
+func setDefinitionIndex(err error, index int) error {
+	var definition_error *DefinitionError
+	if errors.As(err, &definition_error) && definition_error.Index < 0 {
+		definition_error.Index = index
+	}
+	return err
+}
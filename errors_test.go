@@ -0,0 +1,141 @@
+package vtypes
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDefinitionErrors(t *testing.T) {
+	for _, test_case := range []struct {
+		definitions, expected string
+	}{
+		// Errors while decoding the document.
+		{`
+structs:
+  - [Header, 8, [
+      [Magic, 0, uint32],
+      [Flags, 4, uint16, [1, 2]],
+    ]]
+`, "line 5 column 7: struct Header field 1 'Flags': options should be a map"},
+
+		{`
+[
+  ["Header", 8, [
+    ["Magic", 0, "uint32"]
+  ]],
+  ["Trailer", 0, [], {"extends": 1}]
+]`, "line 6 column 3: struct Trailer: extends should be a struct name"},
+
+		{`
+[
+  ["Header", 8, []],
+  [1, 2, 3]
+]`, "line 4 column 3: struct #1: Name should be a string"},
+
+		{`
+typedefs:
+  - [Handle, uint32]
+  - [Flags]
+structs: []
+`, "line 4 column 5: typedef #1: Typedef Definition should be [name, type, options?]"},
+
+		// Errors while adding the definitions.
+		{`
+[
+  ["Header", 8, [
+    ["Magic", 0, "uint32"],
+    ["Next", 4, "Missing"],
+  ]],
+]`, "line 5 column 5: struct Header field 1 'Next': Reference to undefined type Missing"},
+
+		{`
+[
+  ["Header", 8, [
+    ["Magic", 0, "uint32"],
+  ]],
+  ["Record", 8, [
+    ["Data", "x=>", "uint32"],
+  ]],
+]`, "line 7 column 5: struct Record field 0 'Data': offset 'x=>':"},
+
+		{`
+{
+  "typedefs": [["Handle", "Missing"]],
+  "structs": []
+}`, "line 3 column 16: typedef Handle: NotFoundError: Parser Missing not found"},
+
+		{`
+[
+  ["Derived", 0, [], {"extends": "Missing"}]
+]`, "line 3 column 3: struct Derived: extends undefined struct Missing"},
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(test_case.definitions)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), test_case.expected)
+		}
+	}
+
+	// Callers can find the position of the error.
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`[
+  ["Header", 8, [
+    ["Magic", 0, "uint32"],
+    ["Flags", 4, "Enumeration", {"type": "uint16", "map": 1}],
+  ]],
+]`)
+
+	var definition_error *DefinitionError
+	assert.True(t, errors.As(err, &definition_error))
+	assert.Equal(t, "Header", definition_error.Name)
+	assert.Equal(t, 1, definition_error.Field)
+	assert.Equal(t, "Flags", definition_error.FieldName)
+	assert.Equal(t, 4, definition_error.Line)
+	assert.Equal(t, 5, definition_error.Column)
+
+	// Errors in overlays are located in the overlay.
+	err = profile.ApplyOverlay(`[["Header", 0, [["Next", 4, "Missing"]]]]`)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(),
+		"line 1 column 17: struct Header field 0 'Next': Reference to undefined type Missing")
+
+	// Documents decoded as JSON include the struct and field.
+	definitions := &ProfileDefinitions{}
+	err = json.Unmarshal([]byte(`{"structs": [
+  ["Header", 8, [["Magic", 0, "uint32"]]],
+  ["Trailer", 8, [["Magic", 0, "uint32"], ["Flags", 4, 16]]]
+]}`), definitions)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "struct Trailer field 1 'Flags': type should be a string")
+
+	assert.True(t, errors.As(err, &definition_error))
+	assert.Equal(t, 1, definition_error.Index)
+}
+
+// The document is only searched for errors without a position.
+func TestLocateError(t *testing.T) {
+	document := []byte(`[["Header", 8, []]]`)
+
+	located := &DefinitionError{
+		Kind: "typedef", Name: "Handle", Index: -1, Field: -1,
+		Line: 7, Column: 2, Err: errors.New("bad typedef"),
+	}
+	err := &DefinitionError{
+		Kind: "struct", Name: "Header", Index: 0, Field: -1, Err: located,
+	}
+	assert.Equal(t, err, locateError(document, err))
+	assert.Equal(t, 0, err.Line)
+
+	err.Err = errors.New("bad struct")
+	assert.Equal(t, err, locateError(document, err))
+	assert.Equal(t, 1, err.Line)
+	assert.Equal(t, 2, err.Column)
+}
@@ -0,0 +1,304 @@
+// Export the profile back into the vtypes definition language.
+
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/Velocidex/yaml/v2"
+)
+
+// Write the struct definitions in the profile in the requested
+// format ("json" or "yaml"). The output is canonical: structs are
+// sorted by name and options are sorted by key. Inherited fields and
+// overlays are flattened into each struct so the output can be
+// parsed again with ParseStructDefinitions(). Constants and typedefs
+// are sorted by name and written in their own sections.
+func (self *Profile) ExportDefinitions(format string) (string, error) {
+	structs, err := self.exportStructDefinitions()
+	if err != nil {
+		return "", err
+	}
+
+	definitions := &ProfileDefinitions{
+		Endian:    self.endian,
+		Constants: sortedOptions(self.constants),
+		Typedefs:  self.exportTypedefDefinitions(),
+		Structs:   structs,
+	}
+
+	switch format {
+	case "json":
+		return marshalProfileJSON(definitions)
+
+	case "yaml":
+		serialized, err := yaml.Marshal(definitions)
+		if err != nil {
+			return "", err
+		}
+		return string(serialized), nil
+
+	default:
+		return "", fmt.Errorf("ExportDefinitions: format can only be json or yaml, not %v",
+			format)
+	}
+}
+
+func (self *Profile) exportStructDefinitions() ([]*StructDefinition, error) {
+	var names []string
+	for name, parser := range self.types {
+		struct_parser, ok := parser.(*StructParser)
+		// Skip aliases to structs.
+		if ok && struct_parser.type_name == name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]*StructDefinition, 0, len(names))
+	for _, name := range names {
+		struct_def, err := self.types[name].(*StructParser).definition()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, struct_def)
+	}
+
+	return result, nil
+}
+
+// Rebuild the definition from the struct parser.
+func (self *StructParser) definition() (*StructDefinition, error) {
+	result := &StructDefinition{
+		Name:           self.type_name,
+		Size:           self.size,
+		SizeExpression: self.size_expression_source,
+		Endian:         self.endian,
+		Align:          self.align,
+		Pack:           self.pack,
+		Doc:            self.doc,
+		Tags:           self.tags,
+	}
+
+	// Computed sizes are computed again when the definition is
+	// parsed.
+	if self.size_computed {
+		result.Size = 0
+	}
+
+	for _, field_name := range self.field_names {
+		field_def := self.fields[field_name].definition
+		if field_def == nil {
+			return nil, fmt.Errorf(
+				"Struct %v field %v was not built from a definition",
+				self.type_name, field_name)
+		}
+
+		result.Fields = append(result.Fields, &FieldDefinition{
+			Name:             field_name,
+			Offset:           field_def.Offset,
+			OffsetExpression: field_def.OffsetExpression,
+			AutoOffset:       field_def.AutoOffset,
+			Type:             field_def.Type,
+			Options:          sortedOptions(field_def.Options),
+			Doc:              field_def.Doc,
+			Tags:             field_def.Tags,
+		})
+	}
+
+	return result, nil
+}
+
+// Documents with only structs are a plain list of structs.
+func marshalProfileJSON(definitions *ProfileDefinitions) (string, error) {
+	if !definitions.hasSections() {
+		return marshalDefinitionsJSON(definitions.Structs, "")
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("{")
+
+	if definitions.Endian != "" {
+		serialized, err := json.Marshal(definitions.Endian)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, "\n  \"endian\": %s,", serialized)
+	}
+
+	if definitions.Constants != nil {
+		serialized, err := json.Marshal(definitions.Constants)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, "\n  \"constants\": %s,", formatCompactJSON(serialized))
+	}
+
+	if len(definitions.Typedefs) > 0 {
+		buf.WriteString("\n  \"typedefs\": [")
+		for idx, typedef := range definitions.Typedefs {
+			serialized, err := json.Marshal(typedef)
+			if err != nil {
+				return "", err
+			}
+			if idx > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "\n    %s", formatCompactJSON(serialized))
+		}
+		buf.WriteString("\n  ],")
+	}
+
+	structs, err := marshalDefinitionsJSON(definitions.Structs, "  ")
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(buf, "\n  \"structs\": %s\n}\n",
+		strings.TrimSuffix(structs, "\n"))
+
+	return buf.String(), nil
+}
+
+// Lay out each field on its own line to keep the output readable.
+// Lines after the first are indented by indent.
+func marshalDefinitionsJSON(
+	definitions []*StructDefinition, indent string) (string, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteString("[")
+
+	for idx, struct_def := range definitions {
+		if idx > 0 {
+			buf.WriteString(",")
+		}
+
+		var header []byte
+		var err error
+		if struct_def.isKeyed() {
+			header, err = json.Marshal(struct_def.keyedHeader())
+		} else {
+			header, err = json.Marshal([]interface{}{
+				struct_def.Name, struct_def.sizeValue()})
+		}
+		if err != nil {
+			return "", err
+		}
+
+		// Drop the closing ] or } so we can append the fields.
+		header = formatCompactJSON(header)
+		fields_key := ""
+		if struct_def.isKeyed() {
+			fields_key = `"fields": `
+		}
+		fmt.Fprintf(buf, "\n%s  %s, %s[", indent, header[:len(header)-1],
+			fields_key)
+		for field_idx, field_def := range struct_def.Fields {
+			serialized, err := json.Marshal(field_def)
+			if err != nil {
+				return "", err
+			}
+			if field_idx > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "\n%s    %s", indent, formatCompactJSON(serialized))
+		}
+		fmt.Fprintf(buf, "\n%s  ]", indent)
+
+		// The options of keyed structs are in the header.
+		if struct_def.isKeyed() {
+			buf.WriteString("}")
+			continue
+		}
+
+		options := struct_def.options()
+		if options.Len() > 0 {
+			serialized, err := json.Marshal(options)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(buf, ", %s", formatCompactJSON(serialized))
+		}
+		buf.WriteString("]")
+	}
+	fmt.Fprintf(buf, "\n%s]\n", indent)
+
+	return buf.String(), nil
+}
+
+func sortedOptions(options *ordereddict.Dict) *ordereddict.Dict {
+	if options == nil || options.Len() == 0 {
+		return nil
+	}
+
+	keys := options.Keys()
+	sort.Strings(keys)
+
+	result := ordereddict.NewDict()
+	for _, k := range keys {
+		v, _ := options.Get(k)
+		v_dict, ok := v.(*ordereddict.Dict)
+		if ok && v_dict.Len() > 0 {
+			v = sortedOptions(v_dict)
+		}
+		result.Set(k, v)
+	}
+	return result
+}
+
+// Make compact JSON easier to read: add a space after separators and
+// undo the HTML escaping of <, > and & which is common in lambdas.
+func formatCompactJSON(in []byte) []byte {
+	result := make([]byte, 0, len(in))
+	in_string := false
+
+	for i := 0; i < len(in); i++ {
+		c := in[i]
+		if !in_string {
+			result = append(result, c)
+			switch c {
+			case '"':
+				in_string = true
+			case ',', ':':
+				result = append(result, ' ')
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			in_string = false
+
+		case '\\':
+			if i+5 < len(in) && in[i+1] == 'u' {
+				switch string(in[i+2 : i+6]) {
+				case "003c":
+					result = append(result, '<')
+					i += 5
+					continue
+				case "003e":
+					result = append(result, '>')
+					i += 5
+					continue
+				case "0026":
+					result = append(result, '&')
+					i += 5
+					continue
+				}
+			}
+
+			// Copy the escaped character verbatim.
+			if i+1 < len(in) {
+				result = append(result, c, in[i+1])
+				i++
+				continue
+			}
+		}
+		result = append(result, c)
+	}
+
+	return result
+}
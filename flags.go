@@ -81,3 +81,7 @@ func (self *Flags) Parse(
 	sort.Strings(result)
 	return result
 }
+
+func (self *Flags) compile() ([]Parser, error) {
+	return []Parser{self.parser}, nil
+}
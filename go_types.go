@@ -0,0 +1,405 @@
+// Build profiles from annotated Go structs.
+
+package vtypes
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+// Go struct fields may be tagged with this name to control their
+// layout in the profile.
+const vtypesTagName = "vtypes"
+
+// Build a profile from Go structs. Each struct becomes a struct
+// definition named after the Go type, and structs used by its fields
+// are added too. Fields are controlled by the vtypes tag, for example:
+//
+//	type Header struct {
+//	    _         struct{} `vtypes:"size=0x20"`
+//	    Signature [4]byte  `vtypes:"type=String"`
+//	    Length    uint32   `vtypes:"offset=0x10,type=uint32be"`
+//	    Entries   []Entry  `vtypes:"count=x=>x.Length"`
+//	}
+//
+// The following directives are supported:
+//   - offset: The offset of the field. By default fields follow the
+//     previous field without padding.
+//   - type: The type of the field. By default this is derived from
+//     the Go type.
+//   - name: The name of the field in the profile.
+//   - size: On the blank (_) field, sets the size of the struct. By
+//     default this is the end of the last field.
+//
+// All other directives are passed as options to the field's parser
+// (e.g. count for arrays). Lambdas may not contain commas. Fields
+// tagged with "-" and unexported fields are skipped.
+func ProfileFromGoTypes(types ...interface{}) (*Profile, error) {
+	builder := &goTypeBuilder{seen: make(map[reflect.Type]*goStruct)}
+	for _, item := range types {
+		t := reflect.TypeOf(item)
+		for t != nil && t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+
+		if t == nil || t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("ProfileFromGoTypes: %T is not a struct", item)
+		}
+
+		_, err := builder.addStruct(t)
+		if err != nil {
+			return nil, fmt.Errorf("ProfileFromGoTypes: %w", err)
+		}
+	}
+
+	profile := NewProfile()
+	err := AddModel(profile)
+	if err != nil {
+		return nil, fmt.Errorf("ProfileFromGoTypes: %w", err)
+	}
+
+	err = profile.addStructDefinitions(builder.definitions, false)
+	if err != nil {
+		return nil, fmt.Errorf("ProfileFromGoTypes: %w", err)
+	}
+	return profile, nil
+}
+
+type goStruct struct {
+	definition *StructDefinition
+
+	// The size is not known for structs with variable sized fields.
+	size_known bool
+}
+
+type goTypeBuilder struct {
+	seen        map[reflect.Type]*goStruct
+	definitions []*StructDefinition
+}
+
+func (self *goTypeBuilder) addStruct(t reflect.Type) (*goStruct, error) {
+	result, pres := self.seen[t]
+	if pres {
+		return result, nil
+	}
+
+	if t.Name() == "" {
+		return nil, fmt.Errorf("anonymous structs are not supported")
+	}
+
+	definition := &StructDefinition{Name: t.Name()}
+	result = &goStruct{definition: definition, size_known: true}
+	self.seen[t] = result
+	self.definitions = append(self.definitions, definition)
+
+	// The offset of the next field if it does not have an explicit
+	// offset.
+	next_offset := int64(0)
+	next_known := true
+	end := int64(0)
+	size := int64(-1)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get(vtypesTagName)
+		if tag == "-" {
+			continue
+		}
+		directives := parseVtypesTag(tag)
+
+		if field.Name == "_" {
+			value, pres := directives["size"]
+			if pres {
+				size, pres = parseTagInt(value)
+				if !pres {
+					return nil, fmt.Errorf("%v: invalid size %v", t.Name(), value)
+				}
+			}
+			continue
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+
+		field_def, field_size, err := self.fieldDefinition(field, directives)
+		if err != nil {
+			return nil, fmt.Errorf("%v.%v: %w", t.Name(), field.Name, err)
+		}
+
+		offset_str, pres := directives["offset"]
+		if pres {
+			offset, ok := parseTagInt(offset_str)
+			if ok {
+				field_def.Offset = offset
+			} else {
+				field_def.OffsetExpression = offset_str
+			}
+
+		} else if next_known {
+			field_def.Offset = next_offset
+
+		} else {
+			return nil, fmt.Errorf(
+				"%v.%v: field follows a variable sized field and needs an offset",
+				t.Name(), field.Name)
+		}
+
+		next_known = field_size >= 0 && field_def.OffsetExpression == ""
+		next_offset = field_def.Offset + field_size
+		if next_known && next_offset > end {
+			end = next_offset
+		}
+		if !next_known {
+			result.size_known = false
+		}
+
+		definition.Fields = append(definition.Fields, field_def)
+	}
+
+	if size >= 0 {
+		definition.Size = int(size)
+		result.size_known = true
+	} else {
+		definition.Size = int(end)
+	}
+
+	return result, nil
+}
+
+// Build the field definition and return the size of the field, or
+// -1 if it is not known.
+func (self *goTypeBuilder) fieldDefinition(field reflect.StructField,
+	directives map[string]string) (*FieldDefinition, int64, error) {
+
+	result := &FieldDefinition{Name: field.Name}
+	name, pres := directives["name"]
+	if pres {
+		result.Name = name
+	}
+
+	var keys []string
+	for k := range directives {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	options := ordereddict.NewDict()
+	for _, k := range keys {
+		switch k {
+		case "offset", "type", "name":
+			continue
+		}
+		options.Set(k, parseTagValue(directives[k]))
+	}
+
+	type_name, type_options, size, err := self.goType(field.Type)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	explicit_type, pres := directives["type"]
+	if pres && explicit_type != type_name {
+		size, err = self.explicitTypeSize(explicit_type, field.Type, options)
+		if err != nil {
+			return nil, 0, err
+		}
+		type_name = explicit_type
+		type_options = ordereddict.NewDict()
+	}
+
+	// Explicit options override the options derived from the Go
+	// type.
+	for _, k := range options.Keys() {
+		v, _ := options.Get(k)
+		type_options.Set(k, v)
+	}
+
+	// Arrays may be given an explicit count.
+	count, pres := options.Get("count")
+	if type_name == "Array" && pres {
+		size = -1
+		count_int, ok := count.(int64)
+		if ok && (field.Type.Kind() == reflect.Array ||
+			field.Type.Kind() == reflect.Slice) {
+			_, _, elem_size, err := self.goType(field.Type.Elem())
+			if err == nil && elem_size >= 0 {
+				size = count_int * elem_size
+			}
+		}
+	}
+
+	length, pres := options.Get("length")
+	if type_name == "String" && pres {
+		length_int, ok := length.(int64)
+		if ok {
+			size = length_int
+		} else {
+			size = -1
+		}
+	}
+
+	result.Type = type_name
+	if type_options.Len() > 0 {
+		result.Options = type_options
+	}
+
+	return result, size, nil
+}
+
+// The size of a field of Go type t which is parsed with an explicitly
+// given type.
+func (self *goTypeBuilder) explicitTypeSize(type_name string,
+	t reflect.Type, options *ordereddict.Dict) (int64, error) {
+	switch type_name {
+	case "String":
+		if t.Kind() == reflect.Array {
+			_, pres := options.Get("length")
+			if !pres {
+				options.Set("length", int64(t.Len()))
+			}
+		}
+
+		length, pres := options.Get("length")
+		if pres {
+			length_int, ok := length.(int64)
+			if ok {
+				return length_int, nil
+			}
+		}
+		return -1, nil
+	}
+
+	// Ints of the same size, e.g. uint32be for uint32.
+	switch t.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		return int64(t.Size()), nil
+	}
+
+	return -1, nil
+}
+
+// Map the Go type to a type name and options. Returns the size of the
+// type or -1 if it is not known.
+func (self *goTypeBuilder) goType(t reflect.Type) (
+	string, *ordereddict.Dict, int64, error) {
+	options := ordereddict.NewDict()
+
+	switch t.Kind() {
+	case reflect.Bool, reflect.Uint8:
+		return "uint8", options, 1, nil
+	case reflect.Uint16:
+		return "uint16", options, 2, nil
+	case reflect.Uint32:
+		return "uint32", options, 4, nil
+	case reflect.Uint64:
+		return "uint64", options, 8, nil
+	case reflect.Int8:
+		return "int8", options, 1, nil
+	case reflect.Int16:
+		return "int16", options, 2, nil
+	case reflect.Int32:
+		return "int32", options, 4, nil
+	case reflect.Int64:
+		return "int64", options, 8, nil
+	case reflect.Float64:
+		return "float64", options, 8, nil
+	case reflect.Float32:
+		return "float32", options, 4, nil
+
+	case reflect.String:
+		options.Set("term", "")
+		return "String", options, -1, nil
+
+	case reflect.Array, reflect.Slice:
+		type_name, type_options, size, err := self.goType(t.Elem())
+		if err != nil {
+			return "", nil, 0, err
+		}
+		options.Set("type", type_name)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+
+		if t.Kind() == reflect.Slice {
+			return "Array", options, -1, nil
+		}
+
+		options.Set("count", int64(t.Len()))
+		if t.Len() > 1000 {
+			options.Set("max_count", int64(t.Len()))
+		}
+		if size < 0 {
+			return "Array", options, -1, nil
+		}
+		return "Array", options, size * int64(t.Len()), nil
+
+	case reflect.Ptr:
+		type_name, type_options, _, err := self.goType(t.Elem())
+		if err != nil {
+			return "", nil, 0, err
+		}
+		options.Set("type", type_name)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Pointer", options, 8, nil
+
+	case reflect.Struct:
+		go_struct, err := self.addStruct(t)
+		if err != nil {
+			return "", nil, 0, err
+		}
+		if !go_struct.size_known {
+			return go_struct.definition.Name, options, -1, nil
+		}
+		return go_struct.definition.Name, options,
+			int64(go_struct.definition.Size), nil
+
+	default:
+		return "", nil, 0, fmt.Errorf("unsupported Go type %v", t)
+	}
+}
+
+func parseVtypesTag(tag string) map[string]string {
+	result := make(map[string]string)
+	if tag == "" {
+		return result
+	}
+
+	for _, directive := range strings.Split(tag, ",") {
+		components := strings.SplitN(directive, "=", 2)
+		if len(components) == 2 {
+			result[strings.TrimSpace(components[0])] = strings.TrimSpace(components[1])
+		} else {
+			result[strings.TrimSpace(directive)] = "true"
+		}
+	}
+	return result
+}
+
+func parseTagInt(value string) (int64, bool) {
+	result, err := strconv.ParseInt(value, 0, 64)
+	return result, err == nil
+}
+
+// Tag values are strings but options may also be ints or bools.
+func parseTagValue(value string) interface{} {
+	int_value, ok := parseTagInt(value)
+	if ok {
+		return int_value
+	}
+
+	bool_value, err := strconv.ParseBool(value)
+	if err == nil {
+		return bool_value
+	}
+	return value
+}
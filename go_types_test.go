@@ -0,0 +1,76 @@
+package vtypes
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+type goTestEntry struct {
+	Type  uint8
+	Value uint16 `vtypes:"type=uint16be"`
+}
+
+type goTestHeader struct {
+	_         struct{} `vtypes:"size=0x20"`
+	Signature [4]byte  `vtypes:"type=String"`
+	Version   uint8
+	Flags     uint16        `vtypes:"offset=6"`
+	Length    uint32        `vtypes:"offset=8,type=uint32be"`
+	Entries   []goTestEntry `vtypes:"offset=12,count=x=>x.Count"`
+	Count     uint8         `vtypes:"offset=0x1f"`
+	Values    [2]int16      `vtypes:"offset=0x10"`
+	Name      string        `vtypes:"offset=0x14,length=4,name=Tag"`
+	Next      *goTestHeader `vtypes:"offset=0x18"`
+	ignored   uint32
+	Skipped   uint32 `vtypes:"-"`
+}
+
+func TestProfileFromGoTypes(t *testing.T) {
+	profile, err := ProfileFromGoTypes(goTestHeader{})
+	assert.NoError(t, err)
+
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	goldie.Assert(t, "TestProfileFromGoTypes", []byte(exported))
+
+	data := []byte("MAGI\x02\x00\x01\x02\x00\x00\x01\x00" +
+		"\x05\x00\x07\x00" + // Entries
+		"\xff\xff\x02\x00" + // Values
+		"abcd" + // Tag
+		"\x00\x00\x00\x00\x00\x00\x00" + // Next
+		"\x02") // Count
+
+	scope := MakeScope()
+	obj, err := profile.Parse(scope, "goTestHeader", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "MAGI", Associative(scope, obj, "Signature"))
+	assert.Equal(t, uint64(0x0201), Associative(scope, obj, "Flags"))
+	assert.Equal(t, uint64(0x100), Associative(scope, obj, "Length"))
+	assert.Equal(t, "abcd", Associative(scope, obj, "Tag"))
+	assert.Equal(t, []interface{}{int64(-1), int64(2)},
+		Associative(scope, obj, "Values.Value"))
+
+	entries, ok := Associative(scope, obj, "Entries").(*ArrayObject)
+	assert.True(t, ok)
+	assert.Equal(t, 2, len(entries.Contents()))
+
+	entry, err := entries.Get(1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0xffff), Associative(scope, entry, "Value"))
+
+	_, err = ProfileFromGoTypes(1)
+	assert.Error(t, err)
+
+	// No partially built profile is returned on error.
+	type goBadType struct {
+		Value uint32 `vtypes:"type=Missing"`
+	}
+	profile, err = ProfileFromGoTypes(goBadType{})
+	assert.Error(t, err)
+	assert.Nil(t, profile)
+}
@@ -14,6 +14,14 @@ type IntParser struct {
 	type_name string
 	size      int
 	converter func(buf []byte) interface{}
+
+	// Generic ints (e.g. uint32) use this parser when the struct or
+	// profile is big endian.
+	big_endian *IntParser
+
+	// The profile of generic ints. The byte order is only looked up
+	// if the profile sets one.
+	profile *Profile
 }
 
 // IntParser does not take options
@@ -31,6 +39,10 @@ func (self *IntParser) DebugString(scope vfilter.Scope, offset int64, reader io.
 }
 
 func (self *IntParser) Parse(scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+	if self.big_endian != nil && self.profile.has_endian && isBigEndian(scope) {
+		return self.big_endian.Parse(scope, reader, offset)
+	}
+
 	buf := make([]byte, 8)
 
 	n, err := reader.ReadAt(buf, offset)
@@ -0,0 +1,6 @@
+// Package generated holds code generated by vtypes-gen from
+// profile.json. The tests check that it parses data exactly like the
+// runtime parser.
+package generated
+
+//go:generate go run ../../cmd/vtypes-gen -profile profile.json -package generated -model LP64 -output generated.go
@@ -0,0 +1,428 @@
+// Code generated by vtypes-gen. DO NOT EDIT.
+
+package generated
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"unicode/utf16"
+
+	"www.velocidex.com/golang/vtypes"
+)
+
+// Entry is generated from the struct Entry.
+type Entry struct {
+	Type  uint64 `json:"Type"`
+	Value int64  `json:"Value"`
+}
+
+func ParseEntry(reader io.ReaderAt, offset int64) *Entry {
+	self := &Entry{}
+	self.Type = vtypesReadUint8(reader, offset)
+	self.Value = vtypesReadInt16(reader, offset+1)
+	return self
+}
+
+// Header is generated from the struct Header.
+type Header struct {
+	Signature  string      `json:"Signature"`
+	Version    uint64      `json:"Version"`
+	Flags      uint64      `json:"Flags"`
+	Kind       string      `json:"Kind"`
+	Low        int64       `json:"Low"`
+	High       int64       `json:"High"`
+	Count      uint64      `json:"Count"`
+	NameLength uint64      `json:"NameLength"`
+	Name       string      `json:"Name"`
+	Entries    []*Entry    `json:"Entries"`
+	Kinds      []string    `json:"Kinds"`
+	Wide       string      `json:"Wide"`
+	Raw        []byte      `json:"Raw"`
+	Records    []*Record   `json:"Records"`
+	Padded     int64       `json:"Padded"`
+	Stamp      interface{} `json:"Stamp"`
+	Values     interface{} `json:"Values"`
+	Half       float64     `json:"Half"`
+	HalfBig    float64     `json:"HalfBig"`
+	Single     float64     `json:"Single"`
+	SingleBig  float64     `json:"SingleBig"`
+	Double     float64     `json:"Double"`
+	Size       uint64      `json:"Size"`
+	Sizes      interface{} `json:"Sizes"`
+	Build      interface{} `json:"Build"`
+
+	vtypesRuntime vtypesRuntimeStruct
+}
+
+func ParseHeader(reader io.ReaderAt, offset int64) *Header {
+	self := &Header{}
+	self.Signature = string(vtypesReadString(reader, offset, int64(4), 1024, []byte("\x00"), false))
+	self.Version = vtypesReadUint8(reader, offset+4)
+	self.Flags = vtypesReadUint16be(reader, offset+6)
+	self.Kind = vtypesEnum(vtypesHeaderKindChoices, int64(vtypesReadUint8(reader, offset+8)))
+	self.Low = vtypesBits(int64(vtypesReadUint8(reader, offset+9)), 0, 4)
+	self.High = vtypesBits(int64(vtypesReadUint8(reader, offset+9)), 4, 8)
+	self.Count = vtypesReadUint16(reader, offset+10)
+	self.NameLength = vtypesReadUint8(reader, offset+12)
+	self.Name = string(vtypesReadString(reader, offset+13, int64((int64(self.NameLength))), 1024, []byte("\x00"), false))
+	self.Entries = self.vtypesParseEntries(reader, offset+(int64(self.NameLength)+13), int64((int64(self.Count))))
+	self.Kinds = self.vtypesParseKinds(reader, offset+48, int64(2))
+	self.Wide = string(vtypesReadString(reader, offset+50, int64(8), 1024, []byte("\x00\x00"), true))
+	self.Raw = vtypesReadString(reader, offset+58, int64(2), 1024, []byte(""), false)
+	self.Records = self.vtypesParseRecords(reader, offset+60, int64((int64(self.Version) - 1)))
+	self.Padded = vtypesReadInt32(reader, offset+32)
+	self.Stamp = self.vtypesRuntime.field("Header", reader, offset, "Stamp")
+	self.Values = self.vtypesRuntime.field("Header", reader, offset, "Values")
+	self.Half = vtypesReadFloat16(reader, offset+4)
+	self.HalfBig = vtypesReadFloat16be(reader, offset+6)
+	self.Single = vtypesReadFloat32(reader, offset+4)
+	self.SingleBig = vtypesReadFloat32be(reader, offset+4)
+	self.Double = vtypesReadFloat64(reader, offset+24)
+	self.Size = vtypesReadUint64(reader, offset+28)
+	self.Sizes = self.vtypesRuntime.field("Header", reader, offset, "Sizes")
+	self.Build = self.vtypesRuntime.field("Header", reader, offset, "Build")
+	return self
+}
+
+// The error from the runtime parser if the fields it parses could not
+// be parsed.
+func (self *Header) VtypesError() error {
+	return self.vtypesRuntime.err
+}
+
+func (self *Header) vtypesParseEntries(reader io.ReaderAt, offset int64, count int64) []*Entry {
+	if count > 1000 {
+		count = 1000
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	result := make([]*Entry, 0, count)
+	member_offset := int64(0)
+	for i := int64(0); i < count; i++ {
+		element := ParseEntry(reader, offset+member_offset)
+		element_size := int64(3)
+		if element_size == 0 {
+			break
+		}
+		result = append(result, element)
+		member_offset += element_size
+	}
+	return result
+}
+
+func (self *Header) vtypesParseKinds(reader io.ReaderAt, offset int64, count int64) []string {
+	if count > 1000 {
+		count = 1000
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	result := make([]string, 0, count)
+	member_offset := int64(0)
+	for i := int64(0); i < count; i++ {
+		element := vtypesEnum(vtypesHeaderKindsElementChoices, int64(vtypesReadUint8(reader, offset+member_offset)))
+		element_size := int64(int64(len(element)))
+		if element_size == 0 {
+			break
+		}
+		result = append(result, element)
+		member_offset += element_size
+	}
+	return result
+}
+
+func (self *Header) vtypesParseRecords(reader io.ReaderAt, offset int64, count int64) []*Record {
+	if count > 1000 {
+		count = 1000
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	result := make([]*Record, 0, count)
+	member_offset := int64(0)
+	for i := int64(0); i < count; i++ {
+		element := ParseRecord(reader, offset+member_offset)
+		element_size := int64(element.vtypesSize())
+		if element_size == 0 {
+			break
+		}
+		result = append(result, element)
+		member_offset += element_size
+	}
+	return result
+}
+
+// Record is generated from the struct Record.
+type Record struct {
+	Length uint64 `json:"Length"`
+	Data   string `json:"Data"`
+}
+
+func ParseRecord(reader io.ReaderAt, offset int64) *Record {
+	self := &Record{}
+	self.Length = vtypesReadUint8(reader, offset)
+	self.Data = string(vtypesReadString(reader, offset+1, int64((int64(self.Length))), 1024, []byte(""), false))
+	return self
+}
+
+func (self *Record) vtypesSize() int64 {
+	return int64((int64(self.Length) + 1))
+}
+
+// Fields which can not be compiled are parsed by the runtime parser.
+var vtypesDefinitions = "{\n  \"constants\": {\"BUILD\": 7601},\n  \"structs\": [\n    [\"Entry\", 3, [\n      [\"Type\", 0, \"uint8\"],\n      [\"Value\", 1, \"int16\"]\n    ]],\n    [\"Header\", 64, [\n      [\"Signature\", 0, \"String\", {\"length\": 4}],\n      [\"Version\", 4, \"uint8\"],\n      [\"Flags\", 6, \"uint16be\"],\n      [\"Kind\", 8, \"Enumeration\", {\"choices\": {\"1\": \"FILE\", \"2\": \"DIR\"}, \"type\": \"uint8\"}],\n      [\"Low\", 9, \"BitField\", {\"end_bit\": 4, \"start_bit\": 0, \"type\": \"uint8\"}],\n      [\"High\", 9, \"BitField\", {\"end_bit\": 8, \"start_bit\": 4, \"type\": \"uint8\"}],\n      [\"Count\", 10, \"uint16\"],\n      [\"NameLength\", 12, \"uint8\"],\n      [\"Name\", 13, \"String\", {\"length\": \"x=>x.NameLength\"}],\n      [\"Entries\", \"x=>x.NameLength + 13\", \"Array\", {\"count\": \"x=>x.Count\", \"type\": \"Entry\"}],\n      [\"Kinds\", 48, \"Array\", {\"count\": 2, \"type\": \"Enumeration\", \"type_options\": {\"choices\": {\"1\": \"FILE\"}, \"type\": \"uint8\"}}],\n      [\"Wide\", 50, \"String\", {\"encoding\": \"utf16\", \"length\": 8}],\n      [\"Raw\", 58, \"String\", {\"byte_string\": true, \"length\": 2, \"term\": \"\"}],\n      [\"Records\", 60, \"Array\", {\"count\": \"x=>x.Version - 1\", \"type\": \"Record\"}],\n      [\"Padded\", 32, \"int32\"],\n      [\"Stamp\", 60, \"Timestamp\", {\"type\": \"uint32\"}],\n      [\"Values\", 60, \"Array\", {\"count\": 4, \"sentinel\": \"x=>x = 0\", \"type\": \"uint8\"}],\n      [\"Half\", 4, \"float16\"],\n      [\"HalfBig\", 6, \"float16be\"],\n      [\"Single\", 4, \"float32\"],\n      [\"SingleBig\", 4, \"float32be\"],\n      [\"Double\", 24, \"float64\"],\n      [\"Size\", 28, \"unsigned long\"],\n      [\"Sizes\", 28, \"Array\", {\"count\": 1, \"sentinel\": \"x=>x = 0\", \"type\": \"unsigned long\"}],\n      [\"Build\", 0, \"Value\", {\"value\": \"x=>BUILD\"}]\n    ]],\n    [\"Record\", \"x=>x.Length + 1\", [\n      [\"Length\", 0, \"uint8\"],\n      [\"Data\", 1, \"String\", {\"length\": \"x=>x.Length\", \"term\": \"\"}]\n    ]]\n  ]\n}\n"
+
+var (
+	vtypesRuntimeOnce    sync.Once
+	vtypesRuntimeProfile *vtypes.Profile
+	vtypesRuntimeError   error
+)
+
+func vtypesRuntimeLoad() (*vtypes.Profile, error) {
+	vtypesRuntimeOnce.Do(func() {
+		profile := vtypes.NewProfile()
+		err := vtypes.AddModelFor(profile, vtypes.ModelLP64)
+		if err != nil {
+			vtypesRuntimeError = err
+			return
+		}
+		vtypesRuntimeError = profile.ParseStructDefinitions(vtypesDefinitions)
+		if vtypesRuntimeError == nil {
+			vtypesRuntimeProfile = profile
+		}
+	})
+	return vtypesRuntimeProfile, vtypesRuntimeError
+}
+
+// The struct parsed by the runtime parser. It is only parsed once for
+// all the fields which need it.
+type vtypesRuntimeStruct struct {
+	obj *vtypes.StructObject
+	err error
+}
+
+func (self *vtypesRuntimeStruct) field(struct_name string,
+	reader io.ReaderAt, offset int64, field string) interface{} {
+	if self.obj == nil && self.err == nil {
+		self.obj, self.err = vtypesRuntimeParse(struct_name, reader, offset)
+	}
+	if self.obj == nil {
+		return nil
+	}
+
+	value, _ := self.obj.Get(field)
+	return value
+}
+
+func vtypesRuntimeParse(struct_name string,
+	reader io.ReaderAt, offset int64) (*vtypes.StructObject, error) {
+	profile, err := vtypesRuntimeLoad()
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := profile.Parse(vtypes.MakeScope(), struct_name, reader, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	struct_obj, ok := obj.(*vtypes.StructObject)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a struct", struct_name)
+	}
+	return struct_obj, nil
+}
+
+func vtypesBits(value int64, start_bit, end_bit int64) int64 {
+	result := int64(0)
+	for i := start_bit; i < end_bit; i++ {
+		result |= value & (1 << uint8(i))
+	}
+	return result >> start_bit
+}
+
+func vtypesEnum(choices map[int64]string, value int64) string {
+	result, pres := choices[value]
+	if !pres {
+		return fmt.Sprintf("%#x", value)
+	}
+	return result
+}
+
+// Decode an IEEE 754 half precision float.
+func vtypesFloat16frombits(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1.0
+	}
+
+	exponent := int(bits>>10) & 0x1f
+	fraction := float64(bits & 0x3ff)
+	switch exponent {
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+
+	case 0x1f:
+		if fraction != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+
+	return sign * math.Ldexp(fraction+0x400, exponent-25)
+}
+
+var vtypesHeaderKindChoices = map[int64]string{
+	1: "FILE",
+	2: "DIR",
+}
+
+var vtypesHeaderKindsElementChoices = map[int64]string{
+	1: "FILE",
+}
+
+// Ints are read from an 8 byte buffer like the runtime IntParser.
+func vtypesReadBuffer(reader io.ReaderAt, offset int64) []byte {
+	buf := make([]byte, 8)
+	n, err := reader.ReadAt(buf, offset)
+	if n == 0 || (err != nil && !errors.Is(err, io.EOF)) {
+		return nil
+	}
+	return buf
+}
+
+func vtypesReadFloat16(reader io.ReaderAt, offset int64) float64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return vtypesFloat16frombits(binary.LittleEndian.Uint16(buf))
+}
+
+func vtypesReadFloat16be(reader io.ReaderAt, offset int64) float64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return vtypesFloat16frombits(binary.BigEndian.Uint16(buf))
+}
+
+func vtypesReadFloat32(reader io.ReaderAt, offset int64) float64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(buf)))
+}
+
+func vtypesReadFloat32be(reader io.ReaderAt, offset int64) float64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return float64(math.Float32frombits(binary.BigEndian.Uint32(buf)))
+}
+
+func vtypesReadFloat64(reader io.ReaderAt, offset int64) float64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf))
+}
+
+func vtypesReadInt16(reader io.ReaderAt, offset int64) int64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return int64(int16(binary.LittleEndian.Uint16(buf)))
+}
+
+func vtypesReadInt32(reader io.ReaderAt, offset int64) int64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return int64(int32(binary.LittleEndian.Uint32(buf)))
+}
+
+// Read a string like the runtime StringParser.
+func vtypesReadString(reader io.ReaderAt, offset, length, max_length int64,
+	term []byte, is_utf16 bool) []byte {
+	if length > max_length {
+		length = max_length
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	buf := make([]byte, length)
+	n, _ := reader.ReadAt(buf, offset)
+	result := buf[:n]
+
+	step := 1
+	if is_utf16 {
+		step = 2
+	}
+
+	if len(term) > 0 {
+		for i := 0; i < len(result); i += step {
+			if bytes.HasPrefix(result[i:], term) {
+				result = result[:i]
+				break
+			}
+		}
+	}
+
+	if is_utf16 {
+		ints := make([]uint16, len(result)/2)
+		for i := range ints {
+			ints[i] = binary.LittleEndian.Uint16(result[2*i:])
+		}
+		return []byte(string(utf16.Decode(ints)))
+	}
+
+	return result
+}
+
+func vtypesReadUint16(reader io.ReaderAt, offset int64) uint64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return uint64(binary.LittleEndian.Uint16(buf))
+}
+
+func vtypesReadUint16be(reader io.ReaderAt, offset int64) uint64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return uint64(binary.BigEndian.Uint16(buf))
+}
+
+func vtypesReadUint64(reader io.ReaderAt, offset int64) uint64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return uint64(binary.LittleEndian.Uint64(buf))
+}
+
+func vtypesReadUint8(reader io.ReaderAt, offset int64) uint64 {
+	buf := vtypesReadBuffer(reader, offset)
+	if buf == nil {
+		return 0
+	}
+	return uint64(buf[0])
+}
@@ -0,0 +1,58 @@
+package generated
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+	"www.velocidex.com/golang/vtypes"
+)
+
+func TestGeneratedParser(t *testing.T) {
+	definitions, err := os.ReadFile("profile.json")
+	assert.NoError(t, err)
+
+	// The code is generated for 64 bit Linux.
+	profile := vtypes.NewProfile()
+	err = vtypes.AddModelFor(profile, vtypes.ModelLP64)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(string(definitions))
+	assert.NoError(t, err)
+
+	data := []byte("HDR\x00" + // Signature
+		"\x03\x00\x01\x02" + // Version, Flags
+		"\x02\x5a\x02\x00" + // Kind, Low/High, Count
+		"\x05hello" + // NameLength, Name
+		"\x01\x02\x00\xff\xfe\xff" + // Entries
+		"\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"\xfe\xff\xff\xff" + // Padded
+		"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"\x01\x03" + // Kinds
+		"a\x00b\x00\x00\x00c\x00" + // Wide
+		"\x00\x01" + // Raw
+		"\x02ab\x01c" + // Records
+		"\x00\x00")
+
+	// Also parse at offsets where most fields are out of range.
+	for _, offset := range []int64{0, 1, 40, 100} {
+		reader := bytes.NewReader(data)
+
+		scope := vtypes.MakeScope()
+		obj, err := profile.Parse(scope, "Header", reader, offset)
+		assert.NoError(t, err)
+
+		expected, err := json.MarshalIndent(obj, "", " ")
+		assert.NoError(t, err)
+
+		header := ParseHeader(reader, offset)
+		assert.NoError(t, header.VtypesError())
+
+		actual, err := json.MarshalIndent(header, "", " ")
+		assert.NoError(t, err)
+
+		assert.Equal(t, string(expected), string(actual))
+	}
+}
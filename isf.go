@@ -0,0 +1,379 @@
+// Load Volatility 3 Intermediate Symbol Format (ISF) files.
+
+package vtypes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/Velocidex/ordereddict"
+)
+
+type isfFile struct {
+	BaseTypes map[string]*isfBaseType `json:"base_types"`
+	UserTypes map[string]*isfUserType `json:"user_types"`
+	Enums     map[string]*isfEnum     `json:"enums"`
+}
+
+type isfBaseType struct {
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	Signed bool   `json:"signed"`
+	Endian string `json:"endian"`
+}
+
+type isfUserType struct {
+	Kind   string               `json:"kind"`
+	Size   int                  `json:"size"`
+	Fields map[string]*isfField `json:"fields"`
+}
+
+type isfField struct {
+	Offset int64    `json:"offset"`
+	Type   *isfType `json:"type"`
+}
+
+// A type descriptor refers to another type.
+type isfType struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+
+	// For pointers and arrays
+	Subtype *isfType `json:"subtype"`
+	Count   int64    `json:"count"`
+
+	// For bitfields
+	BitPosition int64    `json:"bit_position"`
+	BitLength   int64    `json:"bit_length"`
+	Type        *isfType `json:"type"`
+}
+
+type isfEnum struct {
+	Size      int64            `json:"size"`
+	Base      string           `json:"base"`
+	Constants map[string]int64 `json:"constants"`
+}
+
+// Load the types from a Volatility 3 ISF (Intermediate Symbol Format)
+// JSON file into the profile. User types (structs, unions and
+// classes) become structs, enums become Enumeration fields and
+// bitfields become BitField fields. Base types are mapped to the
+// built in int parsers with the size and endianness given in the
+// file, and the ISF "pointer" base type is registered as the
+// profile's "pointer" type so Pointer fields read addresses of the
+// correct width. A pointer type the profile already has (e.g. from
+// AddModelFor()) is kept.
+//
+// Symbols are not loaded.
+func (self *Profile) LoadISF(reader io.Reader) error {
+	err := self.checkMutable()
+	if err != nil {
+		return fmt.Errorf("LoadISF: %w", err)
+	}
+
+	isf := &isfFile{}
+	err = json.NewDecoder(reader).Decode(isf)
+	if err != nil {
+		return fmt.Errorf("LoadISF: %w", err)
+	}
+
+	loader := &isfLoader{isf: isf}
+
+	var pointer_parser Parser
+	pointer, pres := isf.BaseTypes["pointer"]
+	if pres {
+		pointer_parser, err = isfIntParser(pointer)
+		if err != nil {
+			return fmt.Errorf("LoadISF: pointer: %w", err)
+		}
+	}
+
+	var names []string
+	for name := range isf.UserTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]*StructDefinition, 0, len(names))
+	for _, name := range names {
+		definition, err := loader.convertUserType(name, isf.UserTypes[name])
+		if err != nil {
+			return fmt.Errorf("LoadISF: %w", err)
+		}
+		definitions = append(definitions, definition)
+	}
+
+	return self.addStructDefinitionsWithPointer(definitions, pointer_parser)
+}
+
+type isfLoader struct {
+	isf *isfFile
+}
+
+func (self *isfLoader) convertUserType(
+	name string, user_type *isfUserType) (*StructDefinition, error) {
+	result := &StructDefinition{Name: name, Size: user_type.Size}
+
+	for field_name, field := range user_type.Fields {
+		type_name, options, err := self.convertType(field.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%v.%v: %w", name, field_name, err)
+		}
+
+		field_def := &FieldDefinition{
+			Name:   field_name,
+			Offset: field.Offset,
+			Type:   type_name,
+		}
+		if options.Len() > 0 {
+			field_def.Options = options
+		}
+		result.Fields = append(result.Fields, field_def)
+	}
+
+	// Fields are stored in a map so order them by offset.
+	sort.Slice(result.Fields, func(i, j int) bool {
+		a, b := result.Fields[i], result.Fields[j]
+		if a.Offset != b.Offset {
+			return a.Offset < b.Offset
+		}
+		a_bit, b_bit := isfStartBit(a), isfStartBit(b)
+		if a_bit != b_bit {
+			return a_bit < b_bit
+		}
+		return a.Name < b.Name
+	})
+
+	return result, nil
+}
+
+func isfStartBit(field_def *FieldDefinition) int64 {
+	if field_def.Options == nil {
+		return 0
+	}
+	start_bit, _ := field_def.Options.GetInt64("start_bit")
+	return start_bit
+}
+
+// Convert an ISF type descriptor into a type name and options.
+func (self *isfLoader) convertType(
+	isf_type *isfType) (string, *ordereddict.Dict, error) {
+	options := ordereddict.NewDict()
+	if isf_type == nil {
+		return "", nil, fmt.Errorf("missing type")
+	}
+
+	switch isf_type.Kind {
+	case "base":
+		type_name, err := self.baseTypeName(isf_type.Name)
+		return type_name, options, err
+
+	case "struct", "union", "class":
+		_, pres := self.isf.UserTypes[isf_type.Name]
+		if !pres {
+			return "", nil, fmt.Errorf("undefined user type %v", isf_type.Name)
+		}
+		return isf_type.Name, options, nil
+
+	case "enum":
+		enum, pres := self.isf.Enums[isf_type.Name]
+		if !pres {
+			return "", nil, fmt.Errorf("undefined enum %v", isf_type.Name)
+		}
+
+		type_name, err := self.baseTypeName(enum.Base)
+		if err != nil {
+			return "", nil, err
+		}
+
+		// Several names may have the same value - use the first
+		// name in sorted order.
+		var names []string
+		for name := range enum.Constants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		choices := ordereddict.NewDict()
+		for _, name := range names {
+			key := fmt.Sprintf("%d", enum.Constants[name])
+			_, pres := choices.Get(key)
+			if !pres {
+				choices.Set(key, name)
+			}
+		}
+
+		options.Set("type", type_name).Set("choices", choices)
+		return "Enumeration", options, nil
+
+	case "pointer":
+		// Pointers to void or functions are just addresses.
+		if isf_type.Subtype == nil || isf_type.Subtype.Kind == "function" ||
+			(isf_type.Subtype.Kind == "base" &&
+				self.isf.BaseTypes[isf_type.Subtype.Name] != nil &&
+				self.isf.BaseTypes[isf_type.Subtype.Name].Kind == "void") {
+			type_name, err := self.baseTypeName("pointer")
+			return type_name, options, err
+		}
+
+		type_name, type_options, err := self.convertType(isf_type.Subtype)
+		if err != nil {
+			return "", nil, err
+		}
+		options.Set("type", type_name)
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Pointer", options, nil
+
+	case "array":
+		type_name, type_options, err := self.convertType(isf_type.Subtype)
+		if err != nil {
+			return "", nil, err
+		}
+
+		options.Set("type", type_name).Set("count", isf_type.Count)
+		if isf_type.Count > 1000 {
+			options.Set("max_count", isf_type.Count)
+		}
+		if type_options.Len() > 0 {
+			options.Set("type_options", type_options)
+		}
+		return "Array", options, nil
+
+	case "bitfield":
+		type_name, type_options, err := self.convertType(isf_type.Type)
+		if err != nil {
+			return "", nil, err
+		}
+
+		bitfield_options := ordereddict.NewDict().
+			Set("type", type_name).
+			Set("start_bit", isf_type.BitPosition).
+			Set("end_bit", isf_type.BitPosition+isf_type.BitLength)
+
+		// Enum bitfields extract the bits from the enum's base type.
+		if type_name == "Enumeration" {
+			base, _ := type_options.Get("type")
+			bitfield_options.Set("type", base)
+			type_options.Set("type", "BitField").
+				Set("type_options", bitfield_options)
+			return "Enumeration", type_options, nil
+		}
+		return "BitField", bitfield_options, nil
+
+	case "function":
+		return "", nil, fmt.Errorf("functions can only be used through pointers")
+
+	default:
+		return "", nil, fmt.Errorf("unsupported type kind %v", isf_type.Kind)
+	}
+}
+
+// Map the ISF base type to one of the built in types.
+func (self *isfLoader) baseTypeName(name string) (string, error) {
+	base_type, pres := self.isf.BaseTypes[name]
+	if !pres {
+		return "", fmt.Errorf("undefined base type %v", name)
+	}
+
+	parser, err := isfIntParser(base_type)
+	if err != nil {
+		return "", fmt.Errorf("base type %v: %w", name, err)
+	}
+	return parser.type_name, nil
+}
+
+// Build an int parser for the base type. The parser's type name is
+// the name of the equivalent built in type.
+func isfIntParser(base_type *isfBaseType) (*IntParser, error) {
+	var byte_order binary.ByteOrder = binary.LittleEndian
+	suffix := ""
+	switch base_type.Endian {
+	case "little", "":
+	case "big":
+		byte_order = binary.BigEndian
+		suffix = "be"
+	default:
+		return nil, fmt.Errorf("unsupported endian %v", base_type.Endian)
+	}
+
+	if base_type.Kind == "float" {
+		type_name := fmt.Sprintf("float%d%v", base_type.Size*8, suffix)
+		switch base_type.Size {
+		case 2:
+			return NewIntParser(type_name, 2, func(buf []byte) interface{} {
+				return float16frombits(byte_order.Uint16(buf))
+			}), nil
+		case 4:
+			return NewIntParser(type_name, 4, func(buf []byte) interface{} {
+				return float64(math.Float32frombits(byte_order.Uint32(buf)))
+			}), nil
+		case 8:
+			return NewIntParser(type_name, 8, func(buf []byte) interface{} {
+				return math.Float64frombits(byte_order.Uint64(buf))
+			}), nil
+		}
+		return nil, fmt.Errorf("unsupported float size %v", base_type.Size)
+	}
+
+	switch base_type.Kind {
+	case "int", "char", "bool":
+	default:
+		return nil, fmt.Errorf("unsupported kind %v", base_type.Kind)
+	}
+
+	if base_type.Size == 1 {
+		suffix = ""
+	}
+	type_name := intTypeName(base_type.Size, base_type.Signed) + suffix
+
+	switch base_type.Size {
+	case 1:
+		if base_type.Signed {
+			return NewIntParser(type_name, 1, func(buf []byte) interface{} {
+				return int64(int8(buf[0]))
+			}), nil
+		}
+		return NewIntParser(type_name, 1, func(buf []byte) interface{} {
+			return uint64(buf[0])
+		}), nil
+
+	case 2:
+		if base_type.Signed {
+			return NewIntParser(type_name, 2, func(buf []byte) interface{} {
+				return int64(int16(byte_order.Uint16(buf)))
+			}), nil
+		}
+		return NewIntParser(type_name, 2, func(buf []byte) interface{} {
+			return uint64(byte_order.Uint16(buf))
+		}), nil
+
+	case 4:
+		if base_type.Signed {
+			return NewIntParser(type_name, 4, func(buf []byte) interface{} {
+				return int64(int32(byte_order.Uint32(buf)))
+			}), nil
+		}
+		return NewIntParser(type_name, 4, func(buf []byte) interface{} {
+			return uint64(byte_order.Uint32(buf))
+		}), nil
+
+	case 8:
+		if base_type.Signed {
+			return NewIntParser(type_name, 8, func(buf []byte) interface{} {
+				return int64(byte_order.Uint64(buf))
+			}), nil
+		}
+		return NewIntParser(type_name, 8, func(buf []byte) interface{} {
+			return byte_order.Uint64(buf)
+		}), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported size %v", base_type.Size)
+	}
+}
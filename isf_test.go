@@ -0,0 +1,110 @@
+package vtypes
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// A 32 bit symbol table
+var isfSample = `{
+  "metadata": {"format": "6.2.0"},
+  "base_types": {
+    "pointer": {"kind": "int", "size": 4, "signed": false, "endian": "little"},
+    "unsigned long": {"kind": "int", "size": 4, "signed": false, "endian": "little"},
+    "unsigned short": {"kind": "int", "size": 2, "signed": false, "endian": "little"},
+    "long": {"kind": "int", "size": 4, "signed": true, "endian": "little"},
+    "char": {"kind": "char", "size": 1, "signed": true, "endian": "little"},
+    "void": {"kind": "void", "size": 0, "signed": false, "endian": "little"}
+  },
+  "user_types": {
+    "_LIST_ENTRY": {
+      "kind": "struct", "size": 8,
+      "fields": {
+        "Flink": {"offset": 0, "type": {"kind": "pointer", "subtype": {"kind": "struct", "name": "_LIST_ENTRY"}}},
+        "Blink": {"offset": 4, "type": {"kind": "pointer", "subtype": {"kind": "struct", "name": "_LIST_ENTRY"}}}
+      }
+    },
+    "_OBJECT": {
+      "kind": "struct", "size": 24,
+      "fields": {
+        "Type": {"offset": 0, "type": {"kind": "enum", "name": "_OBJECT_TYPE"}},
+        "Flags": {"offset": 4, "type": {"kind": "bitfield", "bit_position": 4, "bit_length": 4,
+                  "type": {"kind": "base", "name": "unsigned long"}}},
+        "Kind": {"offset": 4, "type": {"kind": "bitfield", "bit_position": 0, "bit_length": 4,
+                  "type": {"kind": "enum", "name": "_OBJECT_TYPE"}}},
+        "Name": {"offset": 8, "type": {"kind": "array", "count": 4, "subtype": {"kind": "base", "name": "char"}}},
+        "List": {"offset": 12, "type": {"kind": "struct", "name": "_LIST_ENTRY"}},
+        "Context": {"offset": 20, "type": {"kind": "pointer", "subtype": {"kind": "base", "name": "void"}}}
+      }
+    }
+  },
+  "enums": {
+    "_OBJECT_TYPE": {"size": 4, "base": "long", "constants": {"File": 1, "Key": 2}}
+  },
+  "symbols": {
+    "PsActiveProcessHead": {"address": 1234}
+  }
+}`
+
+func TestISF(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.LoadISF(strings.NewReader(isfSample))
+	assert.NoError(t, err)
+
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	goldie.Assert(t, "TestISF", []byte(exported))
+
+	data := []byte{
+		0x02, 0x00, 0x00, 0x00, // Type
+		0x51, 0x00, 0x00, 0x00, // Flags and Kind
+		0x41, 0x42, 0x43, 0x44, // Name
+		0x0c, 0x00, 0x00, 0x00, // List.Flink points to itself
+		0x0c, 0x00, 0x00, 0x00, // List.Blink
+		0x78, 0x56, 0x34, 0x12, // Context
+	}
+
+	scope := MakeScope()
+	obj, err := profile.Parse(scope, "_OBJECT", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Key", Associative(scope, obj, "Type"))
+	assert.Equal(t, int64(5), Associative(scope, obj, "Flags"))
+	assert.Equal(t, "File", Associative(scope, obj, "Kind"))
+	assert.Equal(t, uint64(0x12345678), Associative(scope, obj, "Context"))
+
+	// Pointers are 4 bytes wide.
+	assert.Equal(t, int64(12),
+		Associative(scope, obj, "List.Flink.Blink.Flink.OffsetOf"))
+}
+
+func TestISFPointer(t *testing.T) {
+	// The pointer type of the data model is kept.
+	profile := NewProfile()
+	err := AddModelFor(profile, ModelLP64)
+	assert.NoError(t, err)
+
+	err = profile.LoadISF(strings.NewReader(isfSample))
+	assert.NoError(t, err)
+	assert.True(t, profile.types["pointer"] == profile.types["uint64"])
+
+	// Nothing is installed when the types can not be added.
+	profile = NewProfile()
+	AddModel(profile)
+
+	err = profile.ParseStructDefinitions(`[["_LIST_ENTRY", 8, []]]`)
+	assert.NoError(t, err)
+
+	err = profile.LoadISF(strings.NewReader(isfSample))
+	assert.Error(t, err)
+
+	_, pres := profile.types["pointer"]
+	assert.False(t, pres)
+}
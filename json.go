@@ -3,68 +3,382 @@
 package vtypes
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/Velocidex/ordereddict"
 )
 
 func (self *StructDefinition) UnmarshalJSON(p []byte) error {
+	if isJSONObject(p) {
+		return self.unmarshalKeyedJSON(p)
+	}
+
 	var tmp []json.RawMessage
 	if err := json.Unmarshal(p, &tmp); err != nil {
-		return err
+		return self.error(-1, err)
 	}
 
-	if len(tmp) != 3 {
-		return errors.New("Struct Definition should be [name, size, fields]")
+	if len(tmp) != 3 && len(tmp) != 4 {
+		return self.error(-1, errors.New(
+			"Struct Definition should be [name, size, fields, options?]"))
 	}
 
 	if err := json.Unmarshal(tmp[0], &self.Name); err != nil {
+		return self.error(-1, fmt.Errorf("Name should be a string: %w", err))
+	}
+
+	if err := self.unmarshalSizeJSON(tmp[1]); err != nil {
+		return self.error(-1, err)
+	}
+
+	if err := self.unmarshalFieldsJSON(tmp[2]); err != nil {
 		return err
 	}
 
-	if err := json.Unmarshal(tmp[1], &self.Size); err != nil {
-		if err := json.Unmarshal(tmp[1], &self.SizeExpression); err != nil {
-			return err
+	if len(tmp) == 4 {
+		options := ordereddict.NewDict()
+		if err := json.Unmarshal(tmp[3], &options); err != nil {
+			return self.error(-1, fmt.Errorf("struct options %w", err))
 		}
+		return self.error(-1, self.setOptions(options))
 	}
 
-	if err := json.Unmarshal(tmp[2], &self.Fields); err != nil {
-		return fmt.Errorf("Decoding struct %v: %v", self.Name, err)
+	return nil
+}
+
+// The keyed form: {"name": ..., "size": ..., "fields": [...]} with
+// optional doc, tags and struct options.
+func (self *StructDefinition) unmarshalKeyedJSON(p []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(p, &keys); err != nil {
+		return self.error(-1, err)
+	}
+
+	name, pres := keys["name"]
+	if !pres {
+		return self.error(-1, errors.New("Struct name is required"))
 	}
+	if err := json.Unmarshal(name, &self.Name); err != nil {
+		return self.error(-1, fmt.Errorf("Name should be a string: %w", err))
+	}
+
+	options := ordereddict.NewDict()
+	for _, k := range sortedJSONKeys(keys) {
+		value := keys[k]
+
+		var err error
+		switch k {
+		case "name":
+			continue
+
+		case "size":
+			err = self.unmarshalSizeJSON(value)
 
+		case "fields":
+			if err := self.unmarshalFieldsJSON(value); err != nil {
+				return err
+			}
+
+		case "doc":
+			err = unmarshalDocJSON(value, &self.Doc)
+
+		case "tags":
+			err = unmarshalTagsJSON(value, &self.Tags)
+
+		default:
+			var option interface{}
+			err = json.Unmarshal(value, &option)
+			options.Set(k, option)
+		}
+
+		if err != nil {
+			return self.error(-1, err)
+		}
+	}
+
+	return self.error(-1, self.setOptions(options))
+}
+
+func (self *StructDefinition) unmarshalSizeJSON(p []byte) error {
+	if err := json.Unmarshal(p, &self.Size); err != nil {
+		if err := json.Unmarshal(p, &self.SizeExpression); err != nil {
+			return fmt.Errorf("Size should be a string or integer: %w", err)
+		}
+	}
+	return nil
+}
+
+func (self *StructDefinition) unmarshalFieldsJSON(p []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(p, &fields); err != nil {
+		return self.error(-1, fmt.Errorf(
+			"Fields should be a list of field definitions: %w", err))
+	}
+
+	for i, field := range fields {
+		new_field := &FieldDefinition{}
+		self.Fields = append(self.Fields, new_field)
+
+		if err := json.Unmarshal(field, new_field); err != nil {
+			return self.error(i, err)
+		}
+	}
 	return nil
 }
 
 func (self *FieldDefinition) UnmarshalJSON(p []byte) error {
+	if isJSONObject(p) {
+		return self.unmarshalKeyedJSON(p)
+	}
+
 	var tmp []json.RawMessage
 	if err := json.Unmarshal(p, &tmp); err != nil {
 		return err
 	}
 
+	// The offset may be omitted: [name, type, options?]
+	if len(tmp) == 2 || (len(tmp) == 3 && isJSONObject(tmp[2])) {
+		tmp = append([]json.RawMessage{tmp[0], json.RawMessage(`"auto"`)},
+			tmp[1:]...)
+	}
+
 	if len(tmp) != 3 && len(tmp) != 4 {
-		return errors.New("Field Definition should be [name, offset, type, options?]")
+		return errors.New("Field Definition should be [name, offset?, type, options?]")
 	}
 
 	if err := json.Unmarshal(tmp[0], &self.Name); err != nil {
-		return err
+		return fmt.Errorf("field name should be a string: %w", err)
 	}
-	if err := json.Unmarshal(tmp[1], &self.Offset); err != nil {
-		if err := json.Unmarshal(tmp[1], &self.OffsetExpression); err != nil {
-			return err
-		}
+	if err := self.unmarshalOffsetJSON(tmp[1]); err != nil {
+		return err
 	}
 	if err := json.Unmarshal(tmp[2], &self.Type); err != nil {
-		return err
+		return fmt.Errorf("type should be a string: %w", err)
 	}
 
 	if len(tmp) == 4 {
 		self.Options = ordereddict.NewDict()
 		if err := json.Unmarshal(tmp[3], &self.Options); err != nil {
+			return fmt.Errorf("options %w", err)
+		}
+	}
+
+	return nil
+}
+
+// The keyed form: {"name": ..., "offset": ..., "type": ...} with
+// optional options, doc and tags. Without an offset the field
+// follows the previous field.
+func (self *FieldDefinition) unmarshalKeyedJSON(p []byte) error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(p, &keys); err != nil {
+		return err
+	}
+
+	// The name is needed to report problems with the other keys.
+	name, pres := keys["name"]
+	if pres {
+		if err := json.Unmarshal(name, &self.Name); err != nil {
+			return fmt.Errorf("field name should be a string: %w", err)
+		}
+	}
+
+	self.AutoOffset = true
+	for _, k := range sortedJSONKeys(keys) {
+		value := keys[k]
+
+		var err error
+		switch k {
+		case "name":
+			continue
+
+		case "offset":
+			self.AutoOffset = false
+			err = self.unmarshalOffsetJSON(value)
+
+		case "type":
+			if err := json.Unmarshal(value, &self.Type); err != nil {
+				return fmt.Errorf("type should be a string: %w", err)
+			}
+
+		case "options":
+			self.Options = ordereddict.NewDict()
+			if err := json.Unmarshal(value, &self.Options); err != nil {
+				return fmt.Errorf("options %w", err)
+			}
+
+		case "doc":
+			err = unmarshalDocJSON(value, &self.Doc)
+
+		case "tags":
+			err = unmarshalTagsJSON(value, &self.Tags)
+
+		default:
+			err = fmt.Errorf("Unknown field key %v", k)
+		}
+
+		if err != nil {
 			return err
 		}
 	}
 
+	return self.checkKeyed()
+}
+
+func (self *FieldDefinition) unmarshalOffsetJSON(p []byte) error {
+	if err := json.Unmarshal(p, &self.Offset); err != nil {
+		if err := json.Unmarshal(p, &self.OffsetExpression); err != nil {
+			return fmt.Errorf("offset should be a string or int: %w", err)
+		}
+	}
+	if self.OffsetExpression == autoOffset {
+		self.OffsetExpression = ""
+		self.AutoOffset = true
+	}
+	return nil
+}
+
+func unmarshalDocJSON(p []byte, doc *string) error {
+	if err := json.Unmarshal(p, doc); err != nil {
+		return fmt.Errorf("doc should be a string: %w", err)
+	}
+	return nil
+}
+
+func unmarshalTagsJSON(p []byte, tags *[]string) error {
+	if err := json.Unmarshal(p, tags); err != nil {
+		return fmt.Errorf("tags should be a list of strings: %w", err)
+	}
+	return nil
+}
+
+// Report problems in the same order every time.
+func sortedJSONKeys(keys map[string]json.RawMessage) []string {
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func isJSONObject(p []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(p), []byte("{"))
+}
+
+func (self *StructDefinition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.value())
+}
+
+func (self *FieldDefinition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.value())
+}
+
+func (self *TypedefDefinition) UnmarshalJSON(p []byte) error {
+	var tmp []json.RawMessage
+	if err := json.Unmarshal(p, &tmp); err != nil {
+		return self.error(err)
+	}
+
+	if len(tmp) != 2 && len(tmp) != 3 {
+		return self.error(errors.New("Typedef Definition should be [name, type, options?]"))
+	}
+
+	if err := json.Unmarshal(tmp[0], &self.Name); err != nil {
+		return self.error(fmt.Errorf("Typedef name should be a string: %w", err))
+	}
+	if err := json.Unmarshal(tmp[1], &self.Type); err != nil {
+		return self.error(fmt.Errorf("typedef type should be a string: %w", err))
+	}
+
+	if len(tmp) == 3 {
+		self.Options = ordereddict.NewDict()
+		if err := json.Unmarshal(tmp[2], &self.Options); err != nil {
+			return self.error(fmt.Errorf("typedef options %w", err))
+		}
+	}
+
+	return nil
+}
+
+func (self *TypedefDefinition) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.tuple())
+}
+
+func (self *ProfileDefinitions) UnmarshalJSON(p []byte) error {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(p, &sections); err != nil {
+		// Documents without typedefs may be a list of structs.
+		self.Structs, err = structsFromJSON(p)
+		return err
+	}
+
+	var names []string
+	for k := range sections {
+		names = append(names, k)
+	}
+	if err := checkProfileSections(names); err != nil {
+		return err
+	}
+
+	if endian, pres := sections["endian"]; pres {
+		if err := json.Unmarshal(endian, &self.Endian); err != nil {
+			return err
+		}
+	}
+
+	if constants, pres := sections["constants"]; pres {
+		self.Constants = ordereddict.NewDict()
+		if err := json.Unmarshal(constants, self.Constants); err != nil {
+			return err
+		}
+	}
+
+	if typedefs, pres := sections["typedefs"]; pres {
+		var values []json.RawMessage
+		if err := json.Unmarshal(typedefs, &values); err != nil {
+			return err
+		}
+
+		for i, value := range values {
+			typedef := &TypedefDefinition{}
+			if err := json.Unmarshal(value, typedef); err != nil {
+				return setDefinitionIndex(err, i)
+			}
+			self.Typedefs = append(self.Typedefs, typedef)
+		}
+	}
+
+	if structs, pres := sections["structs"]; pres {
+		var err error
+		self.Structs, err = structsFromJSON(structs)
+		return err
+	}
+
 	return nil
 }
+
+func structsFromJSON(p []byte) ([]*StructDefinition, error) {
+	var values []json.RawMessage
+	if err := json.Unmarshal(p, &values); err != nil {
+		return nil, err
+	}
+
+	var result []*StructDefinition
+	for i, value := range values {
+		struct_def := &StructDefinition{}
+		if err := json.Unmarshal(value, struct_def); err != nil {
+			return nil, setDefinitionIndex(err, i)
+		}
+		result = append(result, struct_def)
+	}
+	return result, nil
+}
+
+func (self *ProfileDefinitions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(self.document())
+}
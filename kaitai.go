@@ -0,0 +1,800 @@
+// Convert Kaitai Struct specifications (.ksy files) into vtypes
+// struct definitions.
+
+package vtypes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/Velocidex/yaml/v2"
+)
+
+// The result of converting a Kaitai Struct specification.
+type KaitaiConversion struct {
+	Definitions []*StructDefinition
+
+	// Parts of the specification which could not be translated or
+	// were only approximated.
+	Unsupported []string
+}
+
+// Convert the Kaitai Struct specification and add the resulting
+// structs to the profile. Returns a description of every part of the
+// specification that could not be translated.
+func (self *Profile) ParseKaitaiDefinitions(ksy string) ([]string, error) {
+	conversion, err := ConvertKaitaiStruct(ksy)
+	if err != nil {
+		return nil, err
+	}
+
+	return conversion.Unsupported,
+		self.addStructDefinitions(conversion.Definitions, false)
+}
+
+// Converts a Kaitai Struct specification into struct definitions.
+//
+// Each type becomes a struct (the top level type is named after
+// meta/id). Fields in `seq` are laid out sequentially, `repeat` becomes
+// an Array (repeat-until becomes the Array's sentinel), `switch-on`
+// becomes a Union, `enum` becomes an Enumeration and `instances`
+// become fields at the offset given by `pos` (relative to the start of
+// the struct) or Value fields for `value` instances. Kaitai expressions
+// are translated to VQL lambdas.
+//
+// Anything that can not be translated is listed in Unsupported.
+func ConvertKaitaiStruct(ksy string) (*KaitaiConversion, error) {
+	var spec yaml.MapSlice
+	err := yaml.Unmarshal([]byte(ksy), &spec)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := ksyMap(spec, "meta")
+	id := ksyString(meta, "id")
+	if id == "" {
+		return nil, fmt.Errorf("Kaitai specification requires meta/id")
+	}
+
+	converter := &kaitaiConverter{
+		result:      &KaitaiConversion{},
+		types:       make(map[string]*kaitaiType),
+		enums:       make(map[string]*ordereddict.Dict),
+		definitions: make(map[string]*StructDefinition),
+		in_progress: make(map[string]bool),
+	}
+
+	converter.collect(id, id, spec, "le")
+
+	for _, name := range converter.order {
+		definition := converter.convertType(name)
+		converter.result.Definitions = append(
+			converter.result.Definitions, definition)
+	}
+
+	return converter.result, nil
+}
+
+type kaitaiType struct {
+	name string
+
+	// The name qualified by the names of the enclosing types, like
+	// archive::entry.
+	path string
+
+	spec   yaml.MapSlice
+	endian string
+}
+
+type kaitaiConverter struct {
+	result *KaitaiConversion
+
+	types map[string]*kaitaiType
+	order []string
+
+	// Enums are keyed by their qualified path because nested types
+	// may define enums with the same name.
+	enums map[string]*ordereddict.Dict
+
+	definitions map[string]*StructDefinition
+	in_progress map[string]bool
+}
+
+func (self *kaitaiConverter) unsupported(format string, args ...interface{}) {
+	self.result.Unsupported = append(self.result.Unsupported,
+		fmt.Sprintf(format, args...))
+}
+
+// Register all the types and enums in the specification. Kaitai
+// types may be nested but vtypes has a flat namespace.
+func (self *kaitaiConverter) collect(
+	name, path string, spec yaml.MapSlice, endian string) {
+	meta := ksyMap(spec, "meta")
+	value, pres := ksyGet(meta, "endian")
+	if pres {
+		switch value {
+		case "le", "be":
+			endian = value.(string)
+		default:
+			self.unsupported("%v: only le or be endianness is supported, using %v",
+				name, endian)
+		}
+	}
+
+	_, pres = self.types[name]
+	if pres {
+		self.unsupported("%v: type is defined more than once", name)
+		return
+	}
+
+	self.types[name] = &kaitaiType{
+		name: name, path: path, spec: spec, endian: endian}
+	self.order = append(self.order, name)
+
+	for _, item := range ksyMap(spec, "enums") {
+		enum_name := fmt.Sprintf("%v", item.Key)
+		enum_spec, _ := item.Value.(yaml.MapSlice)
+
+		choices := ordereddict.NewDict()
+		for _, choice := range enum_spec {
+			value, ok := to_int64(choice.Key)
+			if !ok {
+				self.unsupported("%v: enum %v value %v is not an integer",
+					name, enum_name, choice.Key)
+				continue
+			}
+
+			// Choices are either a name or a map with an id.
+			choice_name, ok := choice.Value.(string)
+			if !ok {
+				choice_map, _ := choice.Value.(yaml.MapSlice)
+				choice_name = ksyString(choice_map, "id")
+			}
+			choices.Set(fmt.Sprintf("%d", value), choice_name)
+		}
+		self.enums[path+"::"+enum_name] = choices
+	}
+
+	for _, item := range ksyMap(spec, "types") {
+		type_spec, _ := item.Value.(yaml.MapSlice)
+		type_name := fmt.Sprintf("%v", item.Key)
+		self.collect(type_name, path+"::"+type_name, type_spec, endian)
+	}
+}
+
+// Kaitai looks enums up in the type using them and then in each
+// enclosing type in turn. The name may itself be a path like
+// entry::kind.
+func (self *kaitaiConverter) findEnum(
+	kaitai_type *kaitaiType, enum_name string) (*ordereddict.Dict, bool) {
+	parts := strings.Split(kaitai_type.path, "::")
+	for i := len(parts); i > 0; i-- {
+		key := strings.Join(parts[:i], "::") + "::" + enum_name
+		choices, pres := self.enums[key]
+		if pres {
+			return choices, true
+		}
+	}
+	return nil, false
+}
+
+// The size of a field is either known statically or given by an
+// expression (or unknown).
+type kaitaiSize struct {
+	known bool
+	size  int64
+
+	// A VQL expression for the size
+	expression string
+}
+
+func (self *kaitaiConverter) convertType(name string) *StructDefinition {
+	definition, pres := self.definitions[name]
+	if pres {
+		return definition
+	}
+
+	kaitai_type := self.types[name]
+	result := &StructDefinition{Name: name}
+
+	self.in_progress[name] = true
+	defer delete(self.in_progress, name)
+
+	// The current offset is static until we encounter a field with
+	// a variable size, after that it is an expression.
+	offset := int64(0)
+	offset_expression := ""
+
+	seq, _ := ksyGet(kaitai_type.spec, "seq")
+	seq_list, _ := seq.([]interface{})
+	for idx, item := range seq_list {
+		field_spec, _ := item.(yaml.MapSlice)
+		field_name := ksyString(field_spec, "id")
+		if field_name == "" {
+			field_name = fmt.Sprintf("_unnamed%d", idx)
+		}
+
+		field, size, err := self.convertField(kaitai_type, field_name, field_spec)
+		if err != nil {
+			self.unsupported("%v.%v: %v (field skipped, following offsets may be wrong)",
+				name, field_name, err)
+			continue
+		}
+
+		if offset_expression == "" {
+			field.Offset = offset
+		} else {
+			field.OffsetExpression = "x=>" + offset_expression
+		}
+		result.Fields = append(result.Fields, field)
+
+		switch {
+		case offset_expression == "" && size.known:
+			offset += size.size
+
+		case size.known:
+			offset_expression = fmt.Sprintf("x.`@%v`.RelOffset + %d",
+				field_name, size.size)
+
+		case size.expression != "":
+			offset_expression = fmt.Sprintf("x.`@%v`.RelOffset + (%v)",
+				field_name, size.expression)
+
+		default:
+			offset_expression = fmt.Sprintf("x.`@%v`.RelEndOf", field_name)
+		}
+	}
+
+	if offset_expression == "" {
+		result.Size = int(offset)
+	} else {
+		result.SizeExpression = "x=>" + offset_expression
+	}
+
+	for _, item := range ksyMap(kaitai_type.spec, "instances") {
+		field_name := fmt.Sprintf("%v", item.Key)
+		field_spec, _ := item.Value.(yaml.MapSlice)
+
+		field, err := self.convertInstance(kaitai_type, field_name, field_spec)
+		if err != nil {
+			self.unsupported("%v.%v: %v (instance skipped)", name, field_name, err)
+			continue
+		}
+		result.Fields = append(result.Fields, field)
+	}
+
+	self.definitions[name] = result
+	return result
+}
+
+func (self *kaitaiConverter) convertInstance(kaitai_type *kaitaiType,
+	field_name string, field_spec yaml.MapSlice) (*FieldDefinition, error) {
+
+	_, pres := ksyGet(field_spec, "io")
+	if pres {
+		return nil, fmt.Errorf("io is not supported")
+	}
+
+	value, pres := ksyGet(field_spec, "value")
+	if pres {
+		expression, err := translateKaitaiExpression(value, "x", "")
+		if err != nil {
+			return nil, err
+		}
+		return &FieldDefinition{
+			Name:    field_name,
+			Type:    "Value",
+			Options: ordereddict.NewDict().Set("value", "x=>"+expression),
+		}, nil
+	}
+
+	pos, pres := ksyGet(field_spec, "pos")
+	if !pres {
+		return nil, fmt.Errorf("instances require pos or value")
+	}
+
+	field, _, err := self.convertField(kaitai_type, field_name, field_spec)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, ok := to_int64(pos)
+	if ok {
+		field.Offset = offset
+		return field, nil
+	}
+
+	expression, err := translateKaitaiExpression(pos, "x", "")
+	if err != nil {
+		return nil, err
+	}
+	field.OffsetExpression = "x=>" + expression
+	return field, nil
+}
+
+var kaitaiFieldKeys = map[string]bool{
+	"id": true, "type": true, "size": true, "repeat": true,
+	"repeat-expr": true, "repeat-until": true, "enum": true,
+	"encoding": true, "contents": true, "terminator": true,
+	"consume": true, "include": true, "eos-error": true, "if": true,
+	"doc": true, "doc-ref": true, "pos": true, "-orig-id": true,
+}
+
+func (self *kaitaiConverter) convertField(kaitai_type *kaitaiType,
+	field_name string, field_spec yaml.MapSlice) (
+	*FieldDefinition, kaitaiSize, error) {
+	location := kaitai_type.name + "." + field_name
+
+	for _, item := range field_spec {
+		key := fmt.Sprintf("%v", item.Key)
+		if !kaitaiFieldKeys[key] && !strings.HasPrefix(key, "-webide") {
+			self.unsupported("%v: %v is not supported and was ignored",
+				location, key)
+		}
+	}
+
+	_, pres := ksyGet(field_spec, "if")
+	if pres {
+		self.unsupported("%v: if is not supported, the field is always parsed",
+			location)
+	}
+
+	type_name, options, size, err := self.convertElement(kaitai_type, field_spec)
+	if err != nil {
+		return nil, size, err
+	}
+
+	repeat, pres := ksyGet(field_spec, "repeat")
+	if pres {
+		array_options := ordereddict.NewDict().Set("type", type_name)
+		if options.Len() > 0 {
+			array_options.Set("type_options", options)
+		}
+
+		switch repeat {
+		case "expr":
+			count_spec, _ := ksyGet(field_spec, "repeat-expr")
+			count, ok := to_int64(count_spec)
+			if ok {
+				array_options.Set("count", count)
+				if count > 1000 {
+					array_options.Set("max_count", count)
+				}
+				if size.known {
+					size.size *= count
+				} else {
+					size = kaitaiSize{}
+				}
+
+			} else {
+				expression, err := translateKaitaiExpression(count_spec, "x", "")
+				if err != nil {
+					return nil, size, err
+				}
+				array_options.Set("count", "x=>"+expression)
+				if size.known {
+					size = kaitaiSize{expression: fmt.Sprintf(
+						"(%v) * %d", expression, size.size)}
+				} else {
+					size = kaitaiSize{}
+				}
+			}
+
+		case "until":
+			until, _ := ksyGet(field_spec, "repeat-until")
+			expression, err := translateKaitaiExpression(until, "this", "x")
+			if err != nil {
+				return nil, size, err
+			}
+			array_options.Set("count", 1000).
+				Set("sentinel", "x=>"+expression)
+			size = kaitaiSize{}
+			self.unsupported("%v: repeat-until does not include the terminating element",
+				location)
+
+		default:
+			return nil, size, fmt.Errorf("repeat: %v is not supported", repeat)
+		}
+
+		type_name = "Array"
+		options = array_options
+	}
+
+	result := &FieldDefinition{Name: field_name, Type: type_name}
+	if options.Len() > 0 {
+		result.Options = options
+	}
+	return result, size, nil
+}
+
+var (
+	kaitaiIntRegex   = regexp.MustCompile(`^([us])([1248])(le|be)?$`)
+	kaitaiFloatRegex = regexp.MustCompile(`^f([48])(le|be)?$`)
+)
+
+// Convert the type of a single element (i.e. ignoring repeat).
+func (self *kaitaiConverter) convertElement(
+	kaitai_type *kaitaiType, field_spec yaml.MapSlice) (
+	string, *ordereddict.Dict, kaitaiSize, error) {
+
+	options := ordereddict.NewDict()
+
+	// An explicit size overrides the size of the type.
+	size := kaitaiSize{}
+	size_spec, has_size := ksyGet(field_spec, "size")
+	if has_size {
+		value, ok := to_int64(size_spec)
+		if ok {
+			size = kaitaiSize{known: true, size: value}
+		} else {
+			expression, err := translateKaitaiExpression(size_spec, "x", "")
+			if err != nil {
+				return "", nil, size, err
+			}
+			size = kaitaiSize{expression: expression}
+		}
+	}
+
+	// The length option for strings.
+	var length interface{}
+	if size.known {
+		length = size.size
+	} else if size.expression != "" {
+		length = "x=>" + size.expression
+	}
+
+	contents, pres := ksyGet(field_spec, "contents")
+	if pres {
+		magic, err := kaitaiContents(contents)
+		if err != nil {
+			return "", nil, size, err
+		}
+		options.Set("length", len(magic)).
+			Set("term", "").
+			Set("byte_string", true)
+		return "String", options,
+			kaitaiSize{known: true, size: int64(len(magic))}, nil
+	}
+
+	type_spec, pres := ksyGet(field_spec, "type")
+	if !pres {
+		if !has_size {
+			return "", nil, size, fmt.Errorf("field requires a type or a size")
+		}
+		// Raw bytes
+		options.Set("length", length).
+			Set("term", "").
+			Set("byte_string", true)
+		return "String", options, size, nil
+	}
+
+	// Switch on the type
+	switch_spec, ok := type_spec.(yaml.MapSlice)
+	if ok {
+		selector, _ := ksyGet(switch_spec, "switch-on")
+		expression, err := translateKaitaiExpression(selector, "x", "")
+		if err != nil {
+			return "", nil, size, err
+		}
+
+		choices := ordereddict.NewDict()
+		for _, item := range ksyMap(switch_spec, "cases") {
+			key := fmt.Sprintf("%v", item.Key)
+			if key == "_" {
+				key = "default"
+			} else if strings.Contains(key, "::") {
+				// Enums are parsed into their names.
+				parts := strings.Split(key, "::")
+				key = parts[len(parts)-1]
+			} else {
+				value, err := strconv.ParseInt(key, 0, 64)
+				if err == nil {
+					key = fmt.Sprintf("%d", value)
+				}
+			}
+
+			case_type, _ := item.Value.(string)
+			choice, _, _, err := self.convertTypeName(kaitai_type, case_type)
+			if err != nil {
+				return "", nil, size, err
+			}
+			choices.Set(key, choice)
+		}
+
+		options.Set("selector", "x=>"+expression).Set("choices", choices)
+		return "Union", options, size, nil
+	}
+
+	type_string, _ := type_spec.(string)
+	switch type_string {
+	case "str", "strz":
+		encoding, _ := ksyGet(field_spec, "encoding")
+		if encoding == nil {
+			meta := ksyMap(kaitai_type.spec, "meta")
+			encoding, _ = ksyGet(meta, "encoding")
+		}
+
+		switch strings.ToUpper(fmt.Sprintf("%v", encoding)) {
+		case "UTF-16LE", "UTF16LE":
+			options.Set("encoding", "utf16")
+		case "ASCII", "UTF-8", "UTF8", "<NIL>":
+		default:
+			self.unsupported("%v: encoding %v is not supported, using utf8",
+				kaitai_type.name, encoding)
+		}
+
+		if length != nil {
+			options.Set("length", length)
+		}
+
+		terminator, pres := ksyGet(field_spec, "terminator")
+		if pres {
+			value, _ := to_int64(terminator)
+			options.Set("term_hex", fmt.Sprintf("%02x", value))
+
+		} else if type_string == "str" {
+			if length == nil {
+				return "", nil, size, fmt.Errorf("str requires a size")
+			}
+			options.Set("term", "")
+		}
+		return "String", options, size, nil
+	}
+
+	type_name, type_size, known, err := self.convertTypeName(kaitai_type, type_string)
+	if err != nil {
+		return "", nil, size, err
+	}
+
+	enum, pres := ksyGet(field_spec, "enum")
+	if pres {
+		enum_name := fmt.Sprintf("%v", enum)
+		choices, pres := self.findEnum(kaitai_type, enum_name)
+		if !pres {
+			return "", nil, size, fmt.Errorf("enum %v is not defined", enum_name)
+		}
+		options.Set("type", type_name).Set("choices", choices)
+		type_name = "Enumeration"
+	}
+
+	if !has_size && known {
+		size = kaitaiSize{known: true, size: type_size}
+	}
+
+	return type_name, options, size, nil
+}
+
+// Map a Kaitai type name to a vtypes type name and its size if known.
+func (self *kaitaiConverter) convertTypeName(
+	kaitai_type *kaitaiType, name string) (string, int64, bool, error) {
+	match := kaitaiIntRegex.FindStringSubmatch(name)
+	if match != nil {
+		size, _ := strconv.ParseInt(match[2], 0, 64)
+		endian := match[3]
+		if endian == "" {
+			endian = kaitai_type.endian
+		}
+
+		type_name := intTypeName(size, match[1] == "s")
+		if endian == "be" && size > 1 {
+			type_name += "be"
+		}
+		return type_name, size, true, nil
+	}
+
+	match = kaitaiFloatRegex.FindStringSubmatch(name)
+	if match != nil {
+		size, _ := strconv.ParseInt(match[1], 10, 64)
+		type_name := fmt.Sprintf("float%d", size*8)
+
+		endian := match[2]
+		if endian == "" {
+			endian = kaitai_type.endian
+		}
+		if endian == "be" {
+			type_name += "be"
+		}
+		return type_name, size, true, nil
+	}
+
+	// A user defined type, possibly with a path.
+	parts := strings.Split(name, "::")
+	name = parts[len(parts)-1]
+	_, pres := self.types[name]
+	if !pres {
+		return "", 0, false, fmt.Errorf("type %v is not supported", name)
+	}
+
+	// Recursive types have no static size.
+	if self.in_progress[name] {
+		return name, 0, false, nil
+	}
+
+	definition := self.convertType(name)
+	if definition.SizeExpression != "" {
+		return name, 0, false, nil
+	}
+	return name, int64(definition.Size), true, nil
+}
+
+func kaitaiContents(contents interface{}) ([]byte, error) {
+	switch t := contents.(type) {
+	case string:
+		return []byte(t), nil
+
+	case []interface{}:
+		var result []byte
+		for _, item := range t {
+			value, ok := to_int64(item)
+			if ok {
+				result = append(result, byte(value))
+				continue
+			}
+
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid contents %v", item)
+			}
+			result = append(result, []byte(str)...)
+		}
+		return result, nil
+	}
+	return nil, fmt.Errorf("invalid contents %v", contents)
+}
+
+var kaitaiTokenRegex = regexp.MustCompile(
+	`^(\s+|0[xX][0-9a-fA-F_]+|0[bB][01_]+|0[oO][0-7_]+|[0-9][0-9_]*|` +
+		`[a-zA-Z_][a-zA-Z0-9_]*|'[^']*'|"[^"]*"|::|==|!=|<=|>=|<<|>>|.)`)
+
+// Translate a Kaitai expression into a VQL expression. Fields are
+// accessed through the struct variable, while `_` (the current
+// element in repeat-until) is accessed through the element variable.
+func translateKaitaiExpression(
+	expression interface{}, struct_var, element_var string) (string, error) {
+
+	switch t := expression.(type) {
+	case string:
+	case nil:
+		return "", fmt.Errorf("missing expression")
+	default:
+		return fmt.Sprintf("%v", t), nil
+	}
+
+	input := expression.(string)
+	result := ""
+
+	// Set after an identifier or member access so the next . is a
+	// member access.
+	in_chain := false
+
+	for len(input) > 0 {
+		token := kaitaiTokenRegex.FindString(input)
+		input = input[len(token):]
+
+		switch {
+		case strings.TrimSpace(token) == "":
+			result += " "
+			continue
+
+		case token[0] >= '0' && token[0] <= '9':
+			clean := strings.ReplaceAll(strings.ToLower(token), "_", "")
+			clean = strings.Replace(clean, "0o", "0", 1)
+			if strings.HasPrefix(clean, "0b") {
+				value, err := strconv.ParseInt(clean[2:], 2, 64)
+				if err != nil {
+					return "", err
+				}
+				result += fmt.Sprintf("%d", value)
+			} else {
+				value, err := strconv.ParseInt(clean, 0, 64)
+				if err != nil {
+					return "", err
+				}
+				result += fmt.Sprintf("%d", value)
+			}
+			in_chain = false
+
+		case token[0] == '\'' || token[0] == '"':
+			result += token
+			in_chain = false
+
+		case token == ".":
+			if !in_chain {
+				return "", fmt.Errorf("unsupported expression %v", expression)
+			}
+			member := kaitaiTokenRegex.FindString(input)
+			input = input[len(member):]
+			switch member {
+			case "to_i", "to_s", "length", "size", "reverse", "first", "last",
+				"min", "max", "substring", "to_b", "as":
+				return "", fmt.Errorf("method %v is not supported in expression %v",
+					member, expression)
+			}
+			result += "." + member
+
+		case token == "::":
+			return "", fmt.Errorf("unsupported expression %v", expression)
+
+		case token == "==":
+			result += "="
+			in_chain = false
+
+		case token == "(" || token == ")" || token == "[" || token == "]" ||
+			token == "+" || token == "-" || token == "*" || token == "/" ||
+			token == "<" || token == ">" || token == "<=" || token == ">=" ||
+			token == "!=" || token == ",":
+			result += token
+			in_chain = token == ")" || token == "]"
+
+		case token == "and" || token == "or" || token == "not":
+			result += strings.ToUpper(token)
+			in_chain = false
+
+		case token == "true" || token == "false":
+			result += strings.ToUpper(token)
+			in_chain = false
+
+		case token == "_":
+			if element_var == "" {
+				return "", fmt.Errorf("_ can only be used in repeat-until")
+			}
+			result += element_var
+			in_chain = true
+
+		case token == "_parent":
+			result += struct_var + ".ParentOf"
+			in_chain = true
+
+		case token == "_root" || token == "_io" || token == "_index" ||
+			token == "_parent_io":
+			return "", fmt.Errorf("%v is not supported in expression %v",
+				token, expression)
+
+		case token[0] == '_' || (token[0] >= 'a' && token[0] <= 'z') ||
+			(token[0] >= 'A' && token[0] <= 'Z'):
+			// An enum constant - enums are parsed into their names.
+			if strings.HasPrefix(input, "::") {
+				for strings.HasPrefix(input, "::") {
+					input = input[2:]
+					token = kaitaiTokenRegex.FindString(input)
+					input = input[len(token):]
+				}
+				result += "'" + token + "'"
+				in_chain = false
+				continue
+			}
+			result += struct_var + "." + token
+			in_chain = true
+
+		default:
+			return "", fmt.Errorf("operator %v is not supported in expression %v",
+				token, expression)
+		}
+	}
+
+	return strings.TrimSpace(result), nil
+}
+
+func ksyGet(spec yaml.MapSlice, key string) (interface{}, bool) {
+	for _, item := range spec {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+func ksyMap(spec yaml.MapSlice, key string) yaml.MapSlice {
+	value, _ := ksyGet(spec, key)
+	result, _ := value.(yaml.MapSlice)
+	return result
+}
+
+func ksyString(spec yaml.MapSlice, key string) string {
+	value, _ := ksyGet(spec, key)
+	result, _ := value.(string)
+	return result
+}
@@ -0,0 +1,156 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestKaitaiDefinitions(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	ksy := `
+meta:
+  id: archive
+  endian: le
+seq:
+  - id: magic
+    contents: "ARC"
+  - id: version
+    type: u1
+  - id: num_entries
+    type: u2
+  - id: name_len
+    type: u2be
+  - id: name
+    type: str
+    size: name_len
+    encoding: ASCII
+  - id: entries
+    type: entry
+    repeat: expr
+    repeat-expr: num_entries
+  - id: values
+    type: u1
+    repeat: until
+    repeat-until: _ == 0
+instances:
+  total:
+    value: num_entries * 2
+  tail:
+    pos: 3
+    type: u1
+    enum: kind
+enums:
+  kind:
+    1: file
+    2: dir
+types:
+  entry:
+    seq:
+      - id: kind
+        type: u1
+        enum: kind
+      - id: body
+        type:
+          switch-on: kind
+          cases:
+            kind::file: file_body
+            kind::dir: dir_body
+  file_body:
+    seq:
+      - id: size
+        type: u2
+  dir_body:
+    seq:
+      - id: count
+        type: u1
+      - id: flags
+        type: b4
+`
+	unsupported, err := profile.ParseKaitaiDefinitions(ksy)
+	assert.NoError(t, err)
+
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	data := []byte("ARC\x01\x02\x00\x00\x03abc" +
+		"\x01\x10\x00" + // file entry, size 0x10
+		"\x02\x07" + // dir entry, count 7
+		"\x05\x06\x00")
+
+	scope := MakeScope()
+	reader := bytes.NewReader(data)
+	obj, err := profile.Parse(scope, "archive", reader, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "abc", Associative(scope, obj, "name"))
+	assert.Equal(t, int64(4), Associative(scope, obj, "total"))
+	assert.Equal(t, "file", Associative(scope, obj, "tail"))
+
+	serialized, err := json.MarshalIndent(obj, "", " ")
+	assert.NoError(t, err)
+
+	result := exported + "\nUnsupported:\n" + strings.Join(unsupported, "\n") +
+		"\n\nParsed:\n" + string(serialized) + "\n"
+	goldie.Assert(t, "TestKaitaiDefinitions", []byte(result))
+}
+
+// Nested types may define enums with the same name.
+func TestKaitaiNestedEnums(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	ksy := `
+meta:
+  id: container
+seq:
+  - id: first
+    type: first
+  - id: second
+    type: second
+  - id: outer
+    type: u1
+    enum: status
+enums:
+  status:
+    1: outer_one
+types:
+  first:
+    seq:
+      - id: status
+        type: u1
+        enum: status
+    enums:
+      status:
+        1: first_one
+  second:
+    seq:
+      - id: status
+        type: u1
+        enum: status
+      - id: other
+        type: u1
+        enum: first::status
+    enums:
+      status:
+        1: second_one
+`
+	unsupported, err := profile.ParseKaitaiDefinitions(ksy)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(unsupported))
+
+	obj, err := profile.Parse(MakeScope(), "container",
+		bytes.NewReader([]byte{1, 1, 1, 1}), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"first":{"status":"first_one"},"second":{"status":"second_one","other":"first_one"},"outer":"outer_one"}`,
+		string(serialized))
+}
@@ -0,0 +1,210 @@
+// Fields with an automatic offset ("auto" or no offset in the
+// definition) start at the end of the previous field. Structs which
+// set align or pack place them at their natural alignment like a C
+// compiler.
+
+package vtypes
+
+const autoOffset = "auto"
+
+func isPowerOfTwo(value int64) bool {
+	return value > 0 && value&(value-1) == 0
+}
+
+// The natural alignment of the parser: ints are aligned to their
+// size, arrays to their elements and structs to their most aligned
+// field.
+func alignOf(parser Parser, seen map[*StructParser]bool) int64 {
+	switch t := parser.(type) {
+	case *StructParser:
+		// Structs may contain themselves through arrays of
+		// variable count.
+		if seen[t] {
+			return 1
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		result := int64(1)
+		for _, field := range t.fields {
+			alignment := alignOf(field.parser, seen)
+			if alignment > result {
+				result = alignment
+			}
+		}
+		if t.pack > 0 && result > int64(t.pack) {
+			result = int64(t.pack)
+		}
+		return result
+
+	case *ArrayParser:
+		t.mu.Lock()
+		element := t.parser
+		t.mu.Unlock()
+
+		if element == nil {
+			element = lookupParser(t.profile,
+				t.options.Type, t.options.TypeOptions)
+		}
+		return alignOf(element, seen)
+
+	case *TypedefParser:
+		parser, _ := t.getParser()
+		return alignOf(parser, seen)
+
+	case *StringParser:
+		return 1
+	}
+
+	size := int64(fixedSize(parser))
+	if size <= 8 && isPowerOfTwo(size) {
+		return size
+	}
+	return 1
+}
+
+// The size of the field's parser if it is known before parsing.
+// Values do not take up any space.
+func layoutSize(parser Parser) (int64, bool) {
+	_, ok := parser.(*ValueParser)
+	if ok {
+		return 0, true
+	}
+
+	size := fixedSize(parser)
+	return int64(size), size > 0
+}
+
+func (self *StructParser) hasAutoOffsets() bool {
+	for _, field := range self.fields {
+		if field.definition != nil && field.definition.AutoOffset {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *StructParser) needsLayout() bool {
+	return self.hasAutoOffsets() || (self.auto_size && self.base != nil)
+}
+
+// Place the fields with an automatic offset and compute the size if
+// the definition did not give one. Returns true if anything changed.
+func (self *StructParser) layout() bool {
+	changed := false
+	pack := int64(self.pack)
+	aligned := self.align || pack > 0
+
+	// The end of the previous field if it is known before parsing.
+	var previous *ParseAtOffset
+	end := int64(0)
+	end_known := true
+
+	max_end := int64(0)
+	max_align := int64(1)
+	fixed := true
+	has_auto := false
+
+	for _, name := range self.field_names {
+		field := self.fields[name]
+
+		alignment := int64(1)
+		if aligned {
+			alignment = alignOf(field.parser, make(map[*StructParser]bool))
+			if pack > 0 && alignment > pack {
+				alignment = pack
+			}
+			if alignment > max_align {
+				max_align = alignment
+			}
+		}
+
+		// Inherited fields keep the layout of the base struct.
+		inherited := self.base != nil && self.base.fields[name] == field
+		if field.definition != nil && field.definition.AutoOffset && !inherited {
+			has_auto = true
+
+			offset := int64(0)
+			var dynamic_previous *ParseAtOffset
+			if end_known {
+				offset = alignUp(end, alignment)
+			} else {
+				dynamic_previous = previous
+			}
+
+			if field.offset != offset || field.previous != dynamic_previous ||
+				field.alignment != alignment {
+				changed = true
+			}
+			field.offset = offset
+			field.previous = dynamic_previous
+			field.alignment = alignment
+		}
+
+		size, ok := layoutSize(field.parser)
+		if ok && !field.isDynamic() {
+			end = field.offset + size
+			end_known = true
+			if end > max_end {
+				max_end = end
+			}
+		} else {
+			end_known = false
+			fixed = false
+		}
+		previous = field
+	}
+
+	if !self.auto_size {
+		return changed
+	}
+
+	size := 0
+	self.size_computed = false
+	switch {
+	case has_auto && fixed:
+		size = int(alignUp(max_end, max_align))
+		self.size_expression = nil
+		self.size_expression_source = ""
+		self.size_computed = true
+
+	case self.base != nil:
+		size = self.base.size
+		self.size_expression = self.base.size_expression
+		self.size_expression_source = self.base.size_expression_source
+	}
+
+	if size != self.size {
+		changed = true
+	}
+	self.size = size
+	return changed
+}
+
+// Lay out all the structs with automatic offsets. The size of a
+// struct may depend on the structs it contains so this is repeated
+// until nothing changes.
+func (self *Profile) layoutStructs() {
+	var structs []*StructParser
+	seen := make(map[*StructParser]bool)
+	for _, parser := range self.types {
+		struct_parser, ok := parser.(*StructParser)
+		if ok && !seen[struct_parser] && struct_parser.needsLayout() {
+			seen[struct_parser] = true
+			structs = append(structs, struct_parser)
+		}
+	}
+
+	for i := 0; i <= len(structs); i++ {
+		changed := false
+		for _, struct_parser := range structs {
+			if struct_parser.layout() {
+				changed = true
+			}
+		}
+
+		if !changed {
+			return
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestAutoOffsets(t *testing.T) {
+	for _, test_case := range []struct {
+		options string
+		offsets []int64
+		size    int
+	}{
+		// By default fields follow each other without padding.
+		{"", []int64{0, 1, 5, 9}, 11},
+		{`, {"align": true}`, []int64{0, 4, 8, 12}, 16},
+		{`, {"pack": 2}`, []int64{0, 2, 6, 10}, 12},
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(`[
+  ["Header", 0, [
+    ["Magic", "uint8"],
+    ["Length", "auto", "uint32"],
+    ["Name", "String", {"length": 4}],
+    ["Flags", "uint16"],
+  ]` + test_case.options + `],
+]`)
+		assert.NoError(t, err, test_case.options)
+
+		for i, field := range []string{"Magic", "Length", "Name", "Flags"} {
+			offset, err := profile.OffsetOf("Header", field)
+			assert.NoError(t, err)
+			assert.Equal(t, test_case.offsets[i], offset, test_case.options)
+		}
+
+		description, err := profile.Describe("Header")
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.size, description.Size, test_case.options)
+		assert.True(t, description.Fields[1].AutoOffset)
+	}
+}
+
+func TestAutoOffsetStructs(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	// Structs may be used before they are defined.
+	err := profile.ParseStructDefinitions(`
+[
+  ["Table", 0, [
+    ["Count", "uint8"],
+    ["Entries", "Array", {"type": "Entry", "count": 2}],
+    ["Name", "String", {"length": "x=>x.Count"}],
+    ["Terminator", "uint16"],
+  ], {"align": true}],
+  ["Entry", 0, [
+    ["Type", "uint8"],
+    ["Value", "uint32"],
+  ], {"align": true}],
+  ["LongEntry", 0, [
+    ["Extra", "uint64"],
+  ], {"extends": "Entry"}],
+]`)
+	assert.NoError(t, err)
+
+	for _, test_case := range []struct {
+		type_name string
+		size      int
+	}{
+		{"Entry", 8},
+		{"LongEntry", 16},
+		// The size depends on the string.
+		{"Table", 0},
+	} {
+		description, err := profile.Describe(test_case.type_name)
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.size, description.Size, test_case.type_name)
+	}
+
+	offset, err := profile.OffsetOf("Table", "Entries")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), offset)
+
+	// The terminator follows a string of variable length.
+	_, err = profile.OffsetOf("Table", "Terminator")
+	assert.Error(t, err)
+
+	data := []byte{
+		0x03, 0x00, 0x00, 0x00,
+		0x01, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00, 0x20, 0x00, 0x00, 0x00,
+		'a', 'b', 'c', 0x00, 0xff, 0xff,
+	}
+
+	obj, err := profile.Parse(MakeScope(), "Table", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Count":3,"Entries":[{"Type":1,"Value":16},{"Type":2,"Value":32}],"Name":"abc","Terminator":65535}`,
+		string(serialized))
+
+	// Automatic offsets and computed sizes are exported as they
+	// were defined.
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	assert.Contains(t, exported, `["Entry", 0, [
+    ["Type", "auto", "uint8"],`)
+	assert.Contains(t, exported, `], {"align": true}]`)
+
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		round_trip := NewProfile()
+		AddModel(round_trip)
+		err = round_trip.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		re_exported, err := round_trip.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, re_exported, format)
+	}
+
+	// Static offsets are compiled into Go code. Fields after the
+	// string are parsed at runtime.
+	code, err := profile.GenerateGo("generated")
+	assert.NoError(t, err)
+	assert.Contains(t, code, "offset+4")
+	assert.Contains(t, code, `self.vtypesRuntime.field("Table", reader, offset, "Terminator")`)
+}
+
+// Each field's offset is only worked out once per struct, so long
+// chains of variable sized fields parse quickly.
+func TestAutoOffsetChain(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	fields := []string{}
+	data := []byte{}
+	expected := ordereddict.NewDict()
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("Field%d", i)
+		fields = append(fields, fmt.Sprintf(
+			`["%s", "String", {"term": ";"}]`, name))
+		data = append(data, []byte(name+";")...)
+		expected.Set(name, name)
+	}
+
+	err := profile.ParseStructDefinitions(`[["Chain", 0, [` +
+		strings.Join(fields, ",") + `]]]`)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	obj, err := profile.Parse(MakeScope(), "Chain", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+
+	expected_json, _ := json.Marshal(expected)
+	assert.Equal(t, string(expected_json), string(serialized))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestAutoOffsetErrors(t *testing.T) {
+	for _, definitions := range []string{
+		`[["Header", 0, [["Value", "uint8"]], {"pack": 3}]]`,
+		`[["Header", 0, [["Value", "uint8"]], {"pack": true}]]`,
+		`[["Header", 0, [["Value", "uint8"]], {"align": "yes"}]]`,
+		`[["Header", 0, [["Value"]]]]`,
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(definitions)
+		assert.Error(t, err, definitions)
+	}
+}
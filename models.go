@@ -6,10 +6,19 @@ package vtypes
 
 import (
 	"encoding/binary"
+	"fmt"
 	"math"
+	"strings"
 )
 
-func AddModel(profile *Profile) {
+// Add the built in types to the profile. Fails once the profile is
+// compiled.
+func AddModel(profile *Profile) error {
+	err := profile.checkMutable()
+	if err != nil {
+		return fmt.Errorf("AddModel: %w", err)
+	}
+
 	profile.types["uint8"] = NewIntParser(
 		"uint8", 1, func(buf []byte) interface{} {
 			return uint64(uint8(buf[0]))
@@ -52,6 +61,28 @@ func AddModel(profile *Profile) {
 			return math.Float64frombits(bits)
 		})
 
+	profile.types["float32"] = NewIntParser(
+		"float32", 4, func(buf []byte) interface{} {
+			bits := binary.LittleEndian.Uint32(buf)
+			return float64(math.Float32frombits(bits))
+		})
+
+	profile.types["float32be"] = NewIntParser(
+		"float32be", 4, func(buf []byte) interface{} {
+			bits := binary.BigEndian.Uint32(buf)
+			return float64(math.Float32frombits(bits))
+		})
+
+	profile.types["float16"] = NewIntParser(
+		"float16", 2, func(buf []byte) interface{} {
+			return float16frombits(binary.LittleEndian.Uint16(buf))
+		})
+
+	profile.types["float16be"] = NewIntParser(
+		"float16be", 2, func(buf []byte) interface{} {
+			return float16frombits(binary.BigEndian.Uint16(buf))
+		})
+
 	profile.types["int8"] = NewIntParser(
 		"int8", 1, func(buf []byte) interface{} {
 			return int64(int8(buf[0]))
@@ -104,6 +135,23 @@ func AddModel(profile *Profile) {
 			return int64(binary.BigEndian.Uint64(buf))
 		})
 
+	profile.types["int16be"] = profile.types["int16b"]
+	profile.types["int32be"] = profile.types["int32b"]
+	profile.types["int64be"] = profile.types["int64b"]
+
+	// The generic ints follow the endian attribute of the struct or
+	// profile. The explicit little and big endian types do not.
+	for _, name := range []string{
+		"uint16", "uint32", "uint64", "int16", "int32", "int64",
+		"float16", "float32", "float64"} {
+		little := profile.types[name].(*IntParser)
+		profile.types[name+"le"] = NewIntParser(
+			name+"le", little.size, little.converter)
+
+		little.big_endian = profile.types[name+"be"].(*IntParser)
+		little.profile = profile
+	}
+
 	// Var ints like in protobufs.
 	profile.types["leb128"] = &Leb128Parser{}
 	profile.types["sleb128"] = &Sleb128Parser{}
@@ -130,4 +178,116 @@ func AddModel(profile *Profile) {
 	profile.types["unsigned long"] = profile.types["uint32"]
 	profile.types["unsigned long long"] = profile.types["uint64"]
 	profile.types["unsigned short"] = profile.types["uint16"]
+	profile.types["float"] = profile.types["float32"]
+	profile.types["double"] = profile.types["float64"]
+
+	return nil
+}
+
+// Decode an IEEE 754 half precision float. Like the other floats
+// the value is returned as a float64.
+func float16frombits(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1.0
+	}
+
+	exponent := int(bits>>10) & 0x1f
+	fraction := float64(bits & 0x3ff)
+	switch exponent {
+	// Zero and subnormal numbers.
+	case 0:
+		return sign * math.Ldexp(fraction, -24)
+
+	case 0x1f:
+		if fraction != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
+	}
+
+	return sign * math.Ldexp(fraction+0x400, exponent-25)
+}
+
+// The data model gives the sizes of the C types which differ between
+// platforms.
+type DataModel int
+
+const (
+	// 32 bit platforms: int, long and pointers are 32 bit.
+	ModelILP32 DataModel = iota + 1
+
+	// 64 bit Windows: long is 32 bit, pointers are 64 bit.
+	ModelLLP64
+
+	// 64 bit Linux and macOS: long and pointers are 64 bit.
+	ModelLP64
+)
+
+var dataModelNames = map[DataModel]string{
+	ModelILP32: "ILP32",
+	ModelLLP64: "LLP64",
+	ModelLP64:  "LP64",
+}
+
+func (self DataModel) String() string {
+	name, pres := dataModelNames[self]
+	if !pres {
+		return fmt.Sprintf("DataModel(%d)", int(self))
+	}
+	return name
+}
+
+// Find the data model by name (e.g. "LP64").
+func ParseDataModel(name string) (DataModel, error) {
+	for model, model_name := range dataModelNames {
+		if strings.EqualFold(name, model_name) {
+			return model, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown data model %v: should be ILP32, LLP64 or LP64",
+		name)
+}
+
+// Like AddModel() but the sizes of long, size_t and pointers follow
+// the data model. Pointer fields read addresses using the profile's
+// "pointer" type.
+func AddModelFor(profile *Profile, model DataModel) error {
+	var long_size, pointer_size int
+	switch model {
+	case ModelILP32:
+		long_size, pointer_size = 32, 32
+	case ModelLLP64:
+		long_size, pointer_size = 32, 64
+	case ModelLP64:
+		long_size, pointer_size = 64, 64
+	default:
+		return fmt.Errorf("AddModelFor: unknown data model %v", model)
+	}
+
+	err := AddModel(profile)
+	if err != nil {
+		return err
+	}
+
+	long := fmt.Sprintf("int%d", long_size)
+	for _, name := range []string{"long", "long int", "signed long"} {
+		profile.types[name] = profile.types[long]
+	}
+	for _, name := range []string{"unsigned long", "unsigned long int"} {
+		profile.types[name] = profile.types["u"+long]
+	}
+
+	pointer := fmt.Sprintf("int%d", pointer_size)
+	for _, name := range []string{"ssize_t", "intptr_t", "ptrdiff_t"} {
+		profile.types[name] = profile.types[pointer]
+	}
+	for _, name := range []string{"size_t", "uintptr_t", "pointer", "void *"} {
+		profile.types[name] = profile.types["u"+pointer]
+	}
+
+	profile.types["long long"] = profile.types["int64"]
+	profile.model = model
+
+	return nil
 }
@@ -0,0 +1,113 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDataModels(t *testing.T) {
+	definitions := `
+[
+  ["Header", 0, [
+    ["Long", 0, "unsigned long"],
+    ["Next", 4, "Pointer", {"type": "Target"}],
+  ]],
+  ["Target", 0, [
+    ["Value", 0, "uint8"],
+  ]],
+]`
+
+	data := []byte{
+		0x09, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00,
+		0x2a,
+	}
+
+	for _, test_case := range []struct {
+		model                     DataModel
+		long_size, pointer_size   int
+		long_value, next_expected string
+	}{
+		{ModelILP32, 4, 4, "9", `{"Value":42}`},
+		{ModelLLP64, 4, 8, "9", `{"Value":0}`},
+		{ModelLP64, 8, 8, "34359738377", `{"Value":0}`},
+	} {
+		profile := NewProfile()
+		err := AddModelFor(profile, test_case.model)
+		assert.NoError(t, err)
+
+		scope := MakeScope()
+		reader := bytes.NewReader(data)
+		assert.Equal(t, test_case.long_size,
+			profile.ObjectSize(scope, "long", reader, 0), test_case.model)
+		assert.Equal(t, test_case.pointer_size,
+			profile.ObjectSize(scope, "void *", reader, 0), test_case.model)
+		assert.Equal(t, test_case.pointer_size,
+			profile.ObjectSize(scope, "size_t", reader, 0), test_case.model)
+
+		err = profile.ParseStructDefinitions(definitions)
+		assert.NoError(t, err)
+
+		obj, err := profile.Parse(scope, "Header", reader, 0)
+		assert.NoError(t, err)
+
+		long, _ := obj.(*StructObject).Get("Long")
+		serialized, _ := json.Marshal(long)
+		assert.Equal(t, test_case.long_value, string(serialized), test_case.model)
+
+		// Only 32 bit pointers point at the target, 64 bit
+		// pointers point past the end of the data.
+		next, _ := obj.(*StructObject).Get("Next")
+		serialized, _ = json.Marshal(next)
+		assert.Equal(t, test_case.next_expected, string(serialized), test_case.model)
+	}
+
+	model, err := ParseDataModel("lp64")
+	assert.NoError(t, err)
+	assert.Equal(t, ModelLP64, model)
+	assert.Equal(t, "LP64", model.String())
+
+	_, err = ParseDataModel("LP32")
+	assert.Error(t, err)
+
+	err = AddModelFor(NewProfile(), DataModel(0))
+	assert.Error(t, err)
+}
+
+// The same C declarations give the layout of each platform.
+func TestCDefinitionsDataModels(t *testing.T) {
+	definition := `
+struct Record {
+    long Count;
+    void *Data;
+    size_t Length;
+    int Flags;
+};
+`
+
+	for _, test_case := range []struct {
+		model       DataModel
+		flags, size int64
+	}{
+		{ModelILP32, 12, 16},
+		{ModelLLP64, 24, 32},
+		{ModelLP64, 24, 32},
+	} {
+		profile := NewProfile()
+		err := AddModelFor(profile, test_case.model)
+		assert.NoError(t, err)
+
+		err = profile.ParseCDefinitions(definition)
+		assert.NoError(t, err)
+
+		offset, err := profile.OffsetOf("Record", "Flags")
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.flags, offset, test_case.model)
+
+		description, err := profile.Describe("Record")
+		assert.NoError(t, err)
+		assert.Equal(t, int(test_case.size), description.Size, test_case.model)
+	}
+}
@@ -265,3 +265,17 @@ func maybeGetParser(
 
 	return parser, nil
 }
+
+// Look up a parser which was not known when the field was built. A
+// NullParser is substituted when the type is not known at parse time
+// and is looked up again here too. Other parsers are returned as they
+// are.
+func resolveParser(parser Parser, profile *Profile,
+	type_name string, options *ordereddict.Dict) (Parser, error) {
+	_, is_null := parser.(NullParser)
+	if parser != nil && !is_null {
+		return parser, nil
+	}
+
+	return profile.GetParser(type_name, options)
+}
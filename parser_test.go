@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"strings"
 	"testing"
@@ -63,6 +64,74 @@ func TestIntegerParser(t *testing.T) {
 	assert.Equal(t, uint64(0x0807060504030201), obj)
 }
 
+func TestFloatParser(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	for _, test_case := range []struct {
+		type_name string
+		data      []byte
+		expected  float64
+	}{
+		{"float32", []byte{0x00, 0x00, 0xc0, 0x3f}, 1.5},
+		{"float32be", []byte{0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{"float", []byte{0x00, 0x00, 0x20, 0xc1}, -10},
+		{"double", []byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f}, 1.5},
+		{"float16", []byte{0x00, 0x3e}, 1.5},
+		{"float16be", []byte{0xc0, 0x00}, -2},
+		{"float16le", []byte{0xff, 0x7b}, 65504},
+		{"float16", []byte{0x00, 0x7c}, math.Inf(1)},
+		// Subnormal numbers
+		{"float16", []byte{0x01, 0x00}, 5.960464477539063e-08},
+	} {
+		obj, err := profile.Parse(MakeScope(), test_case.type_name,
+			bytes.NewReader(test_case.data), 0)
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.expected, obj, test_case.type_name)
+	}
+
+	obj, err := profile.Parse(MakeScope(), "float16", bytes.NewReader([]byte{0x01, 0x7e}), 0)
+	assert.NoError(t, err)
+	assert.True(t, math.IsNaN(obj.(float64)))
+
+	// Floats follow the endian of the struct like the other generic
+	// types and C declarations may use float and double.
+	err = profile.ParseCDefinitions(`struct Point { float x; double y; };`)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(`
+[
+  ["Reading", 0, [
+    ["Value", 0, "float32"],
+    ["Half", 4, "float16"],
+  ], {"endian": "big"}],
+]`)
+	assert.NoError(t, err)
+
+	obj, err = profile.Parse(MakeScope(), "Reading",
+		bytes.NewReader([]byte{0x3f, 0xc0, 0x00, 0x00, 0x3e, 0x00}), 0)
+	assert.NoError(t, err)
+	serialized, _ := json.Marshal(obj)
+	assert.Equal(t, `{"Value":1.5,"Half":1.5}`, string(serialized))
+
+	offset, err := profile.OffsetOf("Point", "y")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), offset)
+
+	// Go float32 fields use the float32 parser.
+	type goFloat struct {
+		Value float32
+	}
+	go_profile, err := ProfileFromGoTypes(goFloat{})
+	assert.NoError(t, err)
+
+	obj, err = go_profile.Parse(MakeScope(), "goFloat",
+		bytes.NewReader([]byte{0x00, 0x00, 0xc0, 0x3f}), 0)
+	assert.NoError(t, err)
+	serialized, _ = json.Marshal(obj)
+	assert.Equal(t, `{"Value":1.5}`, string(serialized))
+}
+
 func TestLeb128Parser(t *testing.T) {
 	reader := bytes.NewReader(sample)
 	profile := NewProfile()
@@ -173,7 +242,7 @@ func TestArrayParserError(t *testing.T) {
 	assert.Error(t, err)
 
 	assert.Contains(t, err.Error(),
-		"struct TestStruct field 'Field1': ArrayParser: field max_count: Expecting an integer not string")
+		"line 4 column 6: struct TestStruct field 0 'Field1': ArrayParser: field max_count: Expecting an integer not string")
 }
 
 func TestArrayParser(t *testing.T) {
@@ -714,3 +783,423 @@ func TestErrors(t *testing.T) {
 
 	goldie.Assert(t, "TestErrors", []byte(golden))
 }
+
+func TestOverlay(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	scope := MakeScope()
+	scope.SetLogger(log.New(os.Stderr, " ", 0))
+
+	definition := `
+[
+  ["TestStruct", 4, [
+     ["Field1", 0, "uint8"],
+     ["Field2", 1, "uint8"],
+     ["Field3", 2, "uint16"],
+  ]]
+]
+`
+	err := profile.ParseStructDefinitions(definition)
+	assert.NoError(t, err)
+
+	// Redefining the struct is an error.
+	err = profile.ParseStructDefinitions(definition)
+	assert.Error(t, err)
+
+	// Move Field2, change the type of Field3 and add a new field.
+	overlay := `
+[
+  ["TestStruct", 8, [
+     ["Field2", 4, "uint8"],
+     ["Field3", 2, "uint16be"],
+     ["Field4", 6, "Second"],
+  ]],
+  ["Second", 2, [
+     ["SecondField1", 1, "uint8"],
+  ]]
+]
+`
+	err = profile.ApplyOverlay(overlay)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader(sample)
+	obj, err := profile.Parse(scope, "TestStruct", reader, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(0x01), Associative(scope, obj, "Field1"))
+	assert.Equal(t, uint64(0x05), Associative(scope, obj, "Field2"))
+	assert.Equal(t, uint64(0x0304), Associative(scope, obj, "Field3"))
+	assert.Equal(t, uint64(0x08), Associative(scope, obj, "Field4.SecondField1"))
+	assert.Equal(t, 8, SizeOf(obj))
+
+	// Field order is preserved with new fields at the end.
+	assert.Equal(t, []string{"Field1", "Field2", "Field3", "Field4"},
+		StructAssociative{}.GetMembers(scope, obj))
+
+	// Overlays only apply to structs.
+	err = profile.ApplyOverlay(`[["uint8", 0, []]]`)
+	assert.Error(t, err)
+
+	// A failing overlay leaves the profile unchanged, even the parts
+	// before the error.
+	err = profile.ApplyOverlay(`
+constants:
+  Version: 2
+structs:
+  - [TestStruct, 16, [
+      [Field1, 1, uint16],
+      [Field5, 0, uint8],
+    ]]
+  - [Third, 1, []]
+  - [Second, 0, [
+      [SecondField2, 0, Missing],
+    ]]
+`)
+	assert.Error(t, err)
+
+	obj, err = profile.Parse(scope, "TestStruct", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x01), Associative(scope, obj, "Field1"))
+	assert.Equal(t, 8, SizeOf(obj))
+	assert.Equal(t, []string{"Field1", "Field2", "Field3", "Field4"},
+		StructAssociative{}.GetMembers(scope, obj))
+
+	_, err = profile.Describe("Third")
+	assert.Error(t, err)
+	_, pres := profile.Constants().Get("Version")
+	assert.False(t, pres)
+}
+
+func TestExtends(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	scope := MakeScope()
+	scope.SetLogger(log.New(os.Stderr, " ", 0))
+
+	// The derived struct may appear before its base.
+	definition := `
+[
+  ["RecordV2", 0, [
+     ["Field2", 4, "uint16"],
+     ["Field3", 6, "uint8"],
+  ], {"extends": "Record"}],
+  ["Record", 8, [
+     ["Field1", 0, "uint8"],
+     ["Field2", 1, "uint8"],
+  ]],
+]
+`
+	err := profile.ParseStructDefinitions(definition)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader(sample)
+	obj, err := profile.Parse(scope, "RecordV2", reader, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(0x01), Associative(scope, obj, "Field1"))
+	assert.Equal(t, uint64(0x0605), Associative(scope, obj, "Field2"))
+	assert.Equal(t, uint64(0x07), Associative(scope, obj, "Field3"))
+	assert.Equal(t, 8, SizeOf(obj))
+	assert.Equal(t, []string{"Field1", "Field2", "Field3"},
+		StructAssociative{}.GetMembers(scope, obj))
+
+	// The base struct is not changed.
+	obj, err = profile.Parse(scope, "Record", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x02), Associative(scope, obj, "Field2"))
+
+	// The JSON decoder accepts the options too.
+	var definitions []*StructDefinition
+	err = json.Unmarshal([]byte(`[["B", 0, [], {"extends": "A"}]]`), &definitions)
+	assert.NoError(t, err)
+	assert.Equal(t, "A", definitions[0].Extends)
+
+	for _, bad := range []string{
+		`[["A", 0, [], {"extends": "Undefined"}]]`,
+		`[["A", 0, [], {"extends": "B"}], ["B", 0, [], {"extends": "A"}]]`,
+		`[["A", 0, [], {"extends": "uint8"}]]`,
+		`[["A", 0, [], {"unknown": "B"}]]`,
+	} {
+		err = NewProfile().ParseStructDefinitions(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+// Overlays on a base struct reach the structs extending it.
+func TestExtendsOverlay(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(`
+[
+  ["Base", 8, [
+     ["A", 1, "uint8"],
+     ["B", 2, "uint8"],
+  ]],
+  ["Derived", 0, [
+     ["B", 3, "uint8"],
+  ], {"extends": "Base"}],
+  ["Derived2", 0, [], {"extends": "Derived"}],
+]
+`)
+	assert.NoError(t, err)
+
+	err = profile.ApplyOverlay(`
+[
+  ["Base", 0, [
+     ["A", 4, "uint8"],
+     ["C", 5, "uint8"],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	for _, test_case := range []struct {
+		type_name, field string
+		offset           int64
+	}{
+		{"Base", "A", 4},
+		{"Derived", "A", 4},
+		{"Derived2", "A", 4},
+		{"Derived", "C", 5},
+		{"Derived2", "C", 5},
+
+		// Fields of the derived struct are kept.
+		{"Base", "B", 2},
+		{"Derived", "B", 3},
+		{"Derived2", "B", 3},
+	} {
+		offset, err := profile.OffsetOf(test_case.type_name, test_case.field)
+		assert.NoError(t, err)
+		assert.Equal(t, test_case.offset, offset,
+			test_case.type_name+"."+test_case.field)
+	}
+
+	obj, err := profile.Parse(MakeScope(), "Derived2", bytes.NewReader(sample), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"A":5,"B":4,"C":6}`, string(serialized))
+}
+
+func TestNamespaces(t *testing.T) {
+	scope := MakeScope()
+	scope.SetLogger(log.New(os.Stderr, " ", 0))
+
+	// Both profiles define a Header struct.
+	ntfs := NewNamedProfile("ntfs")
+	AddModel(ntfs)
+	err := ntfs.ParseStructDefinitions(`
+[
+  ["Header", 2, [
+     ["Field1", 0, "uint8"],
+     ["Self", 0, "Pointer", {"type": "ntfs::Header"}],
+  ]],
+  ["Record", 4, [
+     ["Header", 0, "Header"],
+  ]],
+]
+`)
+	assert.NoError(t, err)
+
+	registry := NewNamedProfile("registry")
+	AddModel(registry)
+
+	// Types from ntfs can not be used before it is imported.
+	definition := `
+[
+  ["Header", 8, [
+     ["Field1", 0, "uint16be"],
+     ["Record", 2, "ntfs::Record"],
+     ["Records", 2, "Array", {"type": "ntfs::Header", "count": 2}],
+     ["Choice", 4, "Union", {
+        "selector": "x=>x.Field1",
+        "choices": {"258": "ntfs::Header", "default": "Header"}}],
+     ["Profile", 0, "Profile", {"type": "ntfs::Record", "offset": "x=>6"}],
+  ]],
+]
+`
+	other := NewNamedProfile("other")
+	AddModel(other)
+	err = other.ParseStructDefinitions(definition)
+	assert.Error(t, err)
+
+	assert.NoError(t, registry.Import("ntfs", ntfs))
+	err = registry.ParseStructDefinitions(definition)
+	assert.NoError(t, err)
+
+	reader := bytes.NewReader(sample)
+	obj, err := registry.Parse(scope, "Header", reader, 0)
+	assert.NoError(t, err)
+
+	assert.Equal(t, uint64(0x0102), Associative(scope, obj, "Field1"))
+
+	// ntfs::Record refers to ntfs' own Header.
+	assert.Equal(t, uint64(0x03), Associative(scope, obj, "Record.Header.Field1"))
+	assert.Equal(t, uint64(0x05), Associative(scope, obj, "Choice.Field1"))
+	assert.Equal(t, uint64(0x07), Associative(scope, obj, "Profile.Header.Field1"))
+	assert.Equal(t, []vfilter.Any{uint64(0x03), uint64(0x05)},
+		Associative(scope, obj, "Records.Field1"))
+
+	// Qualified names may also be parsed directly.
+	obj, err = registry.Parse(scope, "ntfs::Header", reader, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x01), Associative(scope, obj, "Field1"))
+
+	// Names qualified with the profile's own namespace.
+	obj, err = ntfs.Parse(scope, "ntfs::Record", reader, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0x03), Associative(scope, obj, "Header.Field1"))
+
+	_, err = registry.Parse(scope, "unknown::Header", reader, 0)
+	assert.Error(t, err)
+
+	assert.Error(t, registry.Import("", ntfs))
+	assert.Error(t, registry.Import("a::b", ntfs))
+	assert.Error(t, registry.Import("registry", ntfs))
+	assert.Error(t, registry.Import("ntfs", NewProfile()))
+	assert.Error(t, registry.Import("self", registry))
+
+	// Referring to other profiles does not make their types unused
+	// or undefined.
+	for _, diagnostic := range registry.Validate() {
+		assert.NotEqual(t, DiagnosticError, diagnostic.Level, diagnostic.String())
+	}
+}
+
+func TestExportDefinitions(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	definition := `
+[
+  ["Header", 0, [
+    ["Signature", 0, "String", {"length": 13}],
+    ["CountOfEntries", 14, "uint32"],
+    ["Entries", 18, "Array", {"type": "Entry", "count": "x=>x.CountOfEntries"}]
+  ]],
+
+  ["Entry", "x=>x.Func.SizeOf + x.ModuleLength + 20", [
+    ["TimestampTicks", 0, "uint64"],
+    ["ModuleLength", 8, "uint32"],
+    ["Flags", 12, "Flags", {
+       type: "BitField",
+       type_options: {type: "uint8", start_bit: 4, end_bit: 8},
+       bitmap: {"First": 1, "Second": 2},
+    }],
+    ["CommandCount", "x=>x.ModuleLength + 12", "uint32"],
+  ]],
+
+  ["EntryV2", 0, [
+    ["Extra", 40, "uint8"],
+  ], {"extends": "Entry"}]
+]
+`
+	err := profile.ParseStructDefinitions(definition)
+	assert.NoError(t, err)
+
+	err = profile.ApplyOverlay(`[["Header", 40, [["CountOfEntries", 16, "uint32"]]]]`)
+	assert.NoError(t, err)
+
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+
+	goldie.Assert(t, "TestExportDefinitions", []byte(exported))
+
+	// Both formats round trip to the same definitions.
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		new_profile := NewProfile()
+		AddModel(new_profile)
+		err = new_profile.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		round_trip, err := new_profile.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, round_trip, format)
+	}
+
+	_, err = profile.ExportDefinitions("xml")
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	definition := `
+[
+  ["Header", 8, [
+    ["Magic", 0, "uint32"],
+    ["Length", 2, "uint32"],
+    ["LowByte", 0, "uint8"],
+    ["Extra", 6, "uint32"],
+    ["Entries", "x=>x.Lenght", "Array", {
+        type: "Entry",
+        count: "x=>x.Count",
+        sentinel: "x=>x.Foo = this.Magic",
+    }],
+    ["Missing", 0, "Array", {type: "Undefined"}],
+    ["MissingNested", 0, "Array", {
+       type: "Enumeration",
+       type_options: {type: "Undefined"},
+    }],
+    ["Choice", 0, "Union", {
+       selector: "x=>x.Magic",
+       choices: {"1": "Entry", "2": "Undefined"},
+    }],
+    ["Ptr", 0, "Pointer", {type: "Undefined"}],
+  ]],
+  ["Entry", "x=>x.Size + 1", [
+    ["Size", 0, "uint8"],
+  ]],
+  ["Unused", 0, [
+    ["Value", "x=>x.SizeOf", "uint8"],
+    ["Name", 0, "String", {
+       length: "x=>if(condition=x.Value = 'x.Missing', then=1, else=2)",
+    }],
+    ["Parenthesized", "x=>(x).Vaule", "uint8"],
+  ]],
+]
+`
+	err := profile.ParseStructDefinitions(definition)
+	assert.NoError(t, err)
+
+	golden := ""
+	for _, diagnostic := range profile.Validate() {
+		golden += diagnostic.String() + "\n"
+	}
+
+	goldie.Assert(t, "TestValidate", []byte(golden))
+}
+
+// Validate() walks vfilter's unexported lambda AST by reflection.
+// This pins the shape of the AST it relies on: if vfilter changes it
+// the members are no longer known.
+func TestLambdaMembers(t *testing.T) {
+	for _, test_case := range []struct {
+		expression string
+		expected   []string
+	}{
+		{"x=>x.Field", []string{"Field"}},
+		{"x=>x.`@Field`.Other", []string{"Field"}},
+		{"x=>(x).Field", []string{"Field"}},
+		{"x=>((x)).Field + 1", []string{"Field"}},
+		{"x=>len(list=x.List) + this.Count", []string{"List", "Count"}},
+		{"x=>if(condition=x.A = 1, then=x.B, else=NOT x.C)", []string{"A", "B", "C"}},
+		{"x=>y.Field + 'x.Quoted'", nil},
+		{"x=>(x + 1).Field", nil},
+	} {
+		lambda, err := vfilter.ParseLambda(test_case.expression)
+		assert.NoError(t, err)
+
+		members, ok := lambdaMembers(lambda, []string{"x", "this"})
+		assert.True(t, ok, test_case.expression)
+		assert.Equal(t, test_case.expected, members, test_case.expression)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -20,6 +21,14 @@ type PointerParser struct {
 	options PointerParserOptions
 	profile *Profile
 	parser  Parser
+
+	// Reads the address. If the profile defines a "pointer" type we
+	// use it, otherwise addresses are 64 bit little endian.
+	address_parser Parser
+
+	// Protects parser which may be filled in by concurrent calls to
+	// Parse()
+	mu sync.Mutex
 }
 
 func (self *PointerParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -41,6 +50,11 @@ func (self *PointerParser) New(profile *Profile, options *ordereddict.Dict) (Par
 	}
 	result.parser = parser
 
+	address_parser, pres := profile.types["pointer"]
+	if pres {
+		result.address_parser = address_parser
+	}
+
 	return result, nil
 }
 
@@ -48,27 +62,76 @@ func (self *PointerParser) Parse(
 	scope vfilter.Scope,
 	reader io.ReaderAt, offset int64) interface{} {
 
+	address, ok := self.readAddress(scope, reader, offset)
+	if !ok {
+		return vfilter.Null{}
+	}
+
+	return self.getParser(scope).Parse(scope, reader, int64(address))
+}
+
+// The target type may be defined after the pointer so the parser is
+// resolved on first use.
+func (self *PointerParser) getParser(scope vfilter.Scope) Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
 	if self.parser == nil {
-		parser, err := self.profile.GetParser(
-			self.options.Type, self.options.TypeOptions)
+		err := self.resolve()
 		if err != nil {
 			scope.Log("ERROR:binary_parser: PointerParser: %v", err)
 			self.parser = NullParser{}
-			return vfilter.Null{}
 		}
+	}
+
+	return self.parser
+}
 
-		// Cache the parser for next time.
-		self.parser = parser
+// Must be called with the lock held.
+func (self *PointerParser) resolve() error {
+	parser, err := resolveParser(self.parser, self.profile,
+		self.options.Type, self.options.TypeOptions)
+	if err != nil {
+		return err
+	}
+
+	// Cache the parser for next time.
+	self.parser = parser
+	return nil
+}
+
+func (self *PointerParser) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return []Parser{self.parser}, nil
+}
+
+func (self *PointerParser) readAddress(scope vfilter.Scope,
+	reader io.ReaderAt, offset int64) (uint64, bool) {
+	if self.address_parser != nil {
+		address, ok := to_int64(self.address_parser.Parse(scope, reader, offset))
+		return uint64(address), ok
 	}
 
 	buf := make([]byte, 8)
 
 	n, err := reader.ReadAt(buf, offset)
 	if n == 0 || (err != nil && !errors.Is(err, io.EOF)) {
-		return vfilter.Null{}
+		return 0, false
 	}
 
-	address := binary.LittleEndian.Uint64(buf)
+	return binary.LittleEndian.Uint64(buf), true
+}
 
-	return self.parser.Parse(scope, reader, int64(address))
+func (self *PointerParser) typeReferences() []typeReference {
+	return []typeReference{{
+		option:    "type",
+		type_name: self.options.Type,
+		options:   self.options.TypeOptions,
+	}}
 }
@@ -4,6 +4,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"github.com/Velocidex/yaml/v2"
@@ -19,11 +21,87 @@ type FieldDefinition struct {
 	// Alternatively offset may be given as an expression.
 	OffsetExpression string
 
+	// The field is placed after the previous field. Written as an
+	// "auto" offset or by omitting the offset.
+	AutoOffset bool
+
 	// Name of the type of parser in this field.
 	Type string
 
 	// Options to the type
 	Options *ordereddict.Dict
+
+	// Documentation and free form tags. Definitions with these are
+	// written in the keyed form.
+	Doc  string
+	Tags []string
+}
+
+// The offset is serialized either as an int or an expression.
+func (self *FieldDefinition) offsetValue() interface{} {
+	if self.AutoOffset {
+		return autoOffset
+	}
+	if self.OffsetExpression != "" {
+		return self.OffsetExpression
+	}
+	return self.Offset
+}
+
+func (self *FieldDefinition) tuple() []interface{} {
+	result := []interface{}{self.Name, self.offsetValue(), self.Type}
+	if self.Options != nil && self.Options.Len() > 0 {
+		result = append(result, self.Options)
+	}
+	return result
+}
+
+// The tuple has no place for the documentation and tags.
+func (self *FieldDefinition) isKeyed() bool {
+	return self.Doc != "" || len(self.Tags) > 0
+}
+
+func (self *FieldDefinition) keyed() *ordereddict.Dict {
+	result := ordereddict.NewDict().Set("name", self.Name)
+	if !self.AutoOffset {
+		result.Set("offset", self.offsetValue())
+	}
+	result.Set("type", self.Type)
+	if self.Options != nil && self.Options.Len() > 0 {
+		result.Set("options", self.Options)
+	}
+	return setDocAndTags(result, self.Doc, self.Tags)
+}
+
+// The keyed form has no required positions so check that the
+// required keys are present.
+func (self *FieldDefinition) checkKeyed() error {
+	if self.Name == "" {
+		return errors.New("field name is required")
+	}
+	if self.Type == "" {
+		return errors.New("field type is required")
+	}
+	return nil
+}
+
+// Fields are serialized as a tuple unless they need the keyed form.
+func (self *FieldDefinition) value() interface{} {
+	if self.isKeyed() {
+		return self.keyed()
+	}
+	return self.tuple()
+}
+
+func setDocAndTags(
+	result *ordereddict.Dict, doc string, tags []string) *ordereddict.Dict {
+	if doc != "" {
+		result.Set("doc", doc)
+	}
+	if len(tags) > 0 {
+		result.Set("tags", tags)
+	}
+	return result
 }
 
 type StructDefinition struct {
@@ -31,26 +109,321 @@ type StructDefinition struct {
 	Size           int
 	SizeExpression string
 	Fields         []*FieldDefinition
+
+	// The name of a struct this struct inherits its fields from.
+	Extends string
+
+	// The byte order of generic ints: little, big or a lambda.
+	Endian string
+
+	// Place fields with an automatic offset at their natural
+	// alignment. Pack limits the alignment like #pragma pack and
+	// implies Align.
+	Align bool
+	Pack  int
+
+	// Documentation and free form tags. Definitions with these are
+	// written in the keyed form.
+	Doc  string
+	Tags []string
+}
+
+// The size is serialized either as an int or an expression.
+func (self *StructDefinition) sizeValue() interface{} {
+	if self.SizeExpression != "" {
+		return self.SizeExpression
+	}
+	return self.Size
+}
+
+func (self *StructDefinition) options() *ordereddict.Dict {
+	result := ordereddict.NewDict()
+	if self.Extends != "" {
+		result.Set("extends", self.Extends)
+	}
+	if self.Endian != "" {
+		result.Set("endian", self.Endian)
+	}
+	if self.Align {
+		result.Set("align", true)
+	}
+	if self.Pack != 0 {
+		result.Set("pack", self.Pack)
+	}
+	return result
+}
+
+func (self *StructDefinition) tuple() []interface{} {
+	result := []interface{}{self.Name, self.sizeValue(), self.Fields}
+	options := self.options()
+	if options.Len() > 0 {
+		result = append(result, options)
+	}
+	return result
+}
+
+func (self *StructDefinition) isKeyed() bool {
+	return self.Doc != "" || len(self.Tags) > 0
+}
+
+// The keyed form without the fields. The struct options are keys of
+// the map.
+func (self *StructDefinition) keyedHeader() *ordereddict.Dict {
+	result := ordereddict.NewDict().
+		Set("name", self.Name).
+		Set("size", self.sizeValue())
+
+	options := self.options()
+	for _, k := range options.Keys() {
+		v, _ := options.Get(k)
+		result.Set(k, v)
+	}
+	return setDocAndTags(result, self.Doc, self.Tags)
+}
+
+func (self *StructDefinition) value() interface{} {
+	if self.isKeyed() {
+		return self.keyedHeader().Set("fields", self.Fields)
+	}
+	return self.tuple()
+}
+
+// Struct definitions may have an optional options map as their 4th
+// element.
+func (self *StructDefinition) setOptions(options *ordereddict.Dict) error {
+	for _, k := range options.Keys() {
+		v, _ := options.Get(k)
+		switch k {
+		case "extends":
+			extends, ok := v.(string)
+			if !ok {
+				return errors.New("extends should be a struct name")
+			}
+			self.Extends = extends
+
+		case "endian":
+			endian, ok := v.(string)
+			if !ok {
+				return errors.New("endian should be a string")
+			}
+			err := checkEndian(endian)
+			if err != nil {
+				return err
+			}
+			self.Endian = endian
+
+		case "align":
+			align, ok := v.(bool)
+			if !ok {
+				return errors.New("align should be true or false")
+			}
+			self.Align = align
+
+		case "pack":
+			_, is_bool := v.(bool)
+			pack, ok := to_int64(v)
+			if is_bool || !ok || !isPowerOfTwo(pack) {
+				return errors.New("pack should be a power of two")
+			}
+			self.Pack = int(pack)
+
+		default:
+			return fmt.Errorf("Unknown struct option %v", k)
+		}
+	}
+	return nil
 }
 
+// A profile document. Documents are either a list of struct
+// definitions or a map with the sections:
+//
+//	endian: The byte order of generic ints (little or big).
+//	constants: A map of constants visible to all lambdas.
+//	typedefs: A list of typedef definitions.
+//	structs: A list of struct definitions.
+type ProfileDefinitions struct {
+	Endian    string
+	Constants *ordereddict.Dict
+	Typedefs  []*TypedefDefinition
+	Structs   []*StructDefinition
+}
+
+// The sections a profile document may have.
+var profileSections = map[string]bool{
+	"endian":    true,
+	"constants": true,
+	"typedefs":  true,
+	"structs":   true,
+}
+
+// Documents with only structs are a plain list of structs.
+func (self *ProfileDefinitions) hasSections() bool {
+	return len(self.Typedefs) > 0 || self.Endian != "" ||
+		(self.Constants != nil && self.Constants.Len() > 0)
+}
+
+func checkProfileSections(sections []string) error {
+	for _, section := range sections {
+		if !profileSections[section] {
+			return fmt.Errorf("Unknown profile section %v", section)
+		}
+	}
+	return nil
+}
+
+// Documents without typedefs or constants are written as a list of
+// structs like before sections were supported.
+func (self *ProfileDefinitions) document() interface{} {
+	if !self.hasSections() {
+		return self.Structs
+	}
+
+	result := ordereddict.NewDict()
+	if self.Endian != "" {
+		result.Set("endian", self.Endian)
+	}
+	if self.Constants != nil && self.Constants.Len() > 0 {
+		result.Set("constants", self.Constants)
+	}
+	if len(self.Typedefs) > 0 {
+		result.Set("typedefs", self.Typedefs)
+	}
+	return result.Set("structs", self.Structs)
+}
+
+// Separates the namespace from the type name in qualified type
+// references, e.g. "ntfs::FILE_RECORD".
+const NamespaceSeparator = "::"
+
+// A Profile may be shared by many goroutines parsing at the same
+// time. Definitions must not be added while the profile is in use.
 type Profile struct {
+	// The profile's own namespace. May be empty.
+	name string
+
 	types map[string]Parser
+
+	// Other profiles whose types may be referred to as
+	// namespace::type.
+	imports map[string]*Profile
+
+	// Values visible to all lambdas by name.
+	constants *ordereddict.Dict
+
+	// The byte order of generic ints. Empty for little endian.
+	endian string
+
+	// Set once the profile or one of its structs has a byte order.
+	// Until then generic ints do not look it up in the scope.
+	has_endian bool
+
+	// Set by AddModelFor(). Zero for the types from AddModel().
+	model DataModel
+
+	// Protects compiled.
+	mu sync.Mutex
+
+	// Set by Compile()
+	compiled bool
 }
 
 func NewProfile() *Profile {
 	result := Profile{
-		types: make(map[string]Parser),
+		types:     make(map[string]Parser),
+		imports:   make(map[string]*Profile),
+		constants: ordereddict.NewDict(),
 	}
 
 	return &result
 }
 
-func (self *Profile) AddParser(type_name string, parser Parser) {
+// Create a profile with its own namespace. Types in the profile may
+// refer to each other either by their plain names or qualified with
+// the profile's name (e.g. "ntfs::FILE_RECORD").
+func NewNamedProfile(name string) *Profile {
+	result := NewProfile()
+	result.name = name
+	return result
+}
+
+func (self *Profile) Name() string {
+	return self.name
+}
+
+// Make the types of another profile available in this profile as
+// namespace::type. The other profile keeps its own namespace: its
+// types are always resolved within the profile that defines them, so
+// both profiles may define types of the same name. Import the other
+// profile before adding definitions which refer to its types.
+func (self *Profile) Import(namespace string, other *Profile) error {
+	err := self.checkMutable()
+	if err != nil {
+		return err
+	}
+
+	if namespace == "" || strings.Contains(namespace, NamespaceSeparator) {
+		return fmt.Errorf("Import: invalid namespace '%v'", namespace)
+	}
+
+	if other == nil || other == self {
+		return fmt.Errorf("Import: a profile can not import itself as %v", namespace)
+	}
+
+	if namespace == self.name {
+		return fmt.Errorf("Import: namespace %v is the profile's own namespace",
+			namespace)
+	}
+
+	existing, pres := self.imports[namespace]
+	if pres && existing != other {
+		return fmt.Errorf("Import: namespace %v is already imported", namespace)
+	}
+
+	self.imports[namespace] = other
+	return nil
+}
+
+// Find the parser for a type name. Qualified names are looked up in
+// the imported profiles. Also returns the profile which owns the
+// type so that parsers are instantiated within their own namespace.
+func (self *Profile) getType(name string) (Parser, *Profile, bool) {
+	// Type names imported from other formats may contain the
+	// separator themselves (e.g. C++ names).
+	parser, pres := self.types[name]
+	if pres {
+		return parser, self, true
+	}
+
+	namespace, type_name, found := strings.Cut(name, NamespaceSeparator)
+	if !found {
+		return nil, nil, false
+	}
+
+	if namespace == self.name {
+		return self.getType(type_name)
+	}
+
+	other, pres := self.imports[namespace]
+	if !pres {
+		return nil, nil, false
+	}
+	return other.getType(type_name)
+}
+
+// Register the parser under the type name. Fails once the profile
+// is compiled.
+func (self *Profile) AddParser(type_name string, parser Parser) error {
+	err := self.checkMutable()
+	if err != nil {
+		return err
+	}
+
 	self.types[type_name] = parser
+	return nil
 }
 
 func (self *Profile) GetParser(name string, options *ordereddict.Dict) (Parser, error) {
-	parser, pres := self.types[name]
+	parser, owner, pres := self.getType(name)
 	if !pres {
 		return nil, fmt.Errorf("%w: Parser %v not found",
 			NotFoundError, name)
@@ -58,12 +431,12 @@ func (self *Profile) GetParser(name string, options *ordereddict.Dict) (Parser,
 	if options == nil {
 		options = ordereddict.NewDict()
 	}
-	return parser.New(self, options)
+	return parser.New(owner, options)
 }
 
 func (self *Profile) ObjectSize(scope vfilter.Scope,
 	name string, reader io.ReaderAt, offset int64) int {
-	parser, pres := self.types[name]
+	parser, _, pres := self.getType(name)
 	if pres {
 		sizer, ok := parser.(Sizer)
 		if ok {
@@ -75,40 +448,136 @@ func (self *Profile) ObjectSize(scope vfilter.Scope,
 }
 
 // Build the profile from definitions given in the vtypes language.
+// The definitions are either a list of structs or a map with
+// "constants", "typedefs" and "structs" sections. Definitions may
+// also be written in the text DSL (see ParseProfileDSL).
 func (self *Profile) ParseStructDefinitions(definitions string) (err error) {
-	var profile_definitions []*StructDefinition
+	if isProfileDSL(definitions) {
+		return self.addDSLDefinitions(definitions, false)
+	}
 
-	err = yaml.Unmarshal([]byte(definitions), &profile_definitions)
+	profile_definitions := &ProfileDefinitions{}
+
+	err = yaml.Unmarshal([]byte(definitions), profile_definitions)
+	if err == nil {
+		err = self.addDefinitions(profile_definitions, false)
+	}
+
+	return locateError([]byte(definitions), err)
+}
+
+// Apply the definitions as an overlay on top of the existing
+// definitions. Structs which already exist are patched: fields in the
+// overlay are added or replace the existing field of the same name
+// (keeping its position), and a non zero size replaces the struct
+// size. All other fields are left untouched. Structs which do not
+// exist yet are simply added. Typedefs in the overlay replace
+// existing typedefs of the same name. If the overlay fails the
+// profile is left unchanged.
+func (self *Profile) ApplyOverlay(definitions string) (err error) {
+	if isProfileDSL(definitions) {
+		return self.addDSLDefinitions(definitions, true)
+	}
+
+	profile_definitions := &ProfileDefinitions{}
+
+	err = yaml.Unmarshal([]byte(definitions), profile_definitions)
+	if err == nil {
+		err = self.addDefinitions(profile_definitions, true)
+	}
+
+	return locateError([]byte(definitions), err)
+}
+
+func (self *Profile) addStructDefinitions(
+	profile_definitions []*StructDefinition, overlay bool) error {
+	return self.addDefinitions(&ProfileDefinitions{
+		Structs: profile_definitions,
+	}, overlay)
+}
+
+// Add the definitions using pointer as the profile's "pointer" type,
+// unless the profile already has one (e.g. from AddModelFor()).
+// Pointer fields pick up the address parser when they are built, so
+// it is installed first and removed again if the definitions fail.
+func (self *Profile) addStructDefinitionsWithPointer(
+	profile_definitions []*StructDefinition, pointer Parser) error {
+	_, pres := self.types["pointer"]
+	if pres || pointer == nil {
+		return self.addStructDefinitions(profile_definitions, false)
+	}
+
+	self.types["pointer"] = pointer
+	err := self.addStructDefinitions(profile_definitions, false)
+	if err != nil {
+		delete(self.types, "pointer")
+	}
+	return err
+}
+
+func (self *Profile) addDefinitions(
+	definitions *ProfileDefinitions, overlay bool) (err error) {
+	err = self.checkMutable()
 	if err != nil {
 		return err
 	}
 
-	for _, struct_def := range profile_definitions {
-		_, pres := self.types[struct_def.Name]
-		if pres {
-			return fmt.Errorf("Struct definition for %v masks an existing definition",
-				struct_def.Name)
+	// Overlays are applied all or nothing: if any part fails the
+	// profile is left as it was.
+	var snapshot *profileSnapshot
+	if overlay {
+		snapshot = self.snapshot(definitions)
+		defer func() {
+			if err != nil {
+				snapshot.restore()
+			}
+		}()
+	}
+
+	if definitions.Endian != "" {
+		err = self.SetEndian(definitions.Endian)
+		if err != nil {
+			return err
 		}
+	}
 
-		struct_parser := NewStructParser(struct_def.Name, struct_def.Size)
-		self.types[struct_def.Name] = struct_parser
+	err = self.addConstants(definitions.Constants, overlay)
+	if err != nil {
+		return err
+	}
 
-		// Try to parse it as a VQL Lambda
-		if struct_def.SizeExpression != "" {
-			struct_parser.size_expression, err = vfilter.ParseLambda(
-				struct_def.SizeExpression)
-			if err != nil {
-				return fmt.Errorf("struct definition %v size expression '%v': %w",
-					struct_def.Name, struct_def.SizeExpression, err)
-			}
+	profile_definitions := definitions.Structs
+
+	// Fields using the typedefs are resolved after the typedefs are
+	// added since an overlay may replace them.
+	typedef_names := make(map[string]bool)
+	for _, typedef := range definitions.Typedefs {
+		typedef_names[typedef.Name] = true
+	}
+
+	// Fields that refer to types which are not defined yet. These
+	// are resolved once all the structs are added.
+	var pending []*pendingField
+
+	// Base structs must be added before the structs extending them.
+	profile_definitions, err = self.orderByExtends(profile_definitions)
+	if err != nil {
+		return err
+	}
+
+	for _, struct_def := range profile_definitions {
+		struct_parser, err := self.getStructForDefinition(struct_def, overlay)
+		if err != nil {
+			return struct_def.error(-1, err)
 		}
 
-		for _, field_def := range struct_def.Fields {
+		for i, field_def := range struct_def.Fields {
 			// Install a parser now to maintain
 			// field ordering but do not include
 			// delegate parser yet
 			temp_parser := &ParseAtOffset{
-				offset: field_def.Offset,
+				offset:     field_def.Offset,
+				definition: field_def,
 			}
 			struct_parser.AddField(field_def.Name, temp_parser)
 
@@ -116,51 +585,356 @@ func (self *Profile) ParseStructDefinitions(definitions string) (err error) {
 				temp_parser.offset_expression, err = vfilter.ParseLambda(
 					field_def.OffsetExpression)
 				if err != nil {
-					return fmt.Errorf("struct %v field offset '%v': %w",
-						struct_def.Name, field_def.OffsetExpression, err)
+					return struct_def.error(i, fmt.Errorf("offset '%v': %w",
+						field_def.OffsetExpression, err))
 				}
 			}
 
 			// Get the parser by name
-			parser, pres := self.types[field_def.Type]
-			if pres {
+			parser, owner, pres := self.getType(field_def.Type)
+			if pres && !typedef_names[field_def.Type] {
 				options := field_def.Options
 				if options == nil {
 					options = ordereddict.NewDict()
 				}
-				temp_parser.parser, err = parser.New(self, options)
+				temp_parser.parser, err = parser.New(owner, options)
 				if err != nil {
-					return fmt.Errorf("struct %v field '%v': %w",
-						struct_def.Name, field_def.Name, err)
+					return struct_def.error(i, err)
 				}
 			} else {
-
 				// Delay the creation of the parser until we
 				// have added all the structs in case the
 				// parser name refers to a struct which has
 				// not been defined yet.
-				defer func(field_def *FieldDefinition, temp_parser *ParseAtOffset) {
-					if err != nil {
-						return
-					}
-
-					parser, pres := self.types[field_def.Type]
-					if !pres {
-						err = fmt.Errorf(
-							"Reference to undefined type %v in %v.%v",
-							field_def.Type, struct_def.Name,
-							field_def.Name)
-						return
-					}
-					temp_parser.parser, _ = parser.New(self, field_def.Options)
-				}(field_def, temp_parser)
+				pending = append(pending, &pendingField{
+					struct_def: struct_def,
+					field:      i,
+					parser:     temp_parser,
+				})
+			}
+		}
+	}
+
+	// Typedefs may refer to the structs and fields may use the
+	// typedefs so they are added in between.
+	err = self.addTypedefs(definitions.Typedefs, overlay)
+	if err != nil {
+		return err
+	}
+
+	for _, field := range pending {
+		field_def := field.struct_def.Fields[field.field]
+		parser, owner, pres := self.getType(field_def.Type)
+		if !pres {
+			return field.struct_def.error(field.field, fmt.Errorf(
+				"Reference to undefined type %v", field_def.Type))
+		}
+		options := field_def.Options
+		if options == nil {
+			options = ordereddict.NewDict()
+		}
+		field.parser.parser, err = parser.New(owner, options)
+		if err != nil {
+			return field.struct_def.error(field.field, err)
+		}
+	}
+
+	// Structs extending the overlaid structs pick up their changed
+	// fields.
+	if snapshot != nil {
+		for struct_parser, saved := range snapshot.structs {
+			self.updateDerived(struct_parser, saved)
+		}
+	}
+
+	// Offsets and sizes of all fields are known now.
+	self.layoutStructs()
+
+	return nil
+}
+
+// The state of the profile that adding definitions may change.
+type profileSnapshot struct {
+	profile   *Profile
+	types     map[string]Parser
+	constants *ordereddict.Dict
+	endian    string
+
+	// Existing structs and typedefs which an overlay patches in
+	// place.
+	structs  map[*StructParser]StructParser
+	typedefs map[*TypedefParser]savedTypedef
+}
+
+type savedTypedef struct {
+	definition *TypedefDefinition
+	parser     Parser
+}
+
+func (self *Profile) snapshot(definitions *ProfileDefinitions) *profileSnapshot {
+	result := &profileSnapshot{
+		profile:   self,
+		types:     make(map[string]Parser, len(self.types)),
+		constants: ordereddict.NewDict(),
+		endian:    self.endian,
+		structs:   make(map[*StructParser]StructParser),
+		typedefs:  make(map[*TypedefParser]savedTypedef),
+	}
+
+	for k, v := range self.types {
+		result.types[k] = v
+	}
+
+	for _, k := range self.constants.Keys() {
+		v, _ := self.constants.Get(k)
+		result.constants.Set(k, v)
+	}
+
+	for _, struct_def := range definitions.Structs {
+		struct_parser, ok := self.types[struct_def.Name].(*StructParser)
+		if ok {
+			result.structs[struct_parser] = struct_parser.copy()
+		}
+	}
+
+	for _, typedef := range definitions.Typedefs {
+		typedef_parser, ok := self.types[typedef.Name].(*TypedefParser)
+		if ok {
+			definition, parser := typedef_parser.get()
+			result.typedefs[typedef_parser] = savedTypedef{
+				definition: definition,
+				parser:     parser,
+			}
+		}
+	}
+
+	return result
+}
+
+func (self *profileSnapshot) restore() {
+	self.profile.types = self.types
+	self.profile.constants = self.constants
+	self.profile.endian = self.endian
+	for struct_parser, saved := range self.structs {
+		*struct_parser = saved
+	}
+	for typedef_parser, saved := range self.typedefs {
+		typedef_parser.set(saved.definition, saved.parser)
+	}
+}
+
+// Find or create the struct parser that the definition should be
+// added to.
+func (self *Profile) getStructForDefinition(
+	struct_def *StructDefinition, overlay bool) (*StructParser, error) {
+
+	existing, pres := self.types[struct_def.Name]
+	if !pres {
+		struct_parser := NewStructParser(struct_def.Name, struct_def.Size)
+		struct_parser.profile = self
+		err := struct_parser.setSizeExpression(struct_def.SizeExpression)
+		if err != nil {
+			return nil, err
+		}
+
+		err = struct_parser.setEndian(struct_def.Endian)
+		if err != nil {
+			return nil, err
+		}
+
+		struct_parser.align = struct_def.Align
+		struct_parser.pack = struct_def.Pack
+		struct_parser.doc = struct_def.Doc
+		struct_parser.tags = struct_def.Tags
+		struct_parser.auto_size = struct_def.Size == 0 &&
+			struct_def.SizeExpression == ""
+
+		if struct_def.Extends != "" {
+			err = self.inheritFields(struct_parser, struct_def)
+			if err != nil {
+				return nil, err
 			}
 		}
 
+		self.types[struct_def.Name] = struct_parser
+		return struct_parser, nil
+	}
+
+	if !overlay {
+		return nil, errors.New("masks an existing definition")
+	}
+
+	if struct_def.Extends != "" {
+		return nil, fmt.Errorf("Overlay can not extend %v: struct already exists",
+			struct_def.Extends)
+	}
+
+	struct_parser, ok := existing.(*StructParser)
+	if !ok {
+		return nil, fmt.Errorf("Overlay can only be applied to a struct not %T",
+			existing)
+	}
+
+	if struct_def.Endian != "" {
+		err := struct_parser.setEndian(struct_def.Endian)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if struct_def.Align {
+		struct_parser.align = true
+	}
+	if struct_def.Pack != 0 {
+		struct_parser.pack = struct_def.Pack
+	}
+	if struct_def.Doc != "" {
+		struct_parser.doc = struct_def.Doc
+	}
+	if len(struct_def.Tags) > 0 {
+		struct_parser.tags = struct_def.Tags
+	}
+
+	// The overlay only changes the size if it specifies one.
+	if struct_def.SizeExpression != "" {
+		struct_parser.auto_size = false
+		struct_parser.size_computed = false
+		return struct_parser, struct_parser.setSizeExpression(
+			struct_def.SizeExpression)
+	}
+
+	if struct_def.Size != 0 {
+		struct_parser.auto_size = false
+		struct_parser.size_computed = false
+		struct_parser.size = struct_def.Size
+		struct_parser.size_expression = nil
+		struct_parser.size_expression_source = ""
 	}
+
+	return struct_parser, nil
+}
+
+// Copy the fields of the base struct into the new struct. The
+// struct's own fields are added later and override the inherited
+// fields of the same name.
+func (self *Profile) inheritFields(
+	struct_parser *StructParser, struct_def *StructDefinition) error {
+	existing, _, pres := self.getType(struct_def.Extends)
+	if !pres {
+		return fmt.Errorf("extends undefined struct %v", struct_def.Extends)
+	}
+
+	base, ok := existing.(*StructParser)
+	if !ok {
+		return fmt.Errorf("can only extend a struct, not %v", struct_def.Extends)
+	}
+
+	for _, field_name := range base.field_names {
+		struct_parser.AddField(field_name, base.fields[field_name])
+	}
+
+	// Inherit the size unless the struct specifies its own.
+	if struct_def.Size == 0 && struct_def.SizeExpression == "" {
+		struct_parser.size = base.size
+		struct_parser.size_expression = base.size_expression
+		struct_parser.size_expression_source = base.size_expression_source
+	}
+
+	if struct_def.Endian == "" {
+		struct_parser.endian = base.endian
+		struct_parser.endian_expression = base.endian_expression
+		if base.endian != "" {
+			self.has_endian = true
+		}
+	}
+
+	if !struct_def.Align && struct_def.Pack == 0 {
+		struct_parser.align = base.align
+		struct_parser.pack = base.pack
+	}
+	struct_parser.base = base
+
 	return nil
 }
 
+// Pass the fields an overlay changed in the base struct on to the
+// structs extending it. Fields which a derived struct still inherits
+// share the parser of the base's old field; fields the derived
+// struct defines itself are kept.
+func (self *Profile) updateDerived(base *StructParser, old StructParser) {
+	seen := make(map[*StructParser]bool)
+	for _, parser := range self.types {
+		struct_parser, ok := parser.(*StructParser)
+		if !ok || struct_parser.base != base || seen[struct_parser] {
+			continue
+		}
+		seen[struct_parser] = true
+
+		saved := struct_parser.copy()
+		for _, field_name := range base.field_names {
+			field, pres := struct_parser.fields[field_name]
+			if !pres || field == old.fields[field_name] {
+				struct_parser.AddField(field_name, base.fields[field_name])
+			}
+		}
+
+		self.updateDerived(struct_parser, saved)
+	}
+}
+
+// Sort the definitions so that base structs appear before the
+// structs that extend them.
+func (self *Profile) orderByExtends(
+	profile_definitions []*StructDefinition) ([]*StructDefinition, error) {
+	by_name := make(map[string]*StructDefinition)
+	for _, struct_def := range profile_definitions {
+		by_name[struct_def.Name] = struct_def
+	}
+
+	result := make([]*StructDefinition, 0, len(profile_definitions))
+	seen := make(map[*StructDefinition]bool)
+	in_progress := make(map[*StructDefinition]bool)
+
+	var visit func(struct_def *StructDefinition) error
+	visit = func(struct_def *StructDefinition) error {
+		if seen[struct_def] {
+			return nil
+		}
+
+		if in_progress[struct_def] {
+			return struct_def.error(-1, errors.New("circular extends chain"))
+		}
+		in_progress[struct_def] = true
+
+		base, pres := by_name[struct_def.Extends]
+		if pres {
+			err := visit(base)
+			if err != nil {
+				return err
+			}
+		}
+
+		seen[struct_def] = true
+		result = append(result, struct_def)
+		return nil
+	}
+
+	for _, struct_def := range profile_definitions {
+		err := visit(struct_def)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+type pendingField struct {
+	struct_def *StructDefinition
+	field      int
+	parser     *ParseAtOffset
+}
+
 // Create a new object of the specified type by instantiating the
 // named parser on the reader at the specified offset.
 
@@ -169,11 +943,18 @@ func (self *Profile) ParseStructDefinitions(definitions string) (err error) {
 // options = { "Target": "int"}
 func (self *Profile) Parse(scope vfilter.Scope, type_name string,
 	reader io.ReaderAt, offset int64) (interface{}, error) {
-	parser, pres := self.types[type_name]
+	parser, owner, pres := self.getType(type_name)
 	if !pres {
 		return nil, errors.New(
 			fmt.Sprintf("Type name %s is not known.", type_name))
 	}
 
-	return parser.Parse(scope, reader, offset), nil
+	// Release the subscope so callers reusing their scope do not
+	// collect one child scope per parse.
+	subscope := self.parseScope(scope, owner)
+	if subscope != scope {
+		defer subscope.Close()
+	}
+
+	return parser.Parse(subscope, reader, offset), nil
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -19,6 +20,10 @@ type ProfileParser struct {
 	options ProfileParserOptions
 	profile *Profile
 	parser  Parser
+
+	// Protects parser which may be filled in by concurrent calls to
+	// Parse()
+	mu sync.Mutex
 }
 
 func (self *ProfileParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -63,20 +68,58 @@ func (self *ProfileParser) New(profile *Profile, options *ordereddict.Dict) (Par
 func (self *ProfileParser) Parse(
 	scope vfilter.Scope,
 	reader io.ReaderAt, offset int64) interface{} {
+	parser := self.getParser(scope)
+
+	// Take the offset from the expression.
+	offset = EvalLambdaAsInt64(self.options.Offset, scope)
+	return parser.Parse(scope, reader, offset)
+}
+
+// Resolve the parser on first use since the type may be defined
+// later.
+func (self *ProfileParser) getParser(scope vfilter.Scope) Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
 	if self.parser == nil {
-		parser, err := self.profile.GetParser(
-			self.options.Type, self.options.TypeOptions)
+		err := self.resolve()
 		if err != nil {
 			scope.Log("ERROR:binary_parser: ProfileParser: %v", err)
 			self.parser = NullParser{}
-			return vfilter.Null{}
 		}
+	}
+
+	return self.parser
+}
 
-		// Cache the parser for next time.
-		self.parser = parser
+// Must be called with the lock held.
+func (self *ProfileParser) resolve() error {
+	parser, err := resolveParser(self.parser, self.profile,
+		self.options.Type, self.options.TypeOptions)
+	if err != nil {
+		return err
 	}
 
-	// Take the offset from the expression.
-	offset = EvalLambdaAsInt64(self.options.Offset, scope)
-	return self.parser.Parse(scope, reader, offset)
+	// Cache the parser for next time.
+	self.parser = parser
+	return nil
+}
+
+func (self *ProfileParser) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return []Parser{self.parser}, nil
+}
+
+func (self *ProfileParser) typeReferences() []typeReference {
+	return []typeReference{{
+		option:    "type",
+		type_name: self.options.Type,
+		options:   self.options.TypeOptions,
+	}}
 }
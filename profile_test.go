@@ -0,0 +1,150 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestKeyedDefinitions(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	// Keyed and positional forms may be mixed freely.
+	err := profile.ParseStructDefinitions(`
+[
+  {"name": "Header", "size": 8, "doc": "The file header.", "tags": ["v1"], "fields": [
+    ["Magic", 0, "String", {"length": 2}],
+    {"name": "Count", "offset": 2, "type": "uint16", "doc": "Number of entries."},
+    {"name": "Flags", "type": "uint8", "options": {}, "tags": ["bitmap", "deprecated"]},
+    ["Version", "uint8"],
+  ]},
+  ["Trailer", 0, [
+    {"name": "Checksum", "offset": 0, "type": "uint16"},
+  ]],
+]`)
+	assert.NoError(t, err)
+
+	err = profile.ParseStructDefinitions(`
+- name: Record
+  extends: Header
+  fields:
+    - {name: Length, type: uint32, doc: Length of the data.}
+`)
+	assert.NoError(t, err)
+
+	data := []byte{'M', 'Z', 0x02, 0x00, 0x01, 0x03, 0x10, 0x00, 0x00, 0x00}
+	obj, err := profile.Parse(MakeScope(), "Record", bytes.NewReader(data), 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Magic":"MZ","Count":2,"Flags":1,"Version":3,"Length":16}`,
+		string(serialized))
+
+	// The documentation and tags are kept for introspection.
+	description, err := profile.Describe("Header")
+	assert.NoError(t, err)
+	assert.Equal(t, "The file header.", description.Doc)
+	assert.Equal(t, []string{"v1"}, description.Tags)
+	assert.Equal(t, "Number of entries.", description.Fields[1].Doc)
+	assert.Equal(t, []string{"bitmap", "deprecated"}, description.Fields[2].Tags)
+	assert.Equal(t, int64(5), description.Fields[3].Offset)
+
+	description, err = profile.Describe("Record")
+	assert.NoError(t, err)
+	assert.Equal(t, "Length of the data.", description.Fields[4].Doc)
+	assert.Equal(t, int64(6), description.Fields[4].Offset)
+
+	// Definitions with documentation or tags are exported in the
+	// keyed form, all others as tuples.
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	assert.Contains(t, exported, `
+  {"name": "Header", "size": 8, "doc": "The file header.", "tags": ["v1"], "fields": [
+    ["Magic", 0, "String", {"length": 2}],
+    {"name": "Count", "offset": 2, "type": "uint16", "doc": "Number of entries."},
+    {"name": "Flags", "type": "uint8", "tags": ["bitmap", "deprecated"]},
+    ["Version", "auto", "uint8"]
+  ]},`)
+	assert.Contains(t, exported, `
+  ["Trailer", 0, [
+    ["Checksum", 0, "uint16"]
+  ]]`)
+
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		round_trip := NewProfile()
+		AddModel(round_trip)
+		err = round_trip.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		re_exported, err := round_trip.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, re_exported, format)
+	}
+
+	// The keyed form is also decoded as JSON.
+	definitions := &ProfileDefinitions{}
+	err = json.Unmarshal([]byte(exported), definitions)
+	assert.NoError(t, err)
+	assert.Equal(t, "The file header.", definitions.Structs[0].Doc)
+	assert.Equal(t, "Length of the data.", definitions.Structs[1].Fields[4].Doc)
+}
+
+func TestKeyedDefinitionErrors(t *testing.T) {
+	for _, test_case := range []struct {
+		definitions, expected string
+	}{
+		{`
+[
+  {"name": "Header", "fields": [
+    {"name": "Magic", "offset": 0},
+  ]},
+]`, "line 4 column 5: struct Header field 0 'Magic': field type is required"},
+
+		{`
+[
+  {"name": "Header", "fields": [
+    {"name": "Magic", "type": "uint32", "comment": "x"},
+  ]},
+]`, "line 4 column 5: struct Header field 0 'Magic': Unknown field key comment"},
+
+		{`
+[
+  {"name": "Header", "fields": [], "doc": 1},
+]`, "line 3 column 3: struct Header: doc should be a string"},
+
+		{`
+[
+  {"name": "Header", "fields": [], "packed": true},
+]`, "line 3 column 3: struct Header: Unknown struct option packed"},
+
+		{`
+[
+  {"size": 8, "fields": []},
+]`, "line 3 column 3: struct #0: Struct name is required"},
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(test_case.definitions)
+		assert.Error(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), test_case.expected)
+		}
+	}
+
+	// The same errors are reported when decoding JSON.
+	definitions := &ProfileDefinitions{}
+	err := json.Unmarshal([]byte(`[
+  {"name": "Header", "fields": [{"name": "Magic", "type": "uint32", "tags": "x"}]}
+]`), definitions)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(),
+		"struct Header field 0 'Magic': tags should be a list of strings")
+}
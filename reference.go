@@ -22,11 +22,11 @@ type StructFieldReference struct {
 
 // The offset within the struct
 func (self *StructFieldReference) RelOffset() int64 {
-	return self.parser.getOffset(self.scope)
+	return self.parser.getOffset(self.scope, self.reader, self.offset)
 }
 
 func (self *StructFieldReference) Start() int64 {
-	return self.offset + self.parser.getOffset(self.scope)
+	return self.offset + self.parser.getOffset(self.scope, self.reader, self.offset)
 }
 
 func (self *StructFieldReference) Size() int {
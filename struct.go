@@ -1,8 +1,10 @@
 package vtypes
 
 import (
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -12,13 +14,49 @@ type StructParser struct {
 	type_name string
 	size      int
 
-	size_expression *vfilter.Lambda
+	// The profile which defines the struct. Its constants apply
+	// when the struct is used by an importing profile.
+	profile *Profile
+
+	size_expression        *vfilter.Lambda
+	size_expression_source string
+
+	// The byte order of generic ints in the struct: little, big or
+	// a lambda. Empty to use the enclosing byte order.
+	endian            string
+	endian_expression *vfilter.Lambda
+
+	// Fields with an automatic offset are placed at their natural
+	// alignment, limited to pack if it is set.
+	align bool
+	pack  int
+
+	// The definition did not give a size. The size is computed
+	// when all fields are fixed size, or inherited from base.
+	auto_size     bool
+	size_computed bool
+	base          *StructParser
+
+	// Documentation and tags from the definition.
+	doc  string
+	tags []string
 
 	// Maintain the order of the fields.
 	fields      map[string]*ParseAtOffset
 	field_names []string
 }
 
+// A copy of the struct which does not share the fields with it.
+func (self *StructParser) copy() StructParser {
+	result := *self
+	result.fields = make(map[string]*ParseAtOffset, len(self.fields))
+	for k, v := range self.fields {
+		result.fields[k] = v
+	}
+	result.field_names = append([]string{}, self.field_names...)
+	return result
+}
+
 // StructParser does not take options
 func (self *StructParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
 	return self, nil
@@ -33,9 +71,29 @@ func (self *StructParser) Size() int {
 	return self.size
 }
 
+// Adds the field to the end of the struct. If the field already
+// exists it is replaced in its current position.
 func (self *StructParser) AddField(field_name string, parser *ParseAtOffset) {
+	_, pres := self.fields[field_name]
+	if !pres {
+		self.field_names = append(self.field_names, field_name)
+	}
 	self.fields[field_name] = parser
-	self.field_names = append(self.field_names, field_name)
+}
+
+// Try to parse the size expression as a VQL Lambda
+func (self *StructParser) setSizeExpression(expression string) (err error) {
+	self.size_expression = nil
+	self.size_expression_source = expression
+	if expression == "" {
+		return nil
+	}
+
+	self.size_expression, err = vfilter.ParseLambda(expression)
+	if err != nil {
+		return fmt.Errorf("size expression '%v': %w", expression, err)
+	}
+	return nil
 }
 
 func (self *StructParser) Parse(
@@ -48,15 +106,26 @@ func (self *StructParser) Parse(
 		parser: self,
 		reader: reader,
 		offset: offset,
+		cache:  newFieldCache(),
 	}
 
 	// All dependencies will use this as the current struct
 	subscope := scope.Copy()
 	defer subscope.Close()
 
+	// Structs of an imported profile use its own constants and byte
+	// order. The struct's own endian still applies below.
+	if self.profile != nil {
+		self.profile.enterScope(subscope)
+	}
+
 	subscope.AppendVars(ordereddict.NewDict().Set("this", obj))
 	obj.scope = subscope
 
+	if self.endian != "" {
+		self.addEndian(subscope, obj)
+	}
+
 	return obj
 }
 
@@ -78,20 +147,58 @@ type ParseAtOffset struct {
 
 	type_name string
 
+	// Fields with an automatic offset which follow a field of
+	// variable size are placed at the end of the previous field
+	// when parsing.
+	previous  *ParseAtOffset
+	alignment int64
+
 	// Delegate parser
 	parser Parser
+
+	// The definition this field was built from.
+	definition *FieldDefinition
 }
 
 func (self *ParseAtOffset) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
 	return self, nil
 }
 
-func (self *ParseAtOffset) getOffset(scope vfilter.Scope) int64 {
-	if self.offset_expression == nil {
-		return self.offset
+// NOTE: offset is the offset to the start of the struct.
+func (self *ParseAtOffset) getOffset(scope vfilter.Scope,
+	reader io.ReaderAt, offset int64) int64 {
+	if self.offset_expression != nil {
+		return EvalLambdaAsInt64(self.offset_expression, scope)
+	}
+
+	if self.previous != nil {
+		// Working out the end of the previous field needs the
+		// offsets of all the fields before it, so remember them
+		// for the struct being parsed.
+		cache := structCache(scope, offset)
+		if cache != nil {
+			field_offset, pres := cache.getOffset(self)
+			if pres {
+				return field_offset
+			}
+		}
+
+		end := self.previous.getOffset(scope, reader, offset) +
+			int64(self.previous.Size(scope, reader, offset))
+		field_offset := alignUp(end, self.alignment)
+
+		if cache != nil {
+			cache.setOffset(self, field_offset)
+		}
+		return field_offset
 	}
 
-	return EvalLambdaAsInt64(self.offset_expression, scope)
+	return self.offset
+}
+
+// The offset is only known when parsing.
+func (self *ParseAtOffset) isDynamic() bool {
+	return self.offset_expression != nil || self.previous != nil
 }
 
 // Geting a field size may require actually parsing it since the size
@@ -103,7 +210,7 @@ func (self *ParseAtOffset) Size(
 		return element_size
 	}
 
-	field_offset := self.getOffset(scope)
+	field_offset := self.getOffset(scope, reader, offset)
 	element_size = InstanceSizeOf(self.parser, scope, reader, offset+field_offset)
 	if element_size != 0 {
 		return element_size
@@ -122,7 +229,7 @@ func (self *ParseAtOffset) Parse(scope vfilter.Scope,
 	}
 
 	// Get the field offset from the start of the struct.
-	field_offset := self.getOffset(scope)
+	field_offset := self.getOffset(scope, reader, offset)
 
 	// Apply the field parser on the combined offset.
 	return self.parser.Parse(scope, reader, offset+field_offset)
@@ -138,8 +245,9 @@ type StructObject struct {
 	// subscope "this" is assigned to this StructObject.
 	scope vfilter.Scope
 
-	// Cache the output of Get()
-	cache map[string]interface{}
+	// Cache the output of Get(). Shared with the copies of the
+	// object made by getThis().
+	cache *fieldCache
 
 	parent *StructObject
 }
@@ -161,12 +269,79 @@ func (self *StructObject) End() int64 {
 	return self.offset + int64(self.Size())
 }
 
-func (self *StructObject) Get(field string) (interface{}, bool) {
-	if self.cache == nil {
-		self.cache = make(map[string]interface{})
+// The parsed fields of a StructObject. Objects may be shared between
+// goroutines so access is protected by a mutex. The mutex is not held
+// while parsing because parsing a field may need other fields of the
+// same struct.
+type fieldCache struct {
+	mu     sync.Mutex
+	values map[string]interface{}
+
+	// The offsets of fields placed after a field of variable size.
+	offsets map[*ParseAtOffset]int64
+}
+
+func newFieldCache() *fieldCache {
+	return &fieldCache{
+		values:  make(map[string]interface{}),
+		offsets: make(map[*ParseAtOffset]int64),
 	}
+}
+
+// The cache of the struct at offset which is being parsed in the
+// scope, or nil if the scope does not belong to it.
+func structCache(scope vfilter.Scope, offset int64) *fieldCache {
+	this, pres := scope.Resolve("this")
+	if !pres {
+		return nil
+	}
+
+	this_struct, ok := this.(*StructObject)
+	if !ok || this_struct.offset != offset {
+		return nil
+	}
+	return this_struct.cache
+}
+
+func (self *fieldCache) get(field string) (interface{}, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
-	hit, pres := self.cache[field]
+	value, pres := self.values[field]
+	return value, pres
+}
+
+// Store the value unless another goroutine got there first. Returns
+// the cached value so all callers see the same object.
+func (self *fieldCache) set(field string, value interface{}) interface{} {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	existing, pres := self.values[field]
+	if pres {
+		return existing
+	}
+	self.values[field] = value
+	return value
+}
+
+func (self *fieldCache) getOffset(field *ParseAtOffset) (int64, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	offset, pres := self.offsets[field]
+	return offset, pres
+}
+
+func (self *fieldCache) setOffset(field *ParseAtOffset, offset int64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.offsets[field] = offset
+}
+
+func (self *StructObject) Get(field string) (interface{}, bool) {
+	hit, pres := self.cache.get(field)
 	if pres {
 		return hit, true
 	}
@@ -205,8 +380,7 @@ func (self *StructObject) Get(field string) (interface{}, bool) {
 		t.SetParent(self)
 	}
 
-	self.cache[field] = res
-	return res, true
+	return self.cache.set(field, res), true
 }
 
 // Get the size of the struct - it can either be fixed, or derived
@@ -0,0 +1,43 @@
+/* Compiled into dwarf_amd64.o and dwarf_386.o for the DWARF importer tests:
+ *
+ *   gcc -g -c dwarf.c -o dwarf_amd64.o
+ *   gcc -m32 -g -c dwarf.c -o dwarf_386.o
+ */
+
+enum Color { RED = 1, GREEN, BLUE = 0x10 };
+
+struct List {
+    struct List *Next;
+    struct List *Prev;
+};
+
+typedef struct {
+    unsigned short X;
+    unsigned short Y;
+} Point;
+
+typedef struct _Header {
+    char Signature[4];
+    unsigned char Version;
+    unsigned short Flags;
+    unsigned int Low: 4, High: 4;
+    enum Color Packed: 8;
+    enum Color Color;
+    long long Timestamp;
+    struct List List;
+    Point Points[2];
+    int Values[2][3];
+    const char *Name;
+    void *Data;
+    void (*Callback)(int);
+    union {
+        unsigned int AsInt;
+        unsigned char AsBytes[4];
+    };
+    struct {
+        short X;
+    } Inner;
+    double Ratio;
+} Header;
+
+Header header;
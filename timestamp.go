@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/Velocidex/ordereddict"
@@ -20,6 +21,10 @@ type EpochTimestamp struct {
 	options EpochTimestampOptions
 	profile *Profile
 	parser  Parser
+
+	// Protects parser which may be filled in by concurrent calls to
+	// Parse()
+	mu sync.Mutex
 }
 
 func (self *EpochTimestamp) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -51,26 +56,59 @@ func (self *EpochTimestamp) New(profile *Profile, options *ordereddict.Dict) (Pa
 }
 
 func (self *EpochTimestamp) Size() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
 	return SizeOf(self.parser)
 }
 
-func (self *EpochTimestamp) Parse(
-	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+// The underlying type may be defined after the timestamp so the
+// parser is resolved on first use. Errors are logged as the caller.
+func (self *EpochTimestamp) getParser(
+	scope vfilter.Scope, caller string) Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
 	if self.parser == nil {
-		parser, err := self.profile.GetParser(
-			self.options.Type, self.options.TypeOptions)
+		err := self.resolve()
 		if err != nil {
-			scope.Log("ERROR:binary_parser: EpochTimestamp: %v", err)
+			scope.Log("ERROR:binary_parser: %v: %v", caller, err)
 			self.parser = NullParser{}
-			return vfilter.Null{}
 		}
+	}
+
+	return self.parser
+}
 
-		// Cache the parser for next time.
-		self.parser = parser
+// Must be called with the lock held.
+func (self *EpochTimestamp) resolve() error {
+	parser, err := resolveParser(self.parser, self.profile,
+		self.options.Type, self.options.TypeOptions)
+	if err != nil {
+		return err
 	}
 
-	value, ok := to_int64(self.parser.Parse(scope, reader, offset))
+	// Cache the parser for next time.
+	self.parser = parser
+	return nil
+}
+
+func (self *EpochTimestamp) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	err := self.resolve()
+	if err != nil {
+		return nil, err
+	}
+	return []Parser{self.parser}, nil
+}
+
+func (self *EpochTimestamp) Parse(
+	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+
+	parser := self.getParser(scope, "EpochTimestamp")
+	value, ok := to_int64(parser.Parse(scope, reader, offset))
 	if !ok {
 		return vfilter.Null{}
 	}
@@ -86,6 +124,14 @@ func (self *EpochTimestamp) Parse(
 	return res
 }
 
+func (self *EpochTimestamp) typeReferences() []typeReference {
+	return []typeReference{{
+		option:    "type",
+		type_name: self.options.Type,
+		options:   self.options.TypeOptions,
+	}}
+}
+
 type WinFileTime struct {
 	*EpochTimestamp
 }
@@ -101,20 +147,8 @@ func (self *WinFileTime) New(profile *Profile, options *ordereddict.Dict) (Parse
 
 func (self *WinFileTime) Parse(
 	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
-	if self.parser == nil {
-		parser, err := self.profile.GetParser(
-			self.options.Type, self.options.TypeOptions)
-		if err != nil {
-			scope.Log("ERROR:binary_parser: WinFileTime: %v", err)
-			self.parser = NullParser{}
-			return vfilter.Null{}
-		}
-
-		// Cache the parser for next time.
-		self.parser = parser
-	}
-
-	value, ok := to_int64(self.parser.Parse(scope, reader, offset))
+	parser := self.getParser(scope, "WinFileTime")
+	value, ok := to_int64(parser.Parse(scope, reader, offset))
 	if !ok {
 		return vfilter.Null{}
 	}
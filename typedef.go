@@ -0,0 +1,297 @@
+// Named types with preconfigured options.
+
+package vtypes
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+// A typedef declares a new type name for an existing type with
+// options, for example an Enumeration or Flags used by many fields:
+//
+//	["FILE_ATTRIBUTES", "Flags", {"type": "uint32", "bitmap": {...}}]
+type TypedefDefinition struct {
+	Name    string
+	Type    string
+	Options *ordereddict.Dict
+}
+
+func (self *TypedefDefinition) tuple() []interface{} {
+	result := []interface{}{self.Name, self.Type}
+	if self.Options != nil && self.Options.Len() > 0 {
+		result = append(result, self.Options)
+	}
+	return result
+}
+
+// The parser registered for a typedef. Fields using the typedef
+// refer to it rather than to the parser built from the typedef's
+// options, so an overlay which replaces the typedef applies to the
+// fields already using it. Options given on the field are merged over
+// the typedef's options.
+type TypedefParser struct {
+	definition *TypedefDefinition
+	profile    *Profile
+
+	// Built from the typedef's options.
+	parser Parser
+
+	// Set for fields which give their own options: the typedef they
+	// use and their options. The parser is rebuilt when the typedef
+	// is replaced.
+	base    *TypedefParser
+	options *ordereddict.Dict
+	err     error
+
+	// Protects definition, parser and err which may be replaced by
+	// an overlay or rebuilt by concurrent calls to Parse()
+	mu sync.Mutex
+}
+
+func (self *TypedefParser) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
+	if options == nil || options.Len() == 0 {
+		return self, nil
+	}
+
+	result := &TypedefParser{
+		profile: self.profile,
+		base:    self,
+		options: options,
+	}
+
+	// Build the parser now so we can catch errors in the options.
+	_, err := result.getParser()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (self *TypedefParser) mergeOptions(options *ordereddict.Dict) *ordereddict.Dict {
+	definition, _ := self.get()
+
+	result := ordereddict.NewDict()
+	if definition.Options != nil {
+		for _, k := range definition.Options.Keys() {
+			v, _ := definition.Options.Get(k)
+			result.Set(k, v)
+		}
+	}
+
+	if options != nil {
+		for _, k := range options.Keys() {
+			v, _ := options.Get(k)
+			result.Set(k, v)
+		}
+	}
+	return result
+}
+
+// The current definition and parser of a registered typedef.
+func (self *TypedefParser) get() (*TypedefDefinition, Parser) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.definition, self.parser
+}
+
+// Replace the definition of a registered typedef.
+func (self *TypedefParser) set(definition *TypedefDefinition, parser Parser) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.definition = definition
+	self.parser = parser
+}
+
+// The parser to delegate to. For fields with their own options it
+// is built again if the typedef was replaced since it was last built.
+func (self *TypedefParser) getParser() (Parser, error) {
+	if self.base == nil {
+		_, parser := self.get()
+		return parser, nil
+	}
+
+	definition, _ := self.base.get()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.definition != definition {
+		self.definition = definition
+		self.parser, self.err = self.profile.GetParser(
+			definition.Type, self.base.mergeOptions(self.options))
+	}
+	return self.parser, self.err
+}
+
+func (self *TypedefParser) Parse(
+	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
+	parser, err := self.getParser()
+	if err != nil {
+		scope.Log("ERROR:binary_parser: TypedefParser: %v", err)
+		return vfilter.Null{}
+	}
+	return parser.Parse(scope, reader, offset)
+}
+
+func (self *TypedefParser) Size() int {
+	parser, _ := self.getParser()
+	return SizeOf(parser)
+}
+
+func (self *TypedefParser) InstanceSize(
+	scope vfilter.Scope, reader io.ReaderAt, offset int64) int {
+	parser, err := self.getParser()
+	if err != nil {
+		return 0
+	}
+	return InstanceSizeOf(parser, scope, reader, offset)
+}
+
+func (self *TypedefParser) compile() ([]Parser, error) {
+	parser, err := self.getParser()
+	if err != nil {
+		return nil, err
+	}
+	return []Parser{parser}, nil
+}
+
+// Register the typedefs. Typedefs may refer to each other in any
+// order and to all the structs in the profile. An overlay replaces
+// existing typedefs in place.
+func (self *Profile) addTypedefs(
+	typedefs []*TypedefDefinition, overlay bool) error {
+	typedefs, err := orderTypedefs(typedefs)
+	if err != nil {
+		return err
+	}
+
+	for _, typedef := range typedefs {
+		existing, pres := self.types[typedef.Name]
+		existing_typedef, is_typedef := existing.(*TypedefParser)
+		if pres && (!overlay || !is_typedef) {
+			return typedef.error(errors.New(
+				"masks an existing definition"))
+		}
+
+		options := typedef.Options
+		if options == nil {
+			options = ordereddict.NewDict()
+		}
+
+		parser, err := self.GetParser(typedef.Type, options)
+		if err != nil {
+			return typedef.error(err)
+		}
+
+		if pres {
+			existing_typedef.set(typedef, parser)
+			continue
+		}
+
+		err = self.AddParser(typedef.Name, &TypedefParser{
+			definition: typedef,
+			profile:    self,
+			parser:     parser,
+		})
+		if err != nil {
+			return typedef.error(err)
+		}
+	}
+
+	return nil
+}
+
+// Typedefs which refer to other typedefs in the same document,
+// either as their type or in their type option, are added after
+// them.
+func orderTypedefs(
+	typedefs []*TypedefDefinition) ([]*TypedefDefinition, error) {
+	by_name := make(map[string]*TypedefDefinition)
+	for _, typedef := range typedefs {
+		_, pres := by_name[typedef.Name]
+		if pres {
+			return nil, typedef.error(errors.New(
+				"defined more than once"))
+		}
+		by_name[typedef.Name] = typedef
+	}
+
+	result := make([]*TypedefDefinition, 0, len(typedefs))
+	seen := make(map[*TypedefDefinition]bool)
+	in_progress := make(map[*TypedefDefinition]bool)
+
+	var visit func(typedef *TypedefDefinition) error
+	visit = func(typedef *TypedefDefinition) error {
+		if seen[typedef] {
+			return nil
+		}
+
+		if in_progress[typedef] {
+			return typedef.error(errors.New("refers to itself"))
+		}
+		in_progress[typedef] = true
+
+		deps := []string{typedef.Type}
+		if typedef.Options != nil {
+			type_option, pres := typedef.Options.GetString("type")
+			if pres {
+				deps = append(deps, type_option)
+			}
+		}
+
+		for _, dep := range deps {
+			target, pres := by_name[dep]
+			if pres {
+				err := visit(target)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		seen[typedef] = true
+		result = append(result, typedef)
+		return nil
+	}
+
+	for _, typedef := range typedefs {
+		err := visit(typedef)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// The typedefs declared in the profile, sorted by name.
+func (self *Profile) exportTypedefDefinitions() []*TypedefDefinition {
+	var names []string
+	for name, parser := range self.types {
+		typedef, ok := parser.(*TypedefParser)
+		// Skip aliases to typedefs.
+		if ok && typedef.definition.Name == name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]*TypedefDefinition, 0, len(names))
+	for _, name := range names {
+		definition := self.types[name].(*TypedefParser).definition
+		result = append(result, &TypedefDefinition{
+			Name:    definition.Name,
+			Type:    definition.Type,
+			Options: sortedOptions(definition.Options),
+		})
+	}
+	return result
+}
@@ -0,0 +1,142 @@
+package vtypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sebdah/goldie"
+	assert "github.com/stretchr/testify/assert"
+)
+
+var typedefDefinitions = `
+{
+  "typedefs": [
+    ["ENTRY_LIST", "Array", {"type": "ENTRY", "count": 2}],
+    ["FILE_ATTRIBUTES", "Flags", {"type": "uint16", "bitmap": {
+        "READONLY": 0, "HIDDEN": 1, "SYSTEM": 2}}],
+    ["KIND", "Enumeration", {"type": "uint16", "choices": {
+        "1": "File", "2": "Directory"}}],
+    ["PENTRY", "Pointer", {"type": "ENTRY"}],
+    ["ENTRY", "Entry"],
+  ],
+  "structs": [
+    ["Header", 18, [
+      ["Attributes", 0, "FILE_ATTRIBUTES"],
+      ["Kind", 2, "KIND"],
+      ["ShortKind", 4, "KIND", {"type": "uint8"}],
+      ["List", 6, "ENTRY_LIST"],
+      ["Entry", 10, "PENTRY"],
+    ]],
+    ["Entry", 2, [
+      ["Attributes", 0, "FILE_ATTRIBUTES"],
+    ]],
+  ]
+}
+`
+
+func TestTypedefs(t *testing.T) {
+	profile := NewProfile()
+	AddModel(profile)
+
+	err := profile.ParseStructDefinitions(typedefDefinitions)
+	assert.NoError(t, err)
+
+	data := []byte{
+		0x03, 0x00, // Attributes
+		0x02, 0x00, // Kind
+		0x01, 0x00, // ShortKind
+		0x04, 0x00, 0x05, 0x00, // List
+		0x12, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // Entry
+		0x06, 0x00,
+	}
+	reader := bytes.NewReader(data)
+
+	obj, err := profile.Parse(MakeScope(), "Header", reader, 0)
+	assert.NoError(t, err)
+
+	serialized, err := json.Marshal(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Attributes":["HIDDEN","READONLY"],"Kind":"Directory","ShortKind":"File","List":[{"Attributes":["SYSTEM"]},{"Attributes":["READONLY","SYSTEM"]}],"Entry":{"Attributes":["HIDDEN","SYSTEM"]}}`,
+		string(serialized))
+
+	assert.Equal(t, 2, profile.ObjectSize(MakeScope(), "ENTRY", reader, 0))
+
+	description, err := profile.Describe("ENTRY_LIST")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, description.Size)
+
+	// Typedefs are exported and can be parsed again.
+	exported, err := profile.ExportDefinitions("json")
+	assert.NoError(t, err)
+	goldie.Assert(t, "TestTypedefs", []byte(exported))
+
+	for _, format := range []string{"json", "yaml"} {
+		serialized, err := profile.ExportDefinitions(format)
+		assert.NoError(t, err)
+
+		round_trip := NewProfile()
+		AddModel(round_trip)
+		err = round_trip.ParseStructDefinitions(serialized)
+		assert.NoError(t, err, format)
+
+		re_exported, err := round_trip.ExportDefinitions("json")
+		assert.NoError(t, err)
+		assert.Equal(t, exported, re_exported, format)
+	}
+
+	// An overlay may replace a typedef. The fields already using it
+	// use the new definition, also with their own options.
+	err = profile.ApplyOverlay(`
+typedefs:
+  - [KIND, Enumeration, {type: uint16, choices: {"1": Document, "2": Folder}}]
+`)
+	assert.NoError(t, err)
+
+	obj, err = profile.Parse(MakeScope(), "Header", reader, 0)
+	assert.NoError(t, err)
+	kind, _ := obj.(*StructObject).Get("Kind")
+	assert.Equal(t, "Folder", kind)
+	kind, _ = obj.(*StructObject).Get("ShortKind")
+	assert.Equal(t, "Document", kind)
+
+	// A failed overlay leaves the typedef as it was.
+	err = profile.ApplyOverlay(`
+typedefs:
+  - [KIND, Enumeration, {type: uint16, choices: {"2": Other}}]
+structs:
+  - [Header, 0, [[Kind, 2, Missing]]]
+`)
+	assert.Error(t, err)
+
+	obj, err = profile.Parse(MakeScope(), "Header", reader, 0)
+	assert.NoError(t, err)
+	kind, _ = obj.(*StructObject).Get("Kind")
+	assert.Equal(t, "Folder", kind)
+
+	_, err = profile.Compile()
+	assert.NoError(t, err)
+}
+
+func TestTypedefErrors(t *testing.T) {
+	for _, definitions := range []string{
+		// Typedefs can not mask existing types.
+		`{"typedefs": [["uint32", "uint16"]]}`,
+		`{"typedefs": [["Header", "uint16"]], "structs": [["Header", 0, []]]}`,
+
+		// Or each other.
+		`{"typedefs": [["A", "uint16"], ["A", "uint32"]]}`,
+		`{"typedefs": [["A", "B"], ["B", "Array", {"type": "A"}]]}`,
+
+		`{"typedefs": [["A", "Undefined"]]}`,
+		`{"typedefs": [["A", "Flags", {"type": "uint16"}]]}`,
+		`{"typedefs": [["A"]]}`,
+		`{"types": []}`,
+	} {
+		profile := NewProfile()
+		AddModel(profile)
+
+		err := profile.ParseStructDefinitions(definitions)
+		assert.Error(t, err, definitions)
+	}
+}
@@ -2,8 +2,11 @@ package vtypes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/vfilter"
@@ -18,6 +21,10 @@ type UnionOptions struct {
 type Union struct {
 	options UnionOptions
 	profile *Profile
+
+	// Protects options.choices which is filled in by the first call
+	// to Parse()
+	mu sync.Mutex
 }
 
 func (self *Union) New(profile *Profile, options *ordereddict.Dict) (Parser, error) {
@@ -35,31 +42,79 @@ func (self *Union) New(profile *Profile, options *ordereddict.Dict) (Parser, err
 	return result, nil
 }
 
+// Initialize the choices late to ensure they are all defined by
+// now. The map is not modified after it is built.
+func (self *Union) getChoices(scope vfilter.Scope) map[string]Parser {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.options.choices == nil {
+		choices, errs := self.resolve()
+		for _, err := range errs {
+			scope.Log("ERROR:binary_parser: Union: %v", err)
+		}
+		self.options.choices = choices
+	}
+
+	return self.options.choices
+}
+
+// Build the parsers for all the choices which can be resolved.
+// Choices decoded from YAML have no order so errors are reported in
+// sorted order.
+func (self *Union) resolve() (map[string]Parser, []error) {
+	choices := make(map[string]Parser)
+	var errs []error
+
+	keys := self.options.Choices.Keys()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		parser_name, pres := self.options.Choices.GetString(k)
+		if !pres {
+			continue
+		}
+
+		parser, err := self.profile.GetParser(
+			parser_name, ordereddict.NewDict())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("choice %v: %w", k, err))
+		} else {
+			choices[k] = parser
+		}
+	}
+
+	return choices, errs
+}
+
+// All choices must be resolved. Choices which were resolved at parse
+// time are rebuilt since some may have been missing.
+func (self *Union) compile() ([]Parser, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	choices, errs := self.resolve()
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	self.options.choices = choices
+
+	var result []Parser
+	for _, k := range self.options.Choices.Keys() {
+		parser, pres := choices[k]
+		if pres {
+			result = append(result, parser)
+		}
+	}
+	return result, nil
+}
+
 func (self *Union) Parse(
 	scope vfilter.Scope, reader io.ReaderAt, offset int64) interface{} {
 
 	var value interface{}
 
-	// Initialize the choices late to ensure they are all defined by
-	// now.
-	if self.options.choices == nil {
-		self.options.choices = make(map[string]Parser)
-
-		for _, k := range self.options.Choices.Keys() {
-			parser_name, pres := self.options.Choices.GetString(k)
-			if !pres {
-				continue
-			}
-
-			parser, err := self.profile.GetParser(
-				parser_name, ordereddict.NewDict())
-			if err != nil {
-				scope.Log("ERROR:binary_parser: Union: %v", err)
-			} else {
-				self.options.choices[k] = parser
-			}
-		}
-	}
+	choices := self.getChoices(scope)
 
 	subscope := scope.Copy()
 	defer subscope.Close()
@@ -75,16 +130,30 @@ func (self *Union) Parse(
 	}
 
 	value_str := fmt.Sprintf("%v", value)
-	parser, pres := self.options.choices[value_str]
+	parser, pres := choices[value_str]
 	if pres {
 		return parser.Parse(scope, reader, offset)
 	}
 
 	// Try the default
-	parser, pres = self.options.choices["default"]
+	parser, pres = choices["default"]
 	if pres {
 		return parser.Parse(scope, reader, offset)
 	}
 
 	return &vfilter.Null{}
 }
+
+func (self *Union) typeReferences() []typeReference {
+	var result []typeReference
+	for _, k := range self.options.Choices.Keys() {
+		parser_name, pres := self.options.Choices.GetString(k)
+		if pres {
+			result = append(result, typeReference{
+				option:    "choices." + k,
+				type_name: parser_name,
+			})
+		}
+	}
+	return result
+}
@@ -0,0 +1,524 @@
+package vtypes
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/vfilter"
+)
+
+const (
+	DiagnosticError   = "ERROR"
+	DiagnosticWarning = "WARNING"
+	DiagnosticInfo    = "INFO"
+)
+
+// A problem found in the profile by Validate()
+type Diagnostic struct {
+	Level   string
+	Struct  string
+	Field   string
+	Message string
+}
+
+func (self Diagnostic) String() string {
+	location := self.Struct
+	if self.Field != "" {
+		location += "." + self.Field
+	}
+	return fmt.Sprintf("%v: %v: %v", self.Level, location, self.Message)
+}
+
+// A reference from a parser to another type by name.
+type typeReference struct {
+	// The option which holds the reference (e.g. "type")
+	option    string
+	type_name string
+	options   *ordereddict.Dict
+}
+
+// Implemented by parsers which refer to other types by name. These
+// references are often only resolved when parsing.
+type typeReferrer interface {
+	typeReferences() []typeReference
+}
+
+// Properties which are always available on a struct.
+var structProperties = map[string]bool{
+	"SizeOf": true, "Size": true,
+	"StartOf": true, "Start": true, "OffsetOf": true,
+	"ParentOf": true, "Parent": true,
+	"EndOf": true, "End": true,
+}
+
+// Check all the structs in the profile and report all the problems
+// found. Unlike ParseStructDefinitions() which stops at the first
+// error, this reports everything at once, including problems which
+// would otherwise only be logged at parse time.
+func (self *Profile) Validate() []Diagnostic {
+	validator := &profileValidator{
+		profile: self,
+		used:    make(map[string]bool),
+	}
+
+	var names []string
+	for name, parser := range self.types {
+		struct_parser, ok := parser.(*StructParser)
+		if ok && struct_parser.type_name == name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		validator.validateStruct(self.types[name].(*StructParser))
+	}
+
+	for _, name := range names {
+		if !validator.used[name] {
+			validator.add(DiagnosticInfo, name, "",
+				"Struct is not used by any other struct")
+		}
+	}
+
+	return validator.diagnostics
+}
+
+type profileValidator struct {
+	profile     *Profile
+	used        map[string]bool
+	diagnostics []Diagnostic
+}
+
+func (self *profileValidator) add(level, struct_name, field, format string,
+	args ...interface{}) {
+	self.diagnostics = append(self.diagnostics, Diagnostic{
+		Level:   level,
+		Struct:  struct_name,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// A field with a known fixed extent within the struct.
+type fieldExtent struct {
+	name       string
+	start, end int64
+}
+
+func (self *profileValidator) validateStruct(struct_parser *StructParser) {
+	name := struct_parser.type_name
+
+	self.checkLambda(struct_parser, "", "size", struct_parser.size_expression_source)
+	if struct_parser.endian_expression != nil {
+		self.checkLambda(struct_parser, "", "endian", struct_parser.endian)
+	}
+
+	var extents []fieldExtent
+
+	for _, field_name := range struct_parser.field_names {
+		field := struct_parser.fields[field_name]
+
+		if field.definition != nil {
+			self.markUsed(field.definition.Type)
+			self.checkLambda(struct_parser, field_name, "offset",
+				field.definition.OffsetExpression)
+			self.checkOptionLambdas(struct_parser, field_name,
+				field.definition.Options)
+		}
+
+		if IsNil(field.parser) {
+			self.add(DiagnosticError, name, field_name, "Field has no parser")
+			continue
+		}
+
+		self.checkReferences(name, field_name, field.parser)
+
+		size := SizeOf(field.parser)
+		if field.isDynamic() || size == 0 {
+			continue
+		}
+
+		extent := fieldExtent{
+			name:  field_name,
+			start: field.offset,
+			end:   field.offset + int64(size),
+		}
+		extents = append(extents, extent)
+
+		if struct_parser.size_expression == nil && struct_parser.size > 0 &&
+			extent.end > int64(struct_parser.size) {
+			self.add(DiagnosticWarning, name, field_name,
+				"Field ends at %v past the end of the struct (size %v)",
+				extent.end, struct_parser.size)
+		}
+	}
+
+	// Report fields that partially overlap. Fields which are
+	// completely contained in other fields are probably deliberate
+	// (e.g. bit fields or alternate views of the same data).
+	for i := 0; i < len(extents); i++ {
+		for j := i + 1; j < len(extents); j++ {
+			a, b := extents[i], extents[j]
+			if a.start >= b.end || b.start >= a.end {
+				continue
+			}
+
+			if (a.start <= b.start && a.end >= b.end) ||
+				(b.start <= a.start && b.end >= a.end) {
+				continue
+			}
+
+			self.add(DiagnosticWarning, name, b.name,
+				"Field [%v-%v] overlaps field %v [%v-%v]",
+				b.start, b.end, a.name, a.start, a.end)
+		}
+	}
+}
+
+// Check that all the types referred to by the parser exist and can
+// be instantiated.
+func (self *profileValidator) checkReferences(
+	struct_name, field_name string, parser Parser) {
+	referrer, ok := parser.(typeReferrer)
+	if !ok {
+		return
+	}
+
+	for _, ref := range referrer.typeReferences() {
+		self.markUsed(ref.type_name)
+
+		target, owner, pres := self.profile.getType(ref.type_name)
+		if !pres {
+			self.add(DiagnosticError, struct_name, field_name,
+				"Option %v refers to undefined type %v",
+				ref.option, ref.type_name)
+			continue
+		}
+
+		// Types imported from other profiles are validated with
+		// their own profile.
+		if owner != self.profile {
+			continue
+		}
+
+		// Structs are checked separately.
+		_, ok := target.(*StructParser)
+		if ok {
+			continue
+		}
+
+		options := ref.options
+		if options == nil {
+			options = ordereddict.NewDict()
+		}
+
+		sub_parser, err := target.New(self.profile, options)
+		if err != nil {
+			self.add(DiagnosticError, struct_name, field_name,
+				"Option %v: %v", ref.option, err)
+			continue
+		}
+
+		self.checkReferences(struct_name, field_name, sub_parser)
+	}
+}
+
+// Types may be referred to with the profile's own namespace.
+func (self *profileValidator) markUsed(type_name string) {
+	self.used[type_name] = true
+	if self.profile.name != "" {
+		self.used[strings.TrimPrefix(type_name,
+			self.profile.name+NamespaceSeparator)] = true
+	}
+}
+
+func (self *profileValidator) checkOptionLambdas(
+	struct_parser *StructParser, field_name string, options *ordereddict.Dict) {
+	if options == nil {
+		return
+	}
+
+	for _, k := range options.Keys() {
+		v, _ := options.Get(k)
+		switch t := v.(type) {
+		case *ordereddict.Dict:
+			self.checkOptionLambdas(struct_parser, field_name, t)
+
+		case string:
+			if !strings.Contains(t, "=>") {
+				continue
+			}
+
+			// The sentinel lambda receives the array element and not
+			// the struct so only check references to this.
+			if k == "sentinel" {
+				self.checkLambda(struct_parser, field_name, k, t, "this")
+				continue
+			}
+			self.checkLambda(struct_parser, field_name, k, t)
+		}
+	}
+}
+
+// Check the lambda parses and that members of the variables which
+// refer to the struct exist. By default these are the lambda's
+// parameters and this.
+func (self *profileValidator) checkLambda(
+	struct_parser *StructParser, field_name, option, expression string,
+	variables ...string) {
+	if expression == "" {
+		return
+	}
+
+	lambda, err := vfilter.ParseLambda(expression)
+	if err != nil {
+		self.add(DiagnosticError, struct_parser.type_name, field_name,
+			"Invalid lambda in %v: %v", option, err)
+		return
+	}
+
+	if len(variables) == 0 {
+		variables = append(lambda.GetParameters(), "this")
+	}
+
+	// Nothing is reported if the lambda can not be checked.
+	members, _ := lambdaMembers(lambda, variables)
+	for _, member := range members {
+		if struct_parser.HasField(member) || structProperties[member] {
+			continue
+		}
+
+		self.add(DiagnosticError, struct_parser.type_name, field_name,
+			"Lambda in %v refers to undefined field %v: %v",
+			option, member, expression)
+	}
+}
+
+// Find the members accessed on the variables in the lambda, like
+// x.Field, x.`@Field` or (x).Field. The AST types are not exported
+// by vfilter so it is walked by reflection. If the AST does not have
+// the expected shape (e.g. vfilter changed it) the members are not
+// known and ok is false.
+func lambdaMembers(lambda *vfilter.Lambda, variables []string) (
+	members []string, ok bool) {
+	walker := &lambdaWalker{is_variable: make(map[string]bool)}
+	for _, variable := range variables {
+		walker.is_variable[variable] = true
+	}
+
+	walker.walk(reflect.ValueOf(lambda))
+	if walker.unknown {
+		return nil, false
+	}
+	return walker.members, true
+}
+
+type lambdaWalker struct {
+	is_variable map[string]bool
+	members     []string
+
+	// Set when a node does not look as expected.
+	unknown bool
+}
+
+func (self *lambdaWalker) add(member string) {
+	member = strings.TrimPrefix(strings.Trim(member, "`"), "@")
+	if member != "" {
+		self.members = append(self.members, member)
+	}
+}
+
+// The named field of an AST node, which should be of the given kind.
+func (self *lambdaWalker) field(
+	node reflect.Value, name string, kind reflect.Kind) (reflect.Value, bool) {
+	if node.Kind() != reflect.Struct {
+		self.unknown = true
+		return reflect.Value{}, false
+	}
+
+	field := node.FieldByName(name)
+	if !field.IsValid() || field.Kind() != kind {
+		self.unknown = true
+		return reflect.Value{}, false
+	}
+	return field, true
+}
+
+// The symbol of a _SymbolRef unless it is a function call.
+func (self *lambdaWalker) symbol(node reflect.Value) (string, bool) {
+	called, ok := self.field(node, "Called", reflect.Bool)
+	if !ok || called.Bool() {
+		return "", false
+	}
+
+	symbol, ok := self.field(node, "Symbol", reflect.String)
+	if !ok {
+		return "", false
+	}
+	return symbol.String(), true
+}
+
+func (self *lambdaWalker) walk(value reflect.Value) {
+	if self.unknown {
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.Ptr:
+		if !value.IsNil() {
+			self.walk(value.Elem())
+		}
+		return
+
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			self.walk(value.Index(i))
+		}
+		return
+
+	case reflect.Struct:
+	default:
+		return
+	}
+
+	switch value.Type().Name() {
+	// x.Field.Other is a single symbol.
+	case "_SymbolRef":
+		symbol, ok := self.symbol(value)
+		if ok {
+			components := splitSymbol(symbol)
+			if len(components) > 1 && self.is_variable[components[0]] {
+				self.add(components[1])
+			}
+		}
+
+	// (x).Field
+	case "_MemberExpression":
+		self.memberExpression(value)
+	}
+
+	value_type := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		// Skip unexported fields which hold runtime state.
+		if value_type.Field(i).PkgPath == "" {
+			self.walk(value.Field(i))
+		}
+	}
+}
+
+func (self *lambdaWalker) memberExpression(node reflect.Value) {
+	left, ok := self.field(node, "Left", reflect.Ptr)
+	if !ok {
+		return
+	}
+
+	terms, ok := self.field(node, "Right", reflect.Slice)
+	if !ok || terms.Len() == 0 || !self.is_variable[self.valueSymbol(left)] {
+		return
+	}
+
+	first := terms.Index(0)
+	if first.Kind() != reflect.Ptr || first.IsNil() {
+		self.unknown = true
+		return
+	}
+
+	term, ok := self.field(first.Elem(), "Term", reflect.Ptr)
+	if !ok || term.IsNil() {
+		return
+	}
+
+	if term.Elem().Kind() != reflect.String {
+		self.unknown = true
+		return
+	}
+	self.add(term.Elem().String())
+}
+
+// The name of the variable a _Value refers to, if it is a plain
+// symbol or a parenthesized one.
+func (self *lambdaWalker) valueSymbol(value reflect.Value) string {
+	for value.IsValid() && !value.IsNil() {
+		symbol_ref, ok := self.field(value.Elem(), "SymbolRef", reflect.Ptr)
+		if !ok {
+			return ""
+		}
+
+		if !symbol_ref.IsNil() {
+			symbol, _ := self.symbol(symbol_ref.Elem())
+			return symbol
+		}
+
+		// Follow (x) down to its value.
+		subexpression, ok := self.field(value.Elem(), "Subexpression", reflect.Ptr)
+		if !ok || subexpression.IsNil() {
+			return ""
+		}
+		value = self.singleValue(subexpression)
+	}
+	return ""
+}
+
+// The _Value at the bottom of an expression consisting of nothing
+// but that value, otherwise an invalid reflect.Value.
+func (self *lambdaWalker) singleValue(value reflect.Value) reflect.Value {
+	for !value.IsNil() {
+		element := value.Elem()
+		if element.Type().Name() == "_Value" {
+			return value
+		}
+
+		// Each level of the expression grammar has a Left and a
+		// list of Right terms, except comparisons which have a
+		// single Right and negation.
+		not := element.FieldByName("Not")
+		if not.IsValid() && not.Kind() == reflect.Ptr && !not.IsNil() {
+			return reflect.Value{}
+		}
+
+		right := element.FieldByName("Right")
+		if right.IsValid() {
+			switch right.Kind() {
+			case reflect.Slice:
+				if right.Len() > 0 {
+					return reflect.Value{}
+				}
+			case reflect.Ptr:
+				if !right.IsNil() {
+					return reflect.Value{}
+				}
+			}
+		}
+
+		left, ok := self.field(element, "Left", reflect.Ptr)
+		if !ok {
+			return reflect.Value{}
+		}
+		value = left
+	}
+	return reflect.Value{}
+}
+
+// Split a symbol like x.`@Field`.Other on the dots outside
+// backticks.
+func splitSymbol(symbol string) []string {
+	result := []string{}
+	quoted := false
+	start := 0
+	for i, c := range symbol {
+		switch c {
+		case '`':
+			quoted = !quoted
+		case '.':
+			if !quoted {
+				result = append(result, symbol[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(result, symbol[start:])
+}
@@ -3,94 +3,338 @@ package vtypes
 import (
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/Velocidex/ordereddict"
+	"github.com/Velocidex/yaml/v2"
+	yaml3 "gopkg.in/yaml.v3"
 )
 
 func (self *StructDefinition) UnmarshalYAML(unmarshal func(v interface{}) error) error {
-	var values []interface{}
+	var values interface{}
 	err := unmarshal(&values)
 	if err != nil {
 		return err
 	}
-	ok := false
+	return self.fromYAML(values)
+}
+
+// Build the definition from the decoded YAML. Errors include the
+// struct name and the index of the field.
+func (self *StructDefinition) fromYAML(value interface{}) error {
+	keys, ok := value.(map[interface{}]interface{})
+	if ok {
+		return self.fromKeyedYAML(keys)
+	}
+
+	values, ok := value.([]interface{})
+	if !ok || len(values) != 3 && len(values) != 4 {
+		return self.error(-1, errors.New(
+			"Struct Definition should be [name, size, fields, options?]"))
+	}
 
 	self.Name, ok = values[0].(string)
 	if !ok {
-		return errors.New("Name should be a string")
+		return self.error(-1, errors.New("Name should be a string"))
 	}
 
-	size, ok := to_int64(values[1])
-	if ok {
-		self.Size = int(size)
+	err := self.sizeFromYAML(values[1])
+	if err != nil {
+		return self.error(-1, err)
+	}
+
+	err = self.fieldsFromYAML(values[2])
+	if err != nil {
+		return err
+	}
 
-	} else {
-		self.SizeExpression, ok = values[1].(string)
+	if len(values) == 4 {
+		option_map, ok := values[3].(map[interface{}]interface{})
 		if !ok {
-			return errors.New("Size should be a string or integer")
+			return self.error(-1, errors.New("struct options should be a map"))
 		}
+		options, err := to_ordereddict(option_map)
+		if err != nil {
+			return self.error(-1, fmt.Errorf("struct options %v", err))
+		}
+		return self.error(-1, self.setOptions(options))
 	}
 
-	fields, ok := values[2].([]interface{})
-	if !ok {
-		return errors.New("Fields should be a list of field definitions")
+	return nil
+}
+
+// The keyed form: {name: ..., size: ..., fields: [...]} with
+// optional doc, tags and struct options.
+func (self *StructDefinition) fromKeyedYAML(keys map[interface{}]interface{}) error {
+	name, pres := keys["name"]
+	if !pres {
+		return self.error(-1, errors.New("Struct name is required"))
 	}
 
-	for _, field_def := range fields {
-		field, ok := field_def.([]interface{})
-		if !ok {
-			return fmt.Errorf("%v: Field Definition should be [name, offset, type, options?]",
-				self.Name)
+	self.Name, _ = name.(string)
+	if self.Name == "" {
+		return self.error(-1, errors.New("Name should be a string"))
+	}
+
+	options := ordereddict.NewDict()
+	for _, k := range sortedYAMLKeys(keys) {
+		value := keys[k]
+
+		var err error
+		switch k {
+		case "name":
+			continue
+
+		case "size":
+			err = self.sizeFromYAML(value)
+
+		case "fields":
+			err := self.fieldsFromYAML(value)
+			if err != nil {
+				return err
+			}
+
+		case "doc":
+			err = docFromYAML(value, &self.Doc)
+
+		case "tags":
+			err = tagsFromYAML(value, &self.Tags)
+
+		default:
+			option_map, ok := value.(map[interface{}]interface{})
+			if ok {
+				value, err = to_ordereddict(option_map)
+			}
+			options.Set(k, value)
 		}
 
-		if len(field) != 3 && len(field) != 4 {
-			return fmt.Errorf("%v: Field Definition should be [name, offset, type, options?]",
-				self.Name)
+		if err != nil {
+			return self.error(-1, err)
 		}
+	}
+
+	return self.error(-1, self.setOptions(options))
+}
+
+func (self *StructDefinition) sizeFromYAML(value interface{}) error {
+	size, ok := to_int64(value)
+	if ok {
+		self.Size = int(size)
+		return nil
+	}
+
+	self.SizeExpression, ok = value.(string)
+	if !ok {
+		return errors.New("Size should be a string or integer")
+	}
+	return nil
+}
+
+func (self *StructDefinition) fieldsFromYAML(value interface{}) error {
+	fields, ok := value.([]interface{})
+	if !ok {
+		return self.error(-1, errors.New(
+			"Fields should be a list of field definitions"))
+	}
 
+	for i, field_def := range fields {
 		new_field := &FieldDefinition{}
-		new_field.Name, ok = field[0].(string)
-		if !ok {
-			return fmt.Errorf("%v: field name should be a string", self.Name)
+		self.Fields = append(self.Fields, new_field)
+
+		err := new_field.fromYAML(field_def)
+		if err != nil {
+			return self.error(i, err)
 		}
+	}
+	return nil
+}
 
-		offset, ok := to_int64(field[1])
-		if ok {
-			new_field.Offset = int64(offset)
+func (self *FieldDefinition) fromYAML(value interface{}) error {
+	keys, ok := value.(map[interface{}]interface{})
+	if ok {
+		return self.fromKeyedYAML(keys)
+	}
 
-		} else {
-			new_field.OffsetExpression, ok = field[1].(string)
-			if !ok {
-				return fmt.Errorf("%v: field %v size should be a string or int",
-					self.Name, new_field.Name)
-			}
-		}
+	field, ok := value.([]interface{})
+	if !ok {
+		return errors.New("Field Definition should be [name, offset?, type, options?]")
+	}
 
-		new_field.Type, ok = field[2].(string)
-		if !ok {
-			return fmt.Errorf("%v: field %v type should be a string",
-				self.Name, new_field.Name)
+	// The offset may be omitted: [name, type, options?]
+	if len(field) == 2 || (len(field) == 3 && isYAMLMap(field[2])) {
+		field = append([]interface{}{field[0], autoOffset}, field[1:]...)
+	}
+
+	if len(field) != 3 && len(field) != 4 {
+		return errors.New("Field Definition should be [name, offset?, type, options?]")
+	}
+
+	self.Name, ok = field[0].(string)
+	if !ok {
+		return errors.New("field name should be a string")
+	}
+
+	err := self.offsetFromYAML(field[1])
+	if err != nil {
+		return err
+	}
+
+	self.Type, ok = field[2].(string)
+	if !ok {
+		return errors.New("type should be a string")
+	}
+
+	if len(field) == 4 {
+		return self.optionsFromYAML(field[3])
+	}
+
+	return nil
+}
+
+// The keyed form: {name: ..., offset: ..., type: ...} with optional
+// options, doc and tags. Without an offset the field follows the
+// previous field.
+func (self *FieldDefinition) fromKeyedYAML(keys map[interface{}]interface{}) error {
+	// The name is needed to report problems with the other keys.
+	name, pres := keys["name"]
+	if pres {
+		self.Name, pres = name.(string)
+		if !pres {
+			return errors.New("field name should be a string")
 		}
+	}
 
-		if len(field) == 4 {
-			option_map, ok := field[3].(map[interface{}]interface{})
+	self.AutoOffset = true
+	for _, k := range sortedYAMLKeys(keys) {
+		value := keys[k]
+
+		var err error
+		switch k {
+		case "name":
+			continue
+
+		case "offset":
+			self.AutoOffset = false
+			err = self.offsetFromYAML(value)
+
+		case "type":
+			type_name, ok := value.(string)
 			if !ok {
-				return fmt.Errorf("%v: field %v options should be a map",
-					self.Name, new_field.Name)
+				return errors.New("type should be a string")
 			}
-			options, err := to_ordereddict(option_map)
-			if err != nil {
-				return fmt.Errorf("%v: field %v options %v",
-					self.Name, new_field.Name, err)
-			}
-			new_field.Options = options
+			self.Type = type_name
+
+		case "options":
+			err = self.optionsFromYAML(value)
+
+		case "doc":
+			err = docFromYAML(value, &self.Doc)
+
+		case "tags":
+			err = tagsFromYAML(value, &self.Tags)
+
+		default:
+			err = fmt.Errorf("Unknown field key %v", k)
 		}
-		self.Fields = append(self.Fields, new_field)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return self.checkKeyed()
+}
+
+func (self *FieldDefinition) offsetFromYAML(value interface{}) error {
+	offset, ok := to_int64(value)
+	if ok {
+		self.Offset = int64(offset)
+		return nil
+	}
+
+	self.OffsetExpression, ok = value.(string)
+	if !ok {
+		return errors.New("offset should be a string or int")
+	}
+	if self.OffsetExpression == autoOffset {
+		self.OffsetExpression = ""
+		self.AutoOffset = true
+	}
+	return nil
+}
+
+func (self *FieldDefinition) optionsFromYAML(value interface{}) error {
+	option_map, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("options should be a map")
 	}
+	options, err := to_ordereddict(option_map)
+	if err != nil {
+		return fmt.Errorf("options %v", err)
+	}
+	self.Options = options
+	return nil
+}
 
+func docFromYAML(value interface{}, doc *string) error {
+	result, ok := value.(string)
+	if !ok {
+		return errors.New("doc should be a string")
+	}
+	*doc = result
+	return nil
+}
+
+func tagsFromYAML(value interface{}, tags *[]string) error {
+	items, ok := value.([]interface{})
+	if !ok {
+		return errors.New("tags should be a list of strings")
+	}
+
+	for _, item := range items {
+		tag, ok := item.(string)
+		if !ok {
+			return errors.New("tags should be a list of strings")
+		}
+		*tags = append(*tags, tag)
+	}
 	return nil
 }
 
+// Report problems in the same order every time. Keys which are not
+// strings are reported as unknown keys.
+func sortedYAMLKeys(keys map[interface{}]interface{}) []string {
+	result := make([]string, 0, len(keys))
+	for k := range keys {
+		result = append(result, fmt.Sprintf("%v", k))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func isYAMLMap(value interface{}) bool {
+	_, ok := value.(map[interface{}]interface{})
+	return ok
+}
+
+func (self *StructDefinition) MarshalYAML() (interface{}, error) {
+	return yamlValue(self.value())
+}
+
+func (self *FieldDefinition) MarshalYAML() (interface{}, error) {
+	return yamlValue(self.value())
+}
+
+// The keyed forms are returned as maps which the YAML encoder does
+// not marshal again.
+func yamlValue(value interface{}) (interface{}, error) {
+	dict, ok := value.(*ordereddict.Dict)
+	if ok {
+		return dict.MarshalYAML()
+	}
+	return value, nil
+}
+
 func to_ordereddict(dict map[interface{}]interface{}) (*ordereddict.Dict, error) {
 	var err error
 	result := ordereddict.NewDict()
@@ -111,3 +355,251 @@ func to_ordereddict(dict map[interface{}]interface{}) (*ordereddict.Dict, error)
 
 	return result, nil
 }
+
+func (self *TypedefDefinition) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	var values interface{}
+	err := unmarshal(&values)
+	if err != nil {
+		return err
+	}
+	return self.fromYAML(values)
+}
+
+func (self *TypedefDefinition) fromYAML(value interface{}) (err error) {
+	values, ok := value.([]interface{})
+	if !ok || len(values) != 2 && len(values) != 3 {
+		return self.error(errors.New("Typedef Definition should be [name, type, options?]"))
+	}
+
+	self.Name, ok = values[0].(string)
+	if !ok {
+		return self.error(errors.New("Typedef name should be a string"))
+	}
+
+	self.Type, ok = values[1].(string)
+	if !ok {
+		return self.error(errors.New("typedef type should be a string"))
+	}
+
+	if len(values) == 3 {
+		option_map, ok := values[2].(map[interface{}]interface{})
+		if !ok {
+			return self.error(errors.New("typedef options should be a map"))
+		}
+		self.Options, err = to_ordereddict(option_map)
+		if err != nil {
+			return self.error(fmt.Errorf("typedef options %v", err))
+		}
+	}
+
+	return nil
+}
+
+func (self *TypedefDefinition) MarshalYAML() (interface{}, error) {
+	return self.tuple(), nil
+}
+
+func structsFromYAML(values []interface{}) ([]*StructDefinition, error) {
+	var result []*StructDefinition
+	for i, value := range values {
+		struct_def := &StructDefinition{}
+		err := struct_def.fromYAML(value)
+		if err != nil {
+			return nil, setDefinitionIndex(err, i)
+		}
+		result = append(result, struct_def)
+	}
+	return result, nil
+}
+
+func (self *ProfileDefinitions) UnmarshalYAML(unmarshal func(v interface{}) error) error {
+	var document interface{}
+	err := unmarshal(&document)
+	if err != nil {
+		return err
+	}
+
+	switch t := document.(type) {
+	case nil:
+		return nil
+
+	// Documents without typedefs may be a list of structs.
+	case []interface{}:
+		self.Structs, err = structsFromYAML(t)
+		return err
+
+	case map[interface{}]interface{}:
+		var names []string
+		for k := range t {
+			name, ok := k.(string)
+			if !ok {
+				return errors.New("Profile sections should be strings")
+			}
+			names = append(names, name)
+		}
+
+		err = checkProfileSections(names)
+		if err != nil {
+			return err
+		}
+
+		var sections struct {
+			Endian    string            `yaml:"endian"`
+			Constants *ordereddict.Dict `yaml:"constants"`
+			Typedefs  []interface{}     `yaml:"typedefs"`
+			Structs   []interface{}     `yaml:"structs"`
+		}
+		err = unmarshal(&sections)
+		if err != nil {
+			return err
+		}
+
+		self.Endian = sections.Endian
+		self.Constants = sections.Constants
+
+		for i, value := range sections.Typedefs {
+			typedef := &TypedefDefinition{}
+			err = typedef.fromYAML(value)
+			if err != nil {
+				return setDefinitionIndex(err, i)
+			}
+			self.Typedefs = append(self.Typedefs, typedef)
+		}
+
+		self.Structs, err = structsFromYAML(sections.Structs)
+		return err
+
+	default:
+		return errors.New(
+			"Profile should be a list of structs or a map of sections")
+	}
+}
+
+func (self *ProfileDefinitions) MarshalYAML() (interface{}, error) {
+	if !self.hasSections() {
+		return self.Structs, nil
+	}
+
+	// Keep the sections in order.
+	result := yaml.MapSlice{}
+	if self.Endian != "" {
+		result = append(result, yaml.MapItem{Key: "endian", Value: self.Endian})
+	}
+	if self.Constants != nil && self.Constants.Len() > 0 {
+		constants, err := self.Constants.MarshalYAML()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, yaml.MapItem{Key: "constants", Value: constants})
+	}
+	if len(self.Typedefs) > 0 {
+		result = append(result, yaml.MapItem{Key: "typedefs", Value: self.Typedefs})
+	}
+	return append(result, yaml.MapItem{Key: "structs", Value: self.Structs}), nil
+}
+
+// Add the position of the definition in the document to the error.
+//
+// The YAML decoder of the definitions only gives the line of syntax
+// errors, which are returned as they are. Definitions are checked
+// after decoding, and the decoder has no way to find where a value
+// came from. So only when a definition error has no position is the
+// document parsed again with yaml.v3, whose nodes keep the line and
+// column of every value.
+func locateError(document []byte, err error) error {
+	var definition_error *DefinitionError
+	if !errors.As(err, &definition_error) || hasPosition(err) {
+		return err
+	}
+
+	// The document was already decoded so it should parse here
+	// too. Only the positions are used.
+	var root yaml3.Node
+	if yaml3.Unmarshal(document, &root) != nil || len(root.Content) == 0 {
+		return err
+	}
+
+	section := root.Content[0]
+	if section.Kind == yaml3.MappingNode {
+		section = yamlMapValue(section, definition_error.Kind+"s")
+
+	} else if definition_error.Kind != "struct" {
+		return err
+	}
+
+	if section == nil || section.Kind != yaml3.SequenceNode {
+		return err
+	}
+
+	node := yamlDefinitionNode(section, definition_error.Name,
+		definition_error.Index)
+	if node == nil {
+		return err
+	}
+	definition_error.Line = node.Line
+	definition_error.Column = node.Column
+
+	if definition_error.Field < 0 {
+		return err
+	}
+
+	var fields *yaml3.Node
+	switch {
+	case node.Kind == yaml3.MappingNode:
+		fields = yamlMapValue(node, "fields")
+	case len(node.Content) >= 3:
+		fields = node.Content[2]
+	}
+
+	if fields != nil && fields.Kind == yaml3.SequenceNode &&
+		definition_error.Field < len(fields.Content) {
+		field := fields.Content[definition_error.Field]
+		definition_error.Line = field.Line
+		definition_error.Column = field.Column
+	}
+
+	return err
+}
+
+// Whether any definition error in the chain already has a position.
+func hasPosition(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		definition_error, ok := err.(*DefinitionError)
+		if ok && definition_error.Line > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func yamlMapValue(node *yaml3.Node, key string) *yaml3.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Find the definition by its index or by its name.
+func yamlDefinitionNode(section *yaml3.Node, name string, index int) *yaml3.Node {
+	if index >= 0 && index < len(section.Content) {
+		return section.Content[index]
+	}
+
+	for _, node := range section.Content {
+		switch node.Kind {
+		case yaml3.SequenceNode:
+			if len(node.Content) > 0 && node.Content[0].Value == name {
+				return node
+			}
+
+		case yaml3.MappingNode:
+			value := yamlMapValue(node, "name")
+			if value != nil && value.Value == name {
+				return node
+			}
+		}
+	}
+	return nil
+}